@@ -14,12 +14,30 @@ import (
 )
 
 func main() {
+	// Offline subcommands: astradb backup|restore|wal [flags]
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backup":
+			os.Exit(runBackup(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "wal":
+			os.Exit(runWAL(os.Args[2:]))
+		}
+	}
+
 	// -----------------------------
 	// Command Line Flags
 	// -----------------------------
 	walMode := flag.String("wal-mode", "batch", "WAL sync mode: immediate, batch, async")
 	walBatch := flag.Int("wal-batch", 100, "WAL batch size")
 	checkpointInterval := flag.Int("checkpoint", 60, "Checkpoint interval (seconds)")
+	compression := flag.String("compression", engine.DefaultSegmentCompression, "Sealed segment compression: none, flate, zlib")
+	migrate := flag.Bool("migrate-legacy", false, "Convert legacy data.db collections to segments at startup")
+	walSegment := flag.Int64("wal-segment-size", engine.DefaultWALSegmentSize, "Size at which a new WAL file is started (bytes)")
+	walRetention := flag.Duration("wal-retention", engine.DefaultWALRetentionAge, "Delete archived WAL files older than this (0 keeps them)")
+	walRetainFiles := flag.Int("wal-retain-files", 0, "Keep at most this many archived WAL files (0 for no limit)")
+	walRetainBytes := flag.Int64("wal-retain-bytes", 0, "Keep at most this many bytes of archived WAL (0 for no limit)")
 	flag.Parse()
 
 	cfg := engine.DefaultConfig()
@@ -27,6 +45,12 @@ func main() {
 	cfg.WALSyncMode = engine.WALSyncMode(*walMode)
 	cfg.WALBatchSize = *walBatch
 	cfg.CheckpointInterval = time.Duration(*checkpointInterval) * time.Second
+	cfg.SegmentCompression = *compression
+	cfg.MigrateLegacyOnStartup = *migrate
+	cfg.WALSegmentSize = *walSegment
+	cfg.WALRetentionAge = *walRetention
+	cfg.WALRetentionCount = *walRetainFiles
+	cfg.WALRetentionBytes = *walRetainBytes
 
 	// -----------------------------
 	// Initialize Engine
@@ -36,7 +60,7 @@ func main() {
 		log.Fatalf("Engine initialization failed: %v", err)
 	}
 
-	eng.StartAutoCompaction(5 * time.Minute)
+	eng.StartAutoCompaction()
 
 	router := api.NewRouter(eng)
 
@@ -59,7 +83,14 @@ func main() {
 	log.Printf("WAL Mode           : %s", cfg.WALSyncMode)
 	log.Printf("WAL Batch Size     : %d", cfg.WALBatchSize)
 	log.Printf("Checkpoint Interval: %s", cfg.CheckpointInterval)
-	log.Printf("Auto Compaction    : every 5m")
+	log.Printf("WAL Files          : %d bytes, archive kept %s", cfg.WALSegmentSize, cfg.WALRetentionAge)
+	log.Printf("Compression        : %s", cfg.SegmentCompression)
+	if cfg.EnableAutoCompaction {
+		log.Printf("Auto Compaction    : every %ds (dead space >= %d%%, %d segments per tier)",
+			cfg.CompactionInterval, cfg.DeadSpaceThreshold, cfg.CompactionThreshold)
+	} else {
+		log.Printf("Auto Compaction    : disabled")
+	}
 	log.Println("--------------------------------------------------")
 	log.Println("Server is ready to accept connections")
 	log.Println("")
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"testDB/internal/engine"
+)
+
+// runWAL implements `astradb wal <command>`. The only command is dump.
+func runWAL(args []string) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: astradb wal dump [flags]")
+		return 2
+	}
+	return runWALDump(args[1:])
+}
+
+// runWALDump implements `astradb wal dump`: the WAL entries of a data
+// directory as JSON lines on stdout, with a summary, and any corruption
+// found, on stderr. A running server serves the same through
+// GET /api/wal/entries.
+func runWALDump(args []string) int {
+	defaults := engine.DefaultConfig()
+
+	fs := flag.NewFlagSet("wal dump", flag.ExitOnError)
+	walDir := fs.String("wal-dir", defaults.WALDir, "WAL directory")
+	archiveDir := fs.String("archive-dir", defaults.WALArchiveDir, "Archived WAL directory")
+	archive := fs.Bool("archive", false, "Include the archived WAL files")
+	db := fs.String("db", "", "Only entries of this database")
+	coll := fs.String("collection", "", "Only entries of this collection")
+	op := fs.String("op", "", "Only entries of this operation (insert, update, delete, ...)")
+	fromSeq := fs.Int64("from-seq", 0, "First WAL sequence")
+	toSeq := fs.Int64("to-seq", 0, "Last WAL sequence")
+	since := fs.String("since", "", "First commit time (RFC 3339)")
+	until := fs.String("until", "", "Last commit time (RFC 3339)")
+	fs.Parse(args)
+
+	filter := engine.WALFilter{
+		DB:         *db,
+		Collection: *coll,
+		Op:         *op,
+		FromSeq:    *fromSeq,
+		ToSeq:      *toSeq,
+		Archive:    *archive,
+	}
+	for _, p := range []struct {
+		name, value string
+		dst         *time.Time
+	}{{"since", *since, &filter.Since}, {"until", *until, &filter.Until}} {
+		if p.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, p.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "wal dump: invalid --%s: %v\n", p.name, err)
+			return 2
+		}
+		*p.dst = t
+	}
+
+	summary, err := engine.DumpWAL(os.Stdout, *walDir, *archiveDir, filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wal dump: %v\n", err)
+		return 1
+	}
+	for _, c := range summary.Corruptions {
+		fmt.Fprintf(os.Stderr, "wal dump: corruption in %v\n", c)
+	}
+	b, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Fprintln(os.Stderr, string(b))
+	return 0
+}
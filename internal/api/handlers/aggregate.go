@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"testDB/internal/engine"
+	"testDB/internal/types"
+)
+
+// Aggregate runs an aggregation pipeline and returns the documents its
+// last stage outputs. A malformed pipeline is answered with 400.
+func (h *Handlers) Aggregate(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) { return }
+	if r.Method != "POST" {
+		writeJSON(w, 405, map[string]any{"success": false, "error": "Method not allowed"})
+		return
+	}
+
+	var req types.AggregateRequest
+	if err := readBodyJSON(r, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "Invalid JSON: " + err.Error()})
+		return
+	}
+	if req.DB == "" { req.DB = "default" }
+
+	res, err := h.eng.Aggregate(req.DB, req.Collection, req.Pipeline)
+	if err != nil {
+		status := 500
+		if errors.Is(err, engine.ErrInvalidPipeline) {
+			status = 400
+		}
+		writeJSON(w, status, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "count": len(res), "data": res})
+}
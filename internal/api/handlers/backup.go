@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// Backup writes a base backup of every collection, for point-in-time
+// restore, to the directory given by the dir parameter. The directory
+// must be empty or absent.
+func (h *Handlers) Backup(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{
+			"success": false,
+			"error":   "POST required",
+		})
+		return
+	}
+
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		writeJSON(w, 400, map[string]any{
+			"success": false,
+			"error":   "dir parameter required",
+		})
+		return
+	}
+
+	label, err := h.eng.Backup(dir)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{
+		"success": true,
+		"label":   label,
+	})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+
+	"testDB/internal/engine"
+	"testDB/internal/types"
+)
+
+// Bulk applies a batch of writes to one collection, sharing one fsync, and
+// reports each op's result. A failed op doesn't fail the request: an
+// ordered batch (the default) stops there, an unordered one carries on.
+func (h *Handlers) Bulk(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) { return }
+	if r.Method != "POST" {
+		writeJSON(w, 405, map[string]any{"success": false, "error": "Method not allowed"})
+		return
+	}
+
+	var req types.BulkRequest
+	if err := readBodyJSON(r, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "Invalid JSON: " + err.Error()})
+		return
+	}
+	if req.DB == "" { req.DB = "default" }
+	wc, err := engine.ParseWriteConcern(req.WriteConcern)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+	if len(req.Ops) == 0 {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "ops is required"})
+		return
+	}
+	ordered := req.Ordered == nil || *req.Ordered
+
+	ops := make([]engine.BulkOp, len(req.Ops))
+	for i, op := range req.Ops {
+		ops[i] = engine.BulkOp{
+			Op:          op.Op,
+			Doc:         op.Doc,
+			Filter:      op.Filter,
+			Update:      op.Update,
+			Replacement: op.Replacement,
+			Upsert:      op.Upsert,
+		}
+	}
+
+	res, err := h.eng.BulkWriteWithConcern(req.DB, req.Collection, ops, ordered, wc)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]any{
+		"success":  res.Errors == 0,
+		"inserted": res.Inserted,
+		"updated":  res.Updated,
+		"deleted":  res.Deleted,
+		"upserted": res.Upserted,
+		"errors":   res.Errors,
+		"results":  res.Results,
+	})
+}
@@ -6,12 +6,15 @@ import (
 	"io"
 	"net/http"
 	"bytes"
+
+	"testDB/internal/engine"
 )
 
 func cors(w http.ResponseWriter, r *http.Request) bool {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match, If-None-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(200)
 		return true
@@ -38,3 +41,12 @@ func readBodyJSON(r *http.Request, out any) error {
 	dec.UseNumber()
 	return dec.Decode(out)
 }
+
+// writeErrorStatus is the status for a failed write: 409 when it lost to a
+// concurrent change, 500 otherwise.
+func writeErrorStatus(err error) int {
+	if errors.Is(err, engine.ErrVersionConflict) || errors.Is(err, engine.ErrTxnConflict) {
+		return 409
+	}
+	return 500
+}
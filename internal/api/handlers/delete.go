@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 
+	"testDB/internal/engine"
 	"testDB/internal/types"
 )
 
@@ -19,10 +20,30 @@ func (h *Handlers) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if req.DB == "" { req.DB = "default" }
+	wc, err := engine.ParseWriteConcern(req.WriteConcern)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
 
-	n, err := h.eng.Delete(req.DB, req.Collection, req.Filter, req.Multi, true)
+	if req.IfVersion != nil && (req.Multi || req.TxnID != "") {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "ifVersion applies to a single document outside a transaction"})
+		return
+	}
+
+	var n int
+	switch {
+	case req.TxnID != "":
+		txn, ok := h.txn(w, req.TxnID)
+		if !ok { return }
+		n, err = txn.Delete(req.DB, req.Collection, req.Filter, req.Multi)
+	case req.IfVersion != nil:
+		n, err = h.eng.DeleteIfVersion(req.DB, req.Collection, req.Filter, *req.IfVersion, wc)
+	default:
+		n, err = h.eng.DeleteWithConcern(req.DB, req.Collection, req.Filter, req.Multi, wc)
+	}
 	if err != nil {
-		writeJSON(w, 500, map[string]any{"success": false, "error": err.Error()})
+		writeJSON(w, writeErrorStatus(err), map[string]any{"success": false, "error": err.Error()})
 		return
 	}
 	writeJSON(w, 200, map[string]any{"success": true, "deleted": n})
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"testDB/internal/engine"
+	"testDB/internal/types"
+)
+
+// Doc serves a single document, named by db, collection and id in the
+// query string. GET returns it with its _version as ETag; POST or PATCH
+// applies {"update": ...} to it and DELETE removes it. An If-Match header
+// makes a write conditional on the document still being at that version,
+// answering 412 if it isn't, and GET answers 304 to a matching
+// If-None-Match.
+func (h *Handlers) Doc(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	db, coll, id := q.Get("db"), q.Get("collection"), q.Get("id")
+	if db == "" {
+		db = "default"
+	}
+	if id == "" {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "id is required"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		doc, ok := h.getDoc(w, db, coll, id)
+		if !ok {
+			return
+		}
+		etag := docETag(doc)
+		w.Header().Set("ETag", etag)
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "data": doc})
+
+	case http.MethodPost, http.MethodPatch:
+		var req types.DocUpdateRequest
+		if err := readBodyJSON(r, &req); err != nil {
+			writeJSON(w, 400, map[string]any{"success": false, "error": "Invalid JSON: " + err.Error()})
+			return
+		}
+		wc, err := engine.ParseWriteConcern(req.WriteConcern)
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"success": false, "error": err.Error()})
+			return
+		}
+		version, ok := h.ifMatch(w, r, db, coll, id)
+		if !ok {
+			return
+		}
+
+		filter := map[string]any{"_id": id}
+		var n int
+		if version == nil {
+			n, err = h.eng.UpdateWithConcern(db, coll, filter, req.Update, false, wc)
+		} else {
+			n, err = h.eng.UpdateIfVersion(db, coll, filter, req.Update, *version, wc)
+		}
+		if !docWritten(w, n, err) {
+			return
+		}
+		doc, ok := h.getDoc(w, db, coll, id)
+		if !ok {
+			return
+		}
+		w.Header().Set("ETag", docETag(doc))
+		writeJSON(w, 200, map[string]any{"success": true, "updated": n, "data": doc})
+
+	case http.MethodDelete:
+		wc, err := engine.ParseWriteConcern(q.Get("writeConcern"))
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"success": false, "error": err.Error()})
+			return
+		}
+		version, ok := h.ifMatch(w, r, db, coll, id)
+		if !ok {
+			return
+		}
+
+		filter := map[string]any{"_id": id}
+		var n int
+		if version == nil {
+			n, err = h.eng.DeleteWithConcern(db, coll, filter, false, wc)
+		} else {
+			n, err = h.eng.DeleteIfVersion(db, coll, filter, *version, wc)
+		}
+		if !docWritten(w, n, err) {
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "deleted": n})
+
+	default:
+		writeJSON(w, 405, map[string]any{"success": false, "error": "Method not allowed"})
+	}
+}
+
+// getDoc reads the document with id, answering 404 if there is none.
+func (h *Handlers) getDoc(w http.ResponseWriter, db, coll, id string) (types.Document, bool) {
+	docs, err := h.eng.Query(db, coll, map[string]any{"_id": id}, nil, 1, 0, nil)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"success": false, "error": err.Error()})
+		return nil, false
+	}
+	if len(docs) == 0 {
+		writeJSON(w, 404, map[string]any{"success": false, "error": "document not found"})
+		return nil, false
+	}
+	return docs[0], true
+}
+
+// ifMatch returns the version an If-Match header asks for, or nil when the
+// write is unconditional. "*" only asks for the document to exist.
+func (h *Handlers) ifMatch(w http.ResponseWriter, r *http.Request, db, coll, id string) (*int64, bool) {
+	im := strings.TrimSpace(r.Header.Get("If-Match"))
+	if im == "" {
+		return nil, true
+	}
+	if im == "*" {
+		if _, ok := h.getDoc(w, db, coll, id); !ok {
+			return nil, false
+		}
+		return nil, true
+	}
+
+	// A list of tags can't name more than one version of one document
+	v, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(im, "W/"), `"`), 10, 64)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "invalid If-Match: " + im})
+		return nil, false
+	}
+	return &v, true
+}
+
+// docWritten answers a failed or missed single-document write: 412 when
+// If-Match didn't hold, 404 when there was no such document.
+func docWritten(w http.ResponseWriter, n int, err error) bool {
+	switch {
+	case errors.Is(err, engine.ErrVersionConflict):
+		writeJSON(w, http.StatusPreconditionFailed, map[string]any{"success": false, "error": err.Error()})
+		return false
+	case err != nil:
+		writeJSON(w, 500, map[string]any{"success": false, "error": err.Error()})
+		return false
+	case n == 0:
+		writeJSON(w, 404, map[string]any{"success": false, "error": "document not found"})
+		return false
+	}
+	return true
+}
+
+// docETag is a document's strong entity tag: its _version, quoted.
+func docETag(doc types.Document) string {
+	return strconv.Quote(strconv.FormatInt(engine.DocVersion(doc), 10))
+}
+
+// etagMatches reports whether an If-None-Match list names etag. Weak
+// comparison applies, as for GET.
+func etagMatches(list, etag string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
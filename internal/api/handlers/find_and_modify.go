@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+
+	"testDB/internal/engine"
+	"testDB/internal/types"
+)
+
+// FindAndModify updates or removes the first document matching filter, in
+// sort order, and returns it in data: as it was before the change, or
+// after it with "new": true. data is null when nothing matched.
+func (h *Handlers) FindAndModify(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) { return }
+	if r.Method != "POST" {
+		writeJSON(w, 405, map[string]any{"success": false, "error": "Method not allowed"})
+		return
+	}
+
+	var req types.FindAndModifyRequest
+	if err := readBodyJSON(r, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "Invalid JSON: " + err.Error()})
+		return
+	}
+	if req.DB == "" { req.DB = "default" }
+	wc, err := engine.ParseWriteConcern(req.WriteConcern)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+
+	doc, err := h.eng.FindAndModify(req.DB, req.Collection, engine.FindAndModifyOptions{
+		Filter:     req.Filter,
+		Sort:       req.Sort,
+		Update:     req.Update,
+		Remove:     req.Remove,
+		Upsert:     req.Upsert,
+		New:        req.New,
+		Projection: req.Projection,
+	}, wc)
+	if err != nil {
+		writeJSON(w, writeErrorStatus(err), map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true, "data": doc})
+}
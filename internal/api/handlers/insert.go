@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 
+	"testDB/internal/engine"
 	"testDB/internal/types"
 )
 
@@ -19,8 +20,20 @@ func (h *Handlers) Insert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if req.DB == "" { req.DB = "default" }
+	wc, err := engine.ParseWriteConcern(req.WriteConcern)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
 
-	id, err := h.eng.Insert(req.DB, req.Collection, req.Data, true)
+	var id string
+	if req.TxnID != "" {
+		txn, ok := h.txn(w, req.TxnID)
+		if !ok { return }
+		id, err = txn.Insert(req.DB, req.Collection, req.Data)
+	} else {
+		id, err = h.eng.InsertWithConcern(req.DB, req.Collection, req.Data, wc)
+	}
 	if err != nil {
 		writeJSON(w, 500, map[string]any{"success": false, "error": err.Error()})
 		return
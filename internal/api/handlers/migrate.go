@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// Migrate converts a legacy data.db collection to segment storage.
+func (h *Handlers) Migrate(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{
+			"success": false,
+			"error":   "POST required",
+		})
+		return
+	}
+
+	db := r.URL.Query().Get("db")
+	coll := r.URL.Query().Get("collection")
+
+	if db == "" {
+		db = "default"
+	}
+
+	if coll == "" {
+		writeJSON(w, 400, map[string]any{
+			"success": false,
+			"error":   "collection parameter required",
+		})
+		return
+	}
+
+	report, err := h.eng.MigrateToSegments(db, coll)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{
+		"success": true,
+		"report":  report,
+	})
+}
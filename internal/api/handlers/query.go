@@ -20,7 +20,29 @@ func (h *Handlers) Query(w http.ResponseWriter, r *http.Request) {
 	}
 	if req.DB == "" { req.DB = "default" }
 
-	res, err := h.eng.Query(req.DB, req.Collection, req.Filter, req.Sort, req.Limit, req.Skip, req.Projection)
+	if req.Explain {
+		if req.TxnID != "" {
+			writeJSON(w, 400, map[string]any{"success": false, "error": "explain can't be used in a transaction"})
+			return
+		}
+		res, explain, err := h.eng.Explain(req.DB, req.Collection, req.Filter, req.Sort, req.Limit, req.Skip, req.Projection)
+		if err != nil {
+			writeJSON(w, 500, map[string]any{"success": false, "error": err.Error()})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"success": true, "count": len(res), "data": res, "explain": explain})
+		return
+	}
+
+	var res []types.Document
+	var err error
+	if req.TxnID != "" {
+		txn, ok := h.txn(w, req.TxnID)
+		if !ok { return }
+		res, err = txn.Query(req.DB, req.Collection, req.Filter, req.Sort, req.Limit, req.Skip, req.Projection)
+	} else {
+		res, err = h.eng.Query(req.DB, req.Collection, req.Filter, req.Sort, req.Limit, req.Skip, req.Projection)
+	}
 	if err != nil {
 		writeJSON(w, 500, map[string]any{"success": false, "error": err.Error()})
 		return
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// Scrub checks a collection's segments for corrupt records.
+// With repair=true, damaged segments are rewritten and quarantined.
+func (h *Handlers) Scrub(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) {
+		return
+	}
+
+	db := r.URL.Query().Get("db")
+	coll := r.URL.Query().Get("collection")
+	repair := r.URL.Query().Get("repair") == "true"
+
+	if db == "" {
+		db = "default"
+	}
+
+	if coll == "" {
+		writeJSON(w, 400, map[string]any{
+			"success": false,
+			"error":   "collection parameter required",
+		})
+		return
+	}
+
+	if repair && r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{
+			"success": false,
+			"error":   "repair requires POST",
+		})
+		return
+	}
+
+	scrub := h.eng.Scrub
+	if repair {
+		scrub = h.eng.RepairCollection
+	}
+	report, err := scrub(db, coll)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+			"report":  report,
+		})
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{
+		"success": true,
+		"healthy": report.CorruptRecords == 0 && len(report.Quarantined) == 0,
+		"report":  report,
+	})
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+
+	"testDB/internal/engine"
+	"testDB/internal/types"
+)
+
+// TxnBegin starts a transaction. Insert, update, delete and query requests
+// carrying its txnId are buffered in it until /api/txn/commit.
+func (h *Handlers) TxnBegin(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) { return }
+	if r.Method != "POST" {
+		writeJSON(w, 405, map[string]any{"success": false, "error": "Method not allowed"})
+		return
+	}
+
+	txn := h.eng.Begin()
+	writeJSON(w, 200, map[string]any{"success": true, "txnId": txn.ID})
+}
+
+// TxnCommit applies a transaction atomically. A conflict with another
+// writer is reported as 409 and nothing is applied.
+func (h *Handlers) TxnCommit(w http.ResponseWriter, r *http.Request) {
+	req, txn, ok := h.readTxnRequest(w, r)
+	if !ok {
+		return
+	}
+	wc, err := engine.ParseWriteConcern(req.WriteConcern)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+
+	if err := txn.CommitWithConcern(wc); err != nil {
+		writeJSON(w, writeErrorStatus(err), map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true})
+}
+
+// TxnAbort discards a transaction.
+func (h *Handlers) TxnAbort(w http.ResponseWriter, r *http.Request) {
+	_, txn, ok := h.readTxnRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := txn.Abort(); err != nil {
+		writeJSON(w, 404, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"success": true})
+}
+
+func (h *Handlers) readTxnRequest(w http.ResponseWriter, r *http.Request) (types.TxnRequest, *engine.Txn, bool) {
+	var req types.TxnRequest
+	if cors(w, r) { return req, nil, false }
+	if r.Method != "POST" {
+		writeJSON(w, 405, map[string]any{"success": false, "error": "Method not allowed"})
+		return req, nil, false
+	}
+	if err := readBodyJSON(r, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "Invalid JSON: " + err.Error()})
+		return req, nil, false
+	}
+	txn, ok := h.txn(w, req.TxnID)
+	return req, txn, ok
+}
+
+// txn looks up the transaction a request names, answering 404 if there is
+// no such open transaction.
+func (h *Handlers) txn(w http.ResponseWriter, id string) (*engine.Txn, bool) {
+	txn, err := h.eng.Txn(id)
+	if err != nil {
+		writeJSON(w, 404, map[string]any{"success": false, "error": err.Error()})
+		return nil, false
+	}
+	return txn, true
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 
+	"testDB/internal/engine"
 	"testDB/internal/types"
 )
 
@@ -19,11 +20,42 @@ func (h *Handlers) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if req.DB == "" { req.DB = "default" }
+	wc, err := engine.ParseWriteConcern(req.WriteConcern)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"success": false, "error": err.Error()})
+		return
+	}
+
+	if req.IfVersion != nil && (req.Multi || req.TxnID != "" || req.Upsert) {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "ifVersion applies to a single existing document outside a transaction"})
+		return
+	}
+	if req.Upsert && req.TxnID != "" {
+		writeJSON(w, 400, map[string]any{"success": false, "error": "upsert is not supported in a transaction"})
+		return
+	}
 
-	n, err := h.eng.Update(req.DB, req.Collection, req.Filter, req.Update, req.Multi, true)
+	var n int
+	var upsertedID string
+	switch {
+	case req.TxnID != "":
+		txn, ok := h.txn(w, req.TxnID)
+		if !ok { return }
+		n, err = txn.Update(req.DB, req.Collection, req.Filter, req.Update, req.Multi)
+	case req.IfVersion != nil:
+		n, err = h.eng.UpdateIfVersion(req.DB, req.Collection, req.Filter, req.Update, *req.IfVersion, wc)
+	case req.Upsert:
+		n, upsertedID, err = h.eng.Upsert(req.DB, req.Collection, req.Filter, req.Update, req.Multi, wc)
+	default:
+		n, err = h.eng.UpdateWithConcern(req.DB, req.Collection, req.Filter, req.Update, req.Multi, wc)
+	}
 	if err != nil {
-		writeJSON(w, 500, map[string]any{"success": false, "error": err.Error()})
+		writeJSON(w, writeErrorStatus(err), map[string]any{"success": false, "error": err.Error()})
 		return
 	}
-	writeJSON(w, 200, map[string]any{"success": true, "updated": n})
+	res := map[string]any{"success": true, "updated": n}
+	if upsertedID != "" {
+		res["upsertedId"] = upsertedID
+	}
+	writeJSON(w, 200, res)
 }
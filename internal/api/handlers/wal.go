@@ -1,18 +1,93 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"testDB/internal/engine"
 )
 
+// WALStats reports the WAL position and files. With archive=true the
+// archived files are read for their entry counts too.
 func (h *Handlers) WALStats(w http.ResponseWriter, r *http.Request) {
 	if cors(w, r) {
 		return
 	}
 
-	stats := h.eng.WALStats()
+	stats := h.eng.WALStats(r.URL.Query().Get("archive") == "true")
 
 	writeJSON(w, 200, map[string]any{
 		"success": true,
 		"stats":   stats,
 	})
-}
\ No newline at end of file
+}
+
+// WALEntries streams the WAL entries matching the db, collection, op,
+// from_seq, to_seq, since and until parameters as NDJSON, one entry per
+// line, with a {"corruption": ...} line wherever a file stops being
+// readable. archive=true includes the archived files.
+func (h *Handlers) WALEntries(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeJSON(w, 405, map[string]any{
+			"success": false,
+			"error":   "GET required",
+		})
+		return
+	}
+
+	filter, err := parseWALFilter(r.URL.Query())
+	if err != nil {
+		writeJSON(w, 400, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(200)
+	// The status is sent: a read error can only end the stream
+	_, _ = h.eng.DumpWAL(w, filter)
+}
+
+func parseWALFilter(q url.Values) (engine.WALFilter, error) {
+	filter := engine.WALFilter{
+		DB:         q.Get("db"),
+		Collection: q.Get("collection"),
+		Op:         q.Get("op"),
+		Archive:    q.Get("archive") == "true",
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"from_seq", &filter.FromSeq}, {"to_seq", &filter.ToSeq}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %v", p.name, err)
+			}
+			*p.dst = n
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %v", p.name, err)
+			}
+			*p.dst = t
+		}
+	}
+	return filter, nil
+}
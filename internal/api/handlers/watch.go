@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"testDB/internal/engine"
+)
+
+// watchHeartbeat is how long a change stream stays silent before a
+// keep-alive is sent.
+const watchHeartbeat = 15 * time.Second
+
+// Watch streams the inserts, updates and deletes of a database (db) or
+// one of its collections (collection) as Server-Sent Events, or over a
+// WebSocket when the request asks for an upgrade. filter, a JSON filter,
+// selects the changed documents; each event carries a token, and a client
+// that reconnects with it (resume_after, or the Last-Event-ID header)
+// receives the events it missed.
+func (h *Handlers) Watch(w http.ResponseWriter, r *http.Request) {
+	if cors(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeJSON(w, 405, map[string]any{
+			"success": false,
+			"error":   "GET required",
+		})
+		return
+	}
+
+	opts, err := parseWatchOptions(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if isWebSocketUpgrade(r) {
+		h.watchWebSocket(w, r, opts)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, 500, map[string]any{
+			"success": false,
+			"error":   "streaming unsupported",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	err = h.streamChanges(r.Context(), opts, func(ev *engine.ChangeEvent) error {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", ev.Token, b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}, func() error {
+		if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		b, _ := json.Marshal(map[string]any{"error": err.Error()})
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+		flusher.Flush()
+	}
+}
+
+// watchWebSocket serves a change stream as one JSON text message per event.
+func (h *Handlers) watchWebSocket(w http.ResponseWriter, r *http.Request, opts engine.WatchOptions) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	// The server no longer watches a hijacked connection: the client's
+	// close ends the stream
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		ws.readLoop()
+		cancel()
+	}()
+
+	err = h.streamChanges(ctx, opts, func(ev *engine.ChangeEvent) error {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		return ws.writeText(b)
+	}, ws.ping)
+	if err != nil && ctx.Err() == nil {
+		b, _ := json.Marshal(map[string]any{"error": err.Error()})
+		ws.writeText(b)
+		ws.close(1011, err.Error())
+		return
+	}
+	ws.close(1000, "")
+}
+
+// streamChanges runs a change stream, passing each event to send and
+// calling ping whenever the stream has been idle for watchHeartbeat. It
+// returns once ctx is done, or with the error that ended the stream.
+func (h *Handlers) streamChanges(ctx context.Context, opts engine.WatchOptions, send func(*engine.ChangeEvent) error, ping func() error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan *engine.ChangeEvent)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.eng.Watch(ctx, opts, func(ev *engine.ChangeEvent) error {
+			select {
+			case events <- ev:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(watchHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if err := send(ev); err != nil {
+				return err
+			}
+			ticker.Reset(watchHeartbeat)
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return err
+			}
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+func parseWatchOptions(r *http.Request) (engine.WatchOptions, error) {
+	q := r.URL.Query()
+	opts := engine.WatchOptions{
+		DB:         q.Get("db"),
+		Collection: q.Get("collection"),
+	}
+	if opts.DB == "" {
+		opts.DB = "default"
+	}
+
+	if f := q.Get("filter"); f != "" {
+		dec := json.NewDecoder(bytes.NewReader([]byte(f)))
+		dec.UseNumber()
+		if err := dec.Decode(&opts.Filter); err != nil {
+			return opts, fmt.Errorf("invalid filter: %v", err)
+		}
+	}
+
+	token := q.Get("resume_after")
+	if token == "" {
+		// Sent by EventSource when it reconnects
+		token = r.Header.Get("Last-Event-ID")
+	}
+	if token != "" {
+		t, err := engine.ParseResumeToken(token)
+		if err != nil {
+			return opts, err
+		}
+		opts.ResumeAfter = &t
+	}
+	return opts, nil
+}
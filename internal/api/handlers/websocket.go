@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Just enough of RFC 6455 for endpoints that push to the client: the
+// opening handshake, unfragmented text frames out, and the control frames
+// a client sends. Messages from the client are read and ignored.
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	wsWriteTimeout = 10 * time.Second
+	wsMaxMessage   = 1 << 20
+)
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex // serializes frame writes
+}
+
+// isWebSocketUpgrade reports whether the request asks to switch to the
+// WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the handshake and takes the connection over
+// from the HTTP server. On error nothing has been written yet.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported WebSocket handshake")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can't be upgraded")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeText(b []byte) error { return c.writeFrame(wsOpText, b) }
+
+func (c *wsConn) ping() error { return c.writeFrame(wsOpPing, nil) }
+
+// close sends a close frame with the status code and reason, then closes
+// the connection.
+func (c *wsConn) close(code uint16, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	c.writeFrame(wsOpClose, append(payload, reason...))
+	return c.conn.Close()
+}
+
+// readLoop reads the client's frames, answering pings, until the client
+// closes the connection or it fails.
+func (c *wsConn) readLoop() error {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+			return err
+		}
+		op := head[0] & 0x0F
+		masked := head[1]&0x80 != 0
+		n := uint64(head[1] & 0x7F)
+		switch n {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+				return err
+			}
+			n = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+				return err
+			}
+			n = binary.BigEndian.Uint64(b[:])
+		}
+		if n > wsMaxMessage {
+			return errors.New("WebSocket message too large")
+		}
+
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+				return err
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch op {
+		case wsOpClose:
+			return nil
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
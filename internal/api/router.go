@@ -28,8 +28,12 @@ func NewRouter(e *engine.Engine) http.Handler {
 	protected := http.NewServeMux()
 	protected.HandleFunc("/api/insert", h.Insert)
 	protected.HandleFunc("/api/query", h.Query)
+	protected.HandleFunc("/api/aggregate", h.Aggregate)
 	protected.HandleFunc("/api/update", h.Update)
 	protected.HandleFunc("/api/delete", h.Delete)
+	protected.HandleFunc("/api/doc", h.Doc)
+	protected.HandleFunc("/api/findAndModify", h.FindAndModify)
+	protected.HandleFunc("/api/bulk", h.Bulk)
 	protected.HandleFunc("/api/list", h.List)
 	protected.HandleFunc("/api/databases", h.Databases)
 	protected.HandleFunc("/api/collections", h.Collections)
@@ -37,6 +41,10 @@ func NewRouter(e *engine.Engine) http.Handler {
 	protected.HandleFunc("/api/createIndex", h.CreateIndex)
 	protected.HandleFunc("/api/compact", h.Compact)
 	protected.HandleFunc("/api/segment-stats", h.SegmentStats)
+	protected.HandleFunc("/api/watch", h.Watch)
+	protected.HandleFunc("/api/txn/begin", h.TxnBegin)
+	protected.HandleFunc("/api/txn/commit", h.TxnCommit)
+	protected.HandleFunc("/api/txn/abort", h.TxnAbort)
 	// Schema endpoints
 	protected.HandleFunc("/api/schema/create", h.SaveSchema)
 	protected.HandleFunc("/api/schema", h.GetSchema)
@@ -48,6 +56,10 @@ func NewRouter(e *engine.Engine) http.Handler {
 	protected.HandleFunc("/api/auth/users", authSystem.RequireAdmin(authH.ListUsers))
 	protected.HandleFunc("/api/auth/create-user", authSystem.RequireAdmin(authH.CreateUser))
 	protected.HandleFunc("/api/auth/delete-user", authSystem.RequireAdmin(authH.DeleteUser))
+	protected.HandleFunc("/api/admin/scrub", authSystem.RequireAdmin(h.Scrub))
+	protected.HandleFunc("/api/admin/migrate", authSystem.RequireAdmin(h.Migrate))
+	protected.HandleFunc("/api/admin/backup", authSystem.RequireAdmin(h.Backup))
+	protected.HandleFunc("/api/wal/entries", authSystem.RequireAdmin(h.WALEntries))
 
 	// User endpoints
 	protected.HandleFunc("/api/auth/rotate-key", authH.RotateAPIKey)
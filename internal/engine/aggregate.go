@@ -0,0 +1,514 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"testDB/internal/types"
+)
+
+// An aggregation pipeline is a list of stages, each an object with a single
+// key naming the stage:
+//
+//	$match     filter, as for Query
+//	$project   {field: 1 | 0 | expression}; _id is kept unless excluded
+//	$addFields {field: expression}
+//	$group     {_id: expression, field: {accumulator: expression}}
+//	$sort      {field: 1 | -1}
+//	$skip      n
+//	$limit     n
+//	$unwind    "$path", or {path: "$path", preserveNullAndEmptyArrays: bool}
+//	$count     field name
+//	$lookup    join with another collection, see lookupStage
+//
+// An expression is a "$path" string naming a field of the document, an
+// object or array whose values are expressions, or any other literal.
+// $group accumulators are $sum, $avg, $min, $max, $push and $count.
+
+// ErrInvalidPipeline is returned by Aggregate for a malformed pipeline.
+var ErrInvalidPipeline = errors.New("invalid pipeline")
+
+// Aggregate runs pipeline over the documents of a collection and returns
+// what its last stage outputs. A leading $match is answered from indexes
+// where one applies, as Query's filter is. Like Query, it reads a snapshot
+// and holds no collection lock while the stages run.
+func (e *Engine) Aggregate(dbName, collName string, pipeline []map[string]any) ([]types.Document, error) {
+	db, err := e.getOrCreateDB(dbName)
+	if err != nil {
+		return nil, err
+	}
+	c, err := db.getOrCreateCollection(e.cfg, collName)
+	if err != nil {
+		return nil, err
+	}
+	return e.aggregate(db, c, pipeline)
+}
+
+func (e *Engine) aggregate(db *Database, c *Collection, pipeline []map[string]any) ([]types.Document, error) {
+	for i, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("%w: stage %d must have exactly one key", ErrInvalidPipeline, i)
+		}
+	}
+
+	filter := map[string]any{}
+	if len(pipeline) > 0 {
+		if m, ok := pipeline[0]["$match"]; ok {
+			f, ok := m.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%w: $match must be an object", ErrInvalidPipeline)
+			}
+			filter, pipeline = f, pipeline[1:]
+		}
+	}
+
+	c.mu.RLock()
+	view, err := c.readViewLocked(filter)
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer view.release()
+
+	candidates, err := view.candidates(filter)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]types.Document, 0, len(candidates))
+	for _, d := range candidates {
+		if matchesFilter(d, filter) {
+			docs = append(docs, d)
+		}
+	}
+
+	return e.runStages(db, docs, pipeline)
+}
+
+// runStages runs pipeline over docs. Stages never modify their input:
+// documents may still be shared with the collection.
+func (e *Engine) runStages(db *Database, docs []types.Document, pipeline []map[string]any) ([]types.Document, error) {
+	var err error
+	for _, stage := range pipeline {
+		for name, spec := range stage {
+			if name == "$lookup" {
+				// Reports its own errors: they may come from reading the
+				// foreign collection, or from a nested pipeline
+				docs, err = e.lookupStage(db, docs, spec)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			docs, err = runStage(docs, name, spec)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidPipeline, name, err)
+			}
+		}
+	}
+	return docs, nil
+}
+
+func runStage(docs []types.Document, name string, spec any) ([]types.Document, error) {
+	switch name {
+	case "$match":
+		filter, ok := spec.(map[string]any)
+		if !ok {
+			return nil, errors.New("must be an object")
+		}
+		out := make([]types.Document, 0, len(docs))
+		for _, d := range docs {
+			if matchesFilter(d, filter) {
+				out = append(out, d)
+			}
+		}
+		return out, nil
+
+	case "$project":
+		m, ok := spec.(map[string]any)
+		if !ok {
+			return nil, errors.New("must be an object")
+		}
+		return projectStage(docs, m)
+
+	case "$addFields":
+		m, ok := spec.(map[string]any)
+		if !ok {
+			return nil, errors.New("must be an object")
+		}
+		out := make([]types.Document, len(docs))
+		for i, d := range docs {
+			nd := cloneDocument(d)
+			for _, f := range mapKeysSorted(m) {
+				setNestedField(nd, f, evalExpr(d, m[f]))
+			}
+			out[i] = nd
+		}
+		return out, nil
+
+	case "$group":
+		m, ok := spec.(map[string]any)
+		if !ok {
+			return nil, errors.New("must be an object")
+		}
+		return groupStage(docs, m)
+
+	case "$sort":
+		m, ok := spec.(map[string]any)
+		if !ok || len(m) == 0 {
+			return nil, errors.New("must be a non-empty object")
+		}
+		sortSpec := make(map[string]int, len(m))
+		for f, v := range m {
+			dir, ok := intArg(v)
+			if !ok || (dir != 1 && dir != -1) {
+				return nil, fmt.Errorf("direction of %s must be 1 or -1", f)
+			}
+			sortSpec[f] = dir
+		}
+		out := append([]types.Document(nil), docs...)
+		applySort(out, sortSpec)
+		return out, nil
+
+	case "$skip":
+		n, ok := intArg(spec)
+		if !ok || n < 0 {
+			return nil, errors.New("must be a non-negative integer")
+		}
+		return applySkipLimit(docs, n, 0), nil
+
+	case "$limit":
+		n, ok := intArg(spec)
+		if !ok || n <= 0 {
+			return nil, errors.New("must be a positive integer")
+		}
+		return applySkipLimit(docs, 0, n), nil
+
+	case "$unwind":
+		return unwindStage(docs, spec)
+
+	case "$count":
+		field, ok := spec.(string)
+		if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return nil, errors.New("must be a field name")
+		}
+		if len(docs) == 0 {
+			return []types.Document{}, nil
+		}
+		return []types.Document{{field: int64(len(docs))}}, nil
+	}
+	return nil, errors.New("unknown pipeline stage")
+}
+
+// projectStage keeps or drops the fields spec names, or sets them to
+// computed values. Inclusions and exclusions can't be mixed, except to
+// drop _id.
+func projectStage(docs []types.Document, spec map[string]any) ([]types.Document, error) {
+	include, exclude := false, false
+	for f, v := range spec {
+		if keep, ok := projectFlag(v); ok && !keep {
+			if f != "_id" {
+				exclude = true
+			}
+		} else {
+			include = true
+		}
+	}
+	if include && exclude {
+		return nil, errors.New("can't mix inclusion and exclusion")
+	}
+
+	out := make([]types.Document, len(docs))
+	for i, d := range docs {
+		if !include {
+			nd := cloneDocument(d)
+			for f := range spec {
+				unsetNestedField(nd, f)
+			}
+			out[i] = nd
+			continue
+		}
+
+		nd := types.Document{}
+		if keep, ok := projectFlag(spec["_id"]); !ok || keep {
+			if id, ok := d["_id"]; ok {
+				nd["_id"] = id
+			}
+		}
+		for _, f := range mapKeysSorted(spec) {
+			v := spec[f]
+			if keep, ok := projectFlag(v); ok {
+				if keep {
+					if val, ok := getNestedField(d, f); ok {
+						setNestedField(nd, f, cloneValue(val))
+					}
+				} else {
+					unsetNestedField(nd, f)
+				}
+				continue
+			}
+			setNestedField(nd, f, evalExpr(d, v))
+		}
+		out[i] = nd
+	}
+	return out, nil
+}
+
+// projectFlag reads a $project value of 1, 0, true or false.
+func projectFlag(v any) (keep bool, ok bool) {
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+	if _, isStr := v.(string); isStr {
+		return false, false
+	}
+	if n, ok := toNumber(v); ok {
+		return n != 0, true
+	}
+	return false, false
+}
+
+// groupStage buckets docs by the value of spec's _id expression and
+// outputs one document per bucket, in order of first appearance, holding
+// the bucket's _id and the accumulated fields.
+func groupStage(docs []types.Document, spec map[string]any) ([]types.Document, error) {
+	keyExpr, ok := spec["_id"]
+	if !ok {
+		return nil, errors.New("_id is required")
+	}
+
+	type accField struct {
+		name string
+		op   string
+		expr any
+	}
+	var fields []accField
+	for _, f := range mapKeysSorted(spec) {
+		if f == "_id" {
+			continue
+		}
+		m, ok := spec[f].(map[string]any)
+		if !ok || len(m) != 1 {
+			return nil, fmt.Errorf("%s must be an object with one accumulator", f)
+		}
+		for op, expr := range m {
+			switch op {
+			case "$sum", "$avg", "$min", "$max", "$push", "$count":
+			default:
+				return nil, fmt.Errorf("unknown accumulator %s", op)
+			}
+			fields = append(fields, accField{name: f, op: op, expr: expr})
+		}
+	}
+
+	type group struct {
+		key  any
+		accs []*accumulator
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, d := range docs {
+		key := evalExpr(d, keyExpr)
+		b, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		g, ok := groups[string(b)]
+		if !ok {
+			g = &group{key: key}
+			for _, f := range fields {
+				g.accs = append(g.accs, &accumulator{op: f.op})
+			}
+			groups[string(b)] = g
+			order = append(order, string(b))
+		}
+		for i, f := range fields {
+			if f.op == "$count" {
+				g.accs[i].add(int64(1), true)
+				continue
+			}
+			v, ok := evalField(d, f.expr)
+			g.accs[i].add(v, ok)
+		}
+	}
+
+	out := make([]types.Document, 0, len(order))
+	for _, k := range order {
+		g := groups[k]
+		nd := types.Document{"_id": g.key}
+		for i, f := range fields {
+			nd[f.name] = g.accs[i].result()
+		}
+		out = append(out, nd)
+	}
+	return out, nil
+}
+
+// accumulator folds the values of one $group field.
+type accumulator struct {
+	op     string
+	isum   int64
+	fsum   float64
+	float  bool // fsum holds the sum: a value wasn't an integer
+	n      int
+	best   any
+	values []any
+}
+
+// add folds in v; ok is false when the expression named a missing field.
+func (a *accumulator) add(v any, ok bool) {
+	switch a.op {
+	case "$sum", "$avg", "$count":
+		if _, isStr := v.(string); isStr || !ok {
+			return
+		}
+		f, isNum := toNumber(v)
+		if !isNum {
+			return
+		}
+		if i, isInt := v.(int64); isInt && !a.float {
+			a.isum += i
+		} else if i, isInt := v.(int); isInt && !a.float {
+			a.isum += int64(i)
+		} else {
+			if !a.float {
+				a.fsum, a.float = float64(a.isum), true
+			}
+			a.fsum += f
+		}
+		a.n++
+	case "$min", "$max":
+		if !ok || v == nil {
+			return
+		}
+		cmp := 0
+		if a.best != nil {
+			cmp = compareAny(v, a.best)
+		}
+		if a.best == nil || (a.op == "$min" && cmp < 0) || (a.op == "$max" && cmp > 0) {
+			a.best = v
+		}
+	case "$push":
+		if ok {
+			a.values = append(a.values, cloneValue(v))
+		}
+	}
+}
+
+func (a *accumulator) result() any {
+	switch a.op {
+	case "$sum", "$count":
+		if a.float {
+			return a.fsum
+		}
+		return a.isum
+	case "$avg":
+		if a.n == 0 {
+			return nil
+		}
+		if a.float {
+			return a.fsum / float64(a.n)
+		}
+		return float64(a.isum) / float64(a.n)
+	case "$push":
+		if a.values == nil {
+			return []any{}
+		}
+		return a.values
+	}
+	return a.best
+}
+
+// unwindStage outputs a copy of each document per element of the array at
+// the path spec names, with the field set to that element. A field that
+// isn't an array counts as an array of one; documents where it is missing,
+// null or empty are dropped unless preserveNullAndEmptyArrays is set.
+func unwindStage(docs []types.Document, spec any) ([]types.Document, error) {
+	path, preserve := "", false
+	switch s := spec.(type) {
+	case string:
+		path = s
+	case map[string]any:
+		path, _ = s["path"].(string)
+		if p, ok := s["preserveNullAndEmptyArrays"]; ok {
+			b, ok := p.(bool)
+			if !ok {
+				return nil, errors.New("preserveNullAndEmptyArrays must be a boolean")
+			}
+			preserve = b
+		}
+	}
+	if !strings.HasPrefix(path, "$") || len(path) < 2 {
+		return nil, errors.New(`path must be a "$field" string`)
+	}
+	path = path[1:]
+
+	out := make([]types.Document, 0, len(docs))
+	for _, d := range docs {
+		v, ok := getNestedField(d, path)
+		items, isArr := v.([]any)
+		switch {
+		case !ok || v == nil || (isArr && len(items) == 0):
+			if preserve {
+				nd := d
+				if isArr {
+					nd = cloneDocument(d)
+					unsetNestedField(nd, path)
+				}
+				out = append(out, nd)
+			}
+		case !isArr:
+			out = append(out, d)
+		default:
+			for _, item := range items {
+				nd := cloneDocument(d)
+				setNestedField(nd, path, item)
+				out = append(out, nd)
+			}
+		}
+	}
+	return out, nil
+}
+
+// evalExpr evaluates expr against doc; a missing field evaluates to nil.
+func evalExpr(doc types.Document, expr any) any {
+	v, _ := evalField(doc, expr)
+	return v
+}
+
+// evalField is evalExpr, also reporting false when expr is a "$path" that
+// names a missing field.
+func evalField(doc types.Document, expr any) (any, bool) {
+	switch x := expr.(type) {
+	case string:
+		if len(x) > 1 && x[0] == '$' {
+			v, ok := getNestedField(doc, x[1:])
+			return cloneValue(v), ok
+		}
+		return x, true
+	case map[string]any:
+		m := make(map[string]any, len(x))
+		for k, v := range x {
+			m[k] = evalExpr(doc, v)
+		}
+		return m, true
+	case []any:
+		out := make([]any, len(x))
+		for i, v := range x {
+			out[i] = evalExpr(doc, v)
+		}
+		return out, true
+	}
+	return canonicalizeAny(expr), true
+}
+
+// intArg reads a stage's integer argument, which may arrive as any JSON
+// number.
+func intArg(v any) (int, bool) {
+	f, ok := toNumber(v)
+	if _, isStr := v.(string); isStr || !ok || f != float64(int(f)) {
+		return 0, false
+	}
+	return int(f), true
+}
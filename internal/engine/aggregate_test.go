@@ -0,0 +1,294 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"testDB/internal/types"
+)
+
+func TestAggregate(t *testing.T) {
+	e := openTestEngine(t, testConfig(t))
+	insertAll(t, e, "orders",
+		types.Document{"_id": "o1", "region": "eu", "total": 10, "items": []any{"a", "b"}},
+		types.Document{"_id": "o2", "region": "eu", "total": 30, "items": []any{"b"}},
+		types.Document{"_id": "o3", "region": "us", "total": 5.5, "items": []any{}},
+		types.Document{"_id": "o4", "region": "us", "total": 20},
+		types.Document{"_id": "o5", "region": "apac", "total": 1, "status": "void"},
+	)
+	if err := e.CreateIndex("db", "orders", []string{"region"}, "hash", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		pipeline []map[string]any
+		check    func([]types.Document) bool
+	}{
+		{
+			name: "group with every accumulator",
+			pipeline: []map[string]any{
+				{"$match": map[string]any{"status": map[string]any{"$ne": "void"}}},
+				{"$group": map[string]any{
+					"_id":   "$region",
+					"sum":   map[string]any{"$sum": "$total"},
+					"avg":   map[string]any{"$avg": "$total"},
+					"min":   map[string]any{"$min": "$total"},
+					"max":   map[string]any{"$max": "$total"},
+					"ids":   map[string]any{"$push": "$_id"},
+					"n":     map[string]any{"$count": map[string]any{}},
+					"count": map[string]any{"$sum": json.Number("1")},
+				}},
+				{"$sort": map[string]any{"_id": json.Number("1")}},
+			},
+			check: func(docs []types.Document) bool {
+				if len(docs) != 2 {
+					return false
+				}
+				eu, us := docs[0], docs[1]
+				return eu["_id"] == "eu" && eu["sum"] == int64(40) && eu["avg"] == 20.0 && eu["min"] == int64(10) && eu["max"] == int64(30) &&
+					fmt.Sprint(eu["ids"]) == "[o1 o2]" && eu["n"] == int64(2) && eu["count"] == int64(2) &&
+					us["_id"] == "us" && us["sum"] == 25.5 && us["min"] == 5.5
+			},
+		},
+		{
+			// A leading $match on an indexed field is answered from the index
+			name: "indexed match and unwind",
+			pipeline: []map[string]any{
+				{"$match": map[string]any{"region": "eu"}},
+				{"$unwind": "$items"},
+				{"$project": map[string]any{"_id": 0, "item": "$items", "total": 1}},
+				{"$sort": map[string]any{"item": 1, "total": -1}},
+			},
+			check: func(docs []types.Document) bool {
+				return fmt.Sprint(docs) == "[map[item:a total:10] map[item:b total:30] map[item:b total:10]]"
+			},
+		},
+		{
+			// preserveNullAndEmptyArrays keeps o3, o4 and o5
+			name: "unwind preserving empty arrays",
+			pipeline: []map[string]any{
+				{"$unwind": map[string]any{"path": "$items", "preserveNullAndEmptyArrays": true}},
+				{"$addFields": map[string]any{"copy.of": "$_id"}},
+				{"$sort": map[string]any{"copy.of": 1}},
+				{"$skip": 1},
+				{"$limit": 4},
+			},
+			check: func(docs []types.Document) bool {
+				return len(docs) == 4 && docs[0]["_id"] == "o1" && docs[0]["items"] == "b" && fmt.Sprint(docs[3]["copy"]) == "map[of:o4]"
+			},
+		},
+		{
+			name:     "count",
+			pipeline: []map[string]any{{"$count": "orders"}},
+			check: func(docs []types.Document) bool {
+				return len(docs) == 1 && docs[0]["orders"] == int64(5)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			docs, err := e.Aggregate("db", "orders", tc.pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.check(docs) {
+				t.Fatalf("Unexpected result: %v", docs)
+			}
+		})
+	}
+
+	// The stages left the stored documents alone
+	stored := queryAll(t, e, "orders", map[string]any{"_id": "o1"})
+	if len(stored) != 1 || stored[0]["copy"] != nil || fmt.Sprint(stored[0]["items"]) != "[a b]" {
+		t.Fatalf("Pipeline changed a stored document: %v", stored)
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, bad := range [][]map[string]any{
+			{{"$bogus": 1}},
+			{{"$limit": 0}},
+			{{"$project": map[string]any{"a": 1, "b": 0}}},
+			{{"$group": map[string]any{"n": map[string]any{"$sum": 1}}}},
+			{{"$match": map[string]any{}, "$limit": 1}},
+		} {
+			if _, err := e.Aggregate("db", "orders", bad); err == nil {
+				t.Fatalf("Expected an error for %v", bad)
+			}
+		}
+	})
+}
+
+func TestAggregateLookup(t *testing.T) {
+	e := openTestEngine(t, testConfig(t))
+	insertAll(t, e, "users",
+		types.Document{"_id": "u1", "name": "ann", "tier": 1},
+		types.Document{"_id": "u2", "name": "bob", "tier": 2},
+		types.Document{"_id": "u3", "name": "cy", "tier": 2},
+	)
+	insertAll(t, e, "orders",
+		types.Document{"_id": "o1", "user": "u1", "tags": []any{"red", "blue"}, "tier": 2},
+		types.Document{"_id": "o2", "user": "u2", "tags": []any{"blue"}, "tier": 1},
+		types.Document{"_id": "o3", "user": "u9", "tier": 5},
+		types.Document{"_id": "o4", "user": "u1", "tags": []any{}, "tier": 2},
+	)
+	insertAll(t, e, "tags",
+		types.Document{"_id": "t1", "tag": "red", "hex": "f00"},
+		types.Document{"_id": "t2", "tag": "blue", "hex": "00f"},
+	)
+	if err := e.CreateIndex("db", "tags", []string{"tag"}, "hash", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CreateIndex("db", "users", []string{"tier"}, "btree", false, false); err != nil {
+		t.Fatal(err)
+	}
+	names := func(v any) string {
+		var out []string
+		for _, d := range v.([]any) {
+			out = append(out, fmt.Sprint(d.(map[string]any)["_id"]))
+		}
+		return strings.Join(out, ",")
+	}
+
+	// Each foreign field kind is looked up in its index
+	db, _ := e.getOrCreateDB("db")
+	for _, tc := range []struct {
+		coll, field string
+		keys        map[string]any
+	}{
+		{"users", "_id", map[string]any{`"u1"`: "u1"}},
+		{"tags", "tag", map[string]any{`"red"`: "red"}},
+		{"users", "tier", map[string]any{"2": int64(2)}},
+	} {
+		t.Run("index on "+tc.coll+"."+tc.field, func(t *testing.T) {
+			fc, _ := db.getOrCreateCollection(e.cfg, tc.coll)
+			fc.mu.RLock()
+			view, err := fc.lookupViewLocked(tc.field, tc.keys)
+			fc.mu.RUnlock()
+			if err != nil || view.ids == nil {
+				t.Fatalf("Expected a lookup in an index, got %+v, %v", view, err)
+			}
+			view.release()
+		})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		coll     string
+		pipeline []map[string]any
+		want     []string // per result, the _ids joined into each field, separated by |
+		fields   []string
+	}{
+		{
+			// On the primary key, element-wise on an array, and on a btree index
+			name: "equality joins",
+			coll: "orders",
+			pipeline: []map[string]any{
+				{"$lookup": map[string]any{"from": "users", "localField": "user", "foreignField": "_id", "as": "u"}},
+				{"$lookup": map[string]any{"from": "tags", "localField": "tags", "foreignField": "tag", "as": "t"}},
+				{"$lookup": map[string]any{"from": "users", "localField": "tier", "foreignField": "tier", "as": "peers"}},
+				{"$sort": map[string]any{"_id": 1}},
+			},
+			fields: []string{"u", "t", "peers"},
+			want:   []string{"u1|t1,t2|u2,u3", "u2|t2|u1", "||", "u1||u2,u3"},
+		},
+		{
+			// Over the matches, correlated with let, and uncorrelated
+			name: "pipeline forms",
+			coll: "users",
+			pipeline: []map[string]any{
+				{"$match": map[string]any{"_id": "u1"}},
+				{"$lookup": map[string]any{
+					"from": "orders", "let": map[string]any{"me": "$_id", "t": "$tier"}, "as": "mine",
+					"pipeline": []any{
+						map[string]any{"$match": map[string]any{"user": "$$me", "tier": map[string]any{"$gt": "$$t"}}},
+						map[string]any{"$project": map[string]any{"_id": 1}},
+						map[string]any{"$sort": map[string]any{"_id": 1}},
+					},
+				}},
+				{"$lookup": map[string]any{"from": "tags", "as": "all", "pipeline": []any{map[string]any{"$sort": map[string]any{"_id": -1}}}}},
+			},
+			fields: []string{"mine", "all"},
+			want:   []string{"o1,o4|t2,t1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			docs, err := e.Aggregate("db", tc.coll, tc.pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != len(tc.want) {
+				t.Fatalf("Expected %d results, got %v", len(tc.want), docs)
+			}
+			for i, want := range tc.want {
+				var got []string
+				for _, f := range tc.fields {
+					got = append(got, names(docs[i][f]))
+				}
+				if strings.Join(got, "|") != want {
+					t.Fatalf("%v joined %s, want %s", docs[i]["_id"], strings.Join(got, "|"), want)
+				}
+			}
+		})
+	}
+
+	t.Run("sub-pipeline stages", func(t *testing.T) {
+		docs, err := e.Aggregate("db", "users", []map[string]any{
+			{"$match": map[string]any{"_id": "u1"}},
+			{"$lookup": map[string]any{
+				"from": "orders", "localField": "_id", "foreignField": "user", "as": "orders",
+				"pipeline": []any{map[string]any{"$match": map[string]any{"tags": map[string]any{"$exists": true}}}, map[string]any{"$count": "n"}},
+			}},
+		})
+		if err != nil || len(docs) != 1 || fmt.Sprint(docs[0]["orders"]) != "[map[n:2]]" {
+			t.Fatalf("Unexpected lookup: %v, %v", docs, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, bad := range []map[string]any{
+			{"from": "users", "as": "x"},
+			{"from": "users", "localField": "user", "as": "x"},
+			{"from": "users", "let": map[string]any{"a": "$x"}, "localField": "user", "foreignField": "_id", "as": "x"},
+			{"from": "users", "let": map[string]any{"a": "$x"}, "pipeline": []any{map[string]any{"$match": map[string]any{"b": "$$b"}}}, "as": "x"},
+			{"from": "users", "pipeline": []any{map[string]any{"$bogus": 1}}, "as": "x"},
+		} {
+			if _, err := e.Aggregate("db", "orders", []map[string]any{{"$lookup": bad}}); !errors.Is(err, ErrInvalidPipeline) {
+				t.Fatalf("Expected ErrInvalidPipeline for %v, got %v", bad, err)
+			}
+		}
+	})
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		// Joins in both directions, and a self-join, run alongside writers
+		// to both collections without deadlocking
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					from, to := "orders", "users"
+					if (w+i)%2 == 1 {
+						from, to = to, from
+					}
+					if w == 3 {
+						to = from
+					}
+					if _, err := e.Aggregate("db", from, []map[string]any{{"$lookup": map[string]any{"from": to, "localField": "user", "foreignField": "_id", "as": "x"}}}); err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := e.Update("db", to, map[string]any{"_id": "u1"}, map[string]any{"$inc": map[string]any{"n": 1}}, false, true); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+	})
+}
@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BackupLabelFile sits at the root of a base backup and records the WAL
+// position each collection was copied at.
+const BackupLabelFile = "BACKUP_LABEL"
+
+// BackupLabel describes a base backup. Collections maps "db/collection" to
+// the LSN of the last WAL entry the copy of that collection includes;
+// restore replays the archived WAL from there.
+type BackupLabel struct {
+	Created     time.Time        `json:"created"`
+	LSN         int64            `json:"lsn"` // WAL position when the backup started
+	Collections map[string]int64 `json:"collections"`
+}
+
+// minLSN returns the oldest position restore has to replay from.
+func (l *BackupLabel) minLSN() int64 {
+	min := l.LSN
+	for _, lsn := range l.Collections {
+		if lsn < min {
+			min = lsn
+		}
+	}
+	return min
+}
+
+// maxLSN returns the position the newest collection copy has reached; a
+// restore can't stop before it.
+func (l *BackupLabel) maxLSN() int64 {
+	max := l.LSN
+	for _, lsn := range l.Collections {
+		if lsn > max {
+			max = lsn
+		}
+	}
+	return max
+}
+
+func readBackupLabel(dir string) (*BackupLabel, error) {
+	b, err := os.ReadFile(filepath.Join(dir, BackupLabelFile))
+	if err != nil {
+		return nil, fmt.Errorf("not a base backup: %w", err)
+	}
+	var label BackupLabel
+	if err := json.Unmarshal(b, &label); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", BackupLabelFile, err)
+	}
+	return &label, nil
+}
+
+// Backup copies every collection into dir, which must be empty or absent,
+// as a base backup for point-in-time restore. Collections are copied one
+// at a time under their read lock, so writes to the others go on.
+//
+// The layout mirrors DBsDir under dir/databases, next to a BACKUP_LABEL.
+func (e *Engine) Backup(dir string) (*BackupLabel, error) {
+	if err := requireEmptyDir(dir); err != nil {
+		return nil, err
+	}
+	dbsDir := filepath.Join(dir, "databases")
+	if err := mkdirAll(dbsDir); err != nil {
+		return nil, err
+	}
+
+	label := &BackupLabel{
+		Created:     time.Now().UTC(),
+		LSN:         e.walv2.LastSequence(),
+		Collections: map[string]int64{},
+	}
+
+	var firstErr error
+	e.forEachCollection(func(db *Database, c *Collection) {
+		if firstErr != nil {
+			return
+		}
+		lsn, err := e.backupCollection(db, c, filepath.Join(dbsDir, db.Name, "collections", c.Name))
+		if err != nil {
+			firstErr = fmt.Errorf("backup %s/%s: %w", db.Name, c.Name, err)
+			return
+		}
+		label.Collections[db.Name+"/"+c.Name] = lsn
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	b, err := json.MarshalIndent(label, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicWriteFile(filepath.Join(dir, BackupLabelFile), b, 0644); err != nil {
+		return nil, err
+	}
+	return label, nil
+}
+
+// backupCollection copies one collection and returns the LSN it is
+// consistent with. Changes are logged and stored under c.mu, so while the
+// read lock is held every entry up to the current WAL position is in
+// storage and no later one is.
+func (e *Engine) backupCollection(db *Database, c *Collection, dst string) (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	lsn := e.walv2.LastSequence()
+	if err := mkdirAll(dst); err != nil {
+		return 0, err
+	}
+
+	src := collectionDir(e.cfg, db.Name, c.Name)
+	entries, err := os.ReadDir(src)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	for _, ent := range entries {
+		name := ent.Name()
+		if ent.IsDir() || filepath.Ext(name) == ".tmp" {
+			continue
+		}
+		if c.useSegments && name == "data.db" {
+			// Superseded by the segments
+			continue
+		}
+		if err := copyFile(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return 0, err
+		}
+	}
+
+	if c.useSegments && c.segmentMgr != nil {
+		if err := c.segmentMgr.backupTo(filepath.Join(dst, "segments")); err != nil {
+			return 0, err
+		}
+	}
+	return lsn, nil
+}
+
+// backupTo copies the live segment set and its manifest into dir. Every
+// append made so far is flushed first, and compaction and appends wait
+// until the copy is done.
+func (sm *SegmentManager) backupTo(dir string) error {
+	sm.compactMu.Lock()
+	defer sm.compactMu.Unlock()
+	if err := sm.committer.flush(); err != nil {
+		return err
+	}
+
+	sm.writeMu.Lock()
+	defer sm.writeMu.Unlock()
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if err := mkdirAll(dir); err != nil {
+		return err
+	}
+	for _, seg := range sm.segments {
+		if err := copyFile(seg.Path, filepath.Join(dir, segmentFileName(seg.ID))); err != nil {
+			return err
+		}
+	}
+
+	// Record the current durable LSN rather than the one last saved
+	m := segmentManifest{
+		Generation:    sm.generation,
+		Segments:      make([]int, 0, len(sm.segments)),
+		NextSegmentID: sm.nextSegmentID,
+		DurableLSN:    sm.appliedLSN,
+	}
+	for _, seg := range sm.segments {
+		m.Segments = append(m.Segments, seg.ID)
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(manifestPath(dir), b, 0644)
+}
+
+// copyTree copies the regular files under src into dst.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return mkdirAll(target)
+		}
+		return copyFile(path, target)
+	})
+}
+
+// copyFile copies src to a new fsynced file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// requireEmptyDir fails unless dir is absent or has no entries.
+func requireEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+
+	"testDB/internal/types"
+)
+
+// BulkOp is one write in a BulkWrite batch. Op names the write; which of
+// the other fields it reads depends on it.
+type BulkOp struct {
+	Op          string         // insertOne, updateOne, updateMany, deleteOne, deleteMany or replaceOne
+	Doc         types.Document // insertOne
+	Filter      map[string]any
+	Update      map[string]any // updateOne, updateMany
+	Replacement types.Document // replaceOne
+	Upsert      bool           // updateOne, updateMany, replaceOne: insert when nothing matches
+}
+
+// BulkResult is the outcome of one BulkOp.
+type BulkResult struct {
+	Index      int    `json:"index"`
+	Op         string `json:"op"`
+	N          int    `json:"n"` // documents inserted, updated or deleted
+	InsertedID string `json:"insertedId,omitempty"`
+	UpsertedID string `json:"upsertedId,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"` // not run: an earlier op of an ordered batch failed
+}
+
+// BulkWriteResult totals a BulkWrite batch and holds each op's result, in
+// the order the ops were given.
+type BulkWriteResult struct {
+	Inserted int          `json:"inserted"`
+	Updated  int          `json:"updated"`
+	Deleted  int          `json:"deleted"`
+	Upserted int          `json:"upserted"`
+	Errors   int          `json:"errors"`
+	Results  []BulkResult `json:"results"`
+}
+
+// BulkWrite is BulkWriteWithConcern with the default write concern.
+func (e *Engine) BulkWrite(dbName, collName string, ops []BulkOp, ordered bool) (*BulkWriteResult, error) {
+	return e.BulkWriteWithConcern(dbName, collName, ops, ordered, WriteConcernDefault)
+}
+
+// BulkWriteWithConcern applies ops to one collection in order, under one
+// collection lock, and waits once for all of them to be as durable as wc
+// asks, so the batch shares a single fsync. Each op is logged and stored
+// as it would be on its own. An op that fails is reported in its result;
+// an ordered batch stops there, an unordered one carries on. The error is
+// only for failures outside the ops, such as the batch not being durable.
+func (e *Engine) BulkWriteWithConcern(dbName, collName string, ops []BulkOp, ordered bool, wc WriteConcern) (*BulkWriteResult, error) {
+	db, err := e.getOrCreateDB(dbName)
+	if err != nil {
+		return nil, err
+	}
+	c, err := db.getOrCreateCollection(e.cfg, collName)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &BulkWriteResult{Results: make([]BulkResult, len(ops))}
+	var last writeTicket
+
+	c.mu.Lock()
+	failed := false
+	for i, op := range ops {
+		r := &res.Results[i]
+		r.Index, r.Op = i, op.Op
+		if failed && ordered {
+			r.Skipped = true
+			continue
+		}
+
+		ticket, err := e.bulkOpLocked(db, c, op, r)
+		if err != nil {
+			r.Error = err.Error()
+			res.Errors++
+			failed = true
+			continue
+		}
+		// Tickets are handed out in order, so the last covers the rest
+		if ticket.wal.gc != nil {
+			last.wal = ticket.wal
+		}
+		if ticket.store.gc != nil {
+			last.store = ticket.store
+		}
+
+		switch {
+		case r.UpsertedID != "":
+			res.Upserted++
+		case op.Op == "insertOne":
+			res.Inserted += r.N
+		case op.Op == "deleteOne" || op.Op == "deleteMany":
+			res.Deleted += r.N
+		default:
+			res.Updated += r.N
+		}
+	}
+	c.mu.Unlock()
+
+	if err := last.Wait(wc); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// bulkOpLocked applies op and fills in r. Caller must hold c.mu and wait
+// on the returned ticket after releasing it.
+func (e *Engine) bulkOpLocked(db *Database, c *Collection, op BulkOp, r *BulkResult) (writeTicket, error) {
+	switch op.Op {
+	case "insertOne":
+		if op.Doc == nil {
+			return writeTicket{}, errors.New("doc is required")
+		}
+		doc := canonicalizeDocument(op.Doc)
+		if err := enforceDocSizeLimit(doc, e.cfg.MaxDocBytes); err != nil {
+			return writeTicket{}, err
+		}
+		id, ticket, err := e.insertLocked(db, c, doc, true)
+		if err != nil {
+			return writeTicket{}, err
+		}
+		r.N, r.InsertedID = 1, id
+		return ticket, nil
+
+	case "updateOne", "updateMany":
+		if op.Update == nil {
+			return writeTicket{}, errors.New("update is required")
+		}
+		images, ticket, err := e.updateLocked(db, c, op.Filter, op.Update, op.Op == "updateMany", nil, true)
+		if err != nil || len(images) > 0 || !op.Upsert {
+			r.N = len(images)
+			return ticket, err
+		}
+		doc, ticket, err := e.upsertLocked(db, c, op.Filter, op.Update, true)
+		if err != nil {
+			return writeTicket{}, err
+		}
+		r.N, r.UpsertedID = 1, fmt.Sprintf("%v", doc["_id"])
+		return ticket, nil
+
+	case "replaceOne":
+		if op.Replacement == nil {
+			return writeTicket{}, errors.New("replacement is required")
+		}
+		images, ticket, err := e.replaceLocked(db, c, op.Filter, op.Replacement, true)
+		if err != nil || len(images) > 0 || !op.Upsert {
+			r.N = len(images)
+			return ticket, err
+		}
+		doc := canonicalizeDocument(op.Replacement)
+		if _, ok := doc["_id"]; !ok {
+			// Only the filter's _id carries over to a replacement
+			seed := types.Document{}
+			seedFromFilter(seed, op.Filter)
+			if id, ok := seed["_id"]; ok {
+				doc["_id"] = canonicalizeAny(id)
+			}
+		}
+		if err := enforceDocSizeLimit(doc, e.cfg.MaxDocBytes); err != nil {
+			return writeTicket{}, err
+		}
+		id, ticket, err := e.insertLocked(db, c, doc, true)
+		if err != nil {
+			return writeTicket{}, err
+		}
+		r.N, r.UpsertedID = 1, id
+		return ticket, nil
+
+	case "deleteOne", "deleteMany":
+		n, ticket, err := e.deleteLocked(db, c, op.Filter, op.Op == "deleteMany", nil, true)
+		r.N = n
+		return ticket, err
+	}
+	return writeTicket{}, fmt.Errorf("unknown bulk op: %q", op.Op)
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"testDB/internal/types"
+)
+
+func TestBulkWrite(t *testing.T) {
+	cfg := testConfig(t)
+	e := openTestEngine(t, cfg)
+
+	// Each batch runs on the items the previous ones left
+	for _, tc := range []struct {
+		name    string
+		ops     []BulkOp
+		ordered bool
+		check   func(*BulkWriteResult) bool
+	}{
+		{
+			name: "every op",
+			ops: []BulkOp{
+				{Op: "insertOne", Doc: types.Document{"_id": "a", "qty": 1}},
+				{Op: "insertOne", Doc: types.Document{"_id": "b", "qty": 2}},
+				{Op: "insertOne", Doc: types.Document{"_id": "c", "qty": 3}},
+				{Op: "updateMany", Filter: map[string]any{"qty": map[string]any{"$gte": 2}}, Update: map[string]any{"$inc": map[string]any{"qty": 10}}},
+				{Op: "replaceOne", Filter: map[string]any{"_id": "a"}, Replacement: types.Document{"name": "replaced"}},
+				{Op: "deleteOne", Filter: map[string]any{"_id": "b"}},
+				{Op: "updateOne", Filter: map[string]any{"_id": "d"}, Update: map[string]any{"$set": map[string]any{"qty": 4}}, Upsert: true},
+			},
+			ordered: true,
+			check: func(res *BulkWriteResult) bool {
+				return res.Inserted == 3 && res.Updated == 3 && res.Deleted == 1 && res.Upserted == 1 && res.Errors == 0 &&
+					res.Results[3].N == 2 && res.Results[3].Op == "updateMany" && res.Results[6].UpsertedID == "d"
+			},
+		},
+		{
+			name: "ordered stops at the first error",
+			ops: []BulkOp{
+				{Op: "insertOne", Doc: types.Document{"_id": "e"}},
+				{Op: "insertOne", Doc: types.Document{"_id": "a"}},
+				{Op: "insertOne", Doc: types.Document{"_id": "f"}},
+			},
+			ordered: true,
+			check: func(res *BulkWriteResult) bool {
+				return res.Inserted == 1 && res.Errors == 1 && res.Results[1].Error != "" && res.Results[2].Skipped
+			},
+		},
+		{
+			name: "unordered carries on",
+			ops: []BulkOp{
+				{Op: "insertOne", Doc: types.Document{"_id": "a"}},
+				{Op: "replaceOne", Filter: map[string]any{"_id": "c"}, Replacement: types.Document{"_id": "z"}},
+				{Op: "bogus"},
+				{Op: "insertOne", Doc: types.Document{"_id": "f"}},
+			},
+			check: func(res *BulkWriteResult) bool {
+				return res.Inserted == 1 && res.Errors == 3 && res.Results[3].InsertedID == "f"
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := e.BulkWrite("db", "items", tc.ops, tc.ordered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.check(res) {
+				t.Fatalf("Unexpected result: %+v", res)
+			}
+		})
+	}
+
+	// A replacement keeps _id and _created but drops every other field
+	docs := queryAll(t, e, "items", map[string]any{"_id": "a"})
+	if len(docs) != 1 || docs[0]["name"] != "replaced" || docs[0]["qty"] != nil || docs[0]["_created"] == nil || DocVersion(docs[0]) != 2 {
+		t.Fatalf("Unexpected replaced document: %v", docs)
+	}
+
+	// Every op was logged, so the batches survive a restart
+	if err := e.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	e = openTestEngine(t, cfg)
+	docs, _ = e.Query("db", "items", map[string]any{}, map[string]int{"_id": 1}, 0, 0, nil)
+	var ids []string
+	for _, d := range docs {
+		ids = append(ids, fmt.Sprint(d["_id"]))
+	}
+	if got := strings.Join(ids, ","); got != "a,c,d,e,f" {
+		t.Fatalf("Expected a,c,d,e,f after restart, got %s", got)
+	}
+}
@@ -0,0 +1,429 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"testDB/internal/types"
+)
+
+// Change streams are read from the WAL: every logged insert, update and
+// delete becomes one event per document it changed. Live events come from
+// the entries the WAL passes on once their writes are stored and durable;
+// a watcher that resumes, or falls behind, reads the entries it missed
+// back from the WAL files and their archive.
+
+// ErrChangeHistoryLost is returned when a change stream resumes from a
+// point the WAL and its archive no longer reach.
+var ErrChangeHistoryLost = errors.New("resume point is no longer in the WAL")
+
+// changeSubBuffer is how many entries a watcher may lag behind the WAL
+// before it is dropped back to reading the files.
+const changeSubBuffer = 1024
+
+// ChangeEvent is one document changed by a write.
+type ChangeEvent struct {
+	Token      string         `json:"token"` // resume after this event
+	Seq        int64          `json:"seq"`   // WAL entry of the write
+	Time       time.Time      `json:"time"`
+	Op         string         `json:"op"` // insert, update or delete
+	DB         string         `json:"db"`
+	Collection string         `json:"collection"`
+	ID         string         `json:"id"`
+	Doc        types.Document `json:"doc,omitempty"` // the document after an insert or update
+}
+
+// ResumeToken is the position of a change event: the WAL entry and the
+// index of the document within it. It is written "seq:index"; a bare
+// "seq" stands for every event of the entry.
+type ResumeToken struct {
+	Seq   int64
+	Index int
+}
+
+// wholeEntry is the index of a token past every event of its entry.
+const wholeEntry = math.MaxInt
+
+func (t ResumeToken) String() string {
+	if t.Index == wholeEntry {
+		return strconv.FormatInt(t.Seq, 10)
+	}
+	return fmt.Sprintf("%d:%d", t.Seq, t.Index)
+}
+
+// ParseResumeToken parses a token as written by ResumeToken.String.
+func ParseResumeToken(s string) (ResumeToken, error) {
+	seq, index, found := strings.Cut(s, ":")
+	t := ResumeToken{Index: wholeEntry}
+	var err error
+	if t.Seq, err = strconv.ParseInt(seq, 10, 64); err != nil || t.Seq < 0 {
+		return t, fmt.Errorf("invalid resume token %q", s)
+	}
+	if found {
+		if t.Index, err = strconv.Atoi(index); err != nil || t.Index < 0 {
+			return t, fmt.Errorf("invalid resume token %q", s)
+		}
+	}
+	return t, nil
+}
+
+// WatchOptions selects the changes a stream delivers.
+type WatchOptions struct {
+	DB         string         // empty for every database
+	Collection string         // empty for every collection of DB
+	Filter     map[string]any // matched against the changed document; a delete only has its _id
+
+	// ResumeAfter starts the stream after this event rather than with
+	// the next write.
+	ResumeAfter *ResumeToken
+}
+
+func (o *WatchOptions) matches(ev *ChangeEvent) bool {
+	if (o.DB != "" && ev.DB != o.DB) || (o.Collection != "" && ev.Collection != o.Collection) {
+		return false
+	}
+	if len(o.Filter) == 0 {
+		return true
+	}
+	doc := ev.Doc
+	if doc == nil {
+		doc = types.Document{"_id": ev.ID}
+	}
+	return matchesFilter(doc, o.Filter)
+}
+
+// changeEvents returns the events of a WAL entry, one per document.
+// Entries logged before updates and deletes recorded their ids have none.
+// The changes of a transaction share its entry, in the order it made them.
+func changeEvents(entry *WALEntryV2) []*ChangeEvent {
+	events := appendChangeEvents(nil, entry, entry)
+	for i, ev := range events {
+		ev.Token = ResumeToken{Seq: entry.Sequence, Index: i}.String()
+	}
+	return events
+}
+
+// appendChangeEvents appends the events of op, a change logged by entry.
+func appendChangeEvents(events []*ChangeEvent, entry, op *WALEntryV2) []*ChangeEvent {
+	var images []map[string]any
+	var ids []string
+	switch op.Op {
+	case "insert":
+		images = []map[string]any{op.Doc}
+	case "update":
+		images = op.Docs
+	case "delete":
+		ids = op.IDs
+	case "txn":
+		for _, change := range op.Ops {
+			events = appendChangeEvents(events, entry, change)
+		}
+		return events
+	default:
+		return events
+	}
+
+	base := ChangeEvent{
+		Seq:        entry.Sequence,
+		Time:       time.Unix(0, entry.Timestamp).UTC(),
+		Op:         op.Op,
+		DB:         op.DB,
+		Collection: op.Collection,
+	}
+	for _, img := range images {
+		ev := base
+		ev.Doc = canonicalizeDocument(img)
+		ev.ID = fmt.Sprintf("%v", ev.Doc["_id"])
+		events = append(events, &ev)
+	}
+	for _, id := range ids {
+		ev := base
+		ev.ID = id
+		events = append(events, &ev)
+	}
+	return events
+}
+
+// changeHub hands the entries appended to the WAL to the change stream
+// subscribers, in sequence order. An entry is held back until the write
+// that logged it has settled, i.e. has been stored or has failed, and an
+// fsync has made it durable; a watcher that sees an event can then read
+// the change, and never sees one that a crash could undo. Failed writes
+// are dropped.
+type changeHub struct {
+	mu        sync.Mutex
+	subs      map[*changeSub]struct{}
+	closed    bool
+	held      map[int64]*heldChange // appended entries not passed on yet
+	published int64                 // entries up to here were passed on or dropped
+	durable   int64                 // entries up to here are on disk
+}
+
+type heldChange struct {
+	data    []byte
+	settled bool
+	stored  bool
+}
+
+// changeSub receives encoded entries. The channel is closed when the
+// subscriber falls changeSubBuffer entries behind, or the WAL closes.
+type changeSub struct {
+	ch chan []byte
+}
+
+// newChangeHub returns a hub whose next entry follows seq.
+func newChangeHub(seq int64) *changeHub {
+	return &changeHub{
+		subs:      map[*changeSub]struct{}{},
+		held:      map[int64]*heldChange{},
+		published: seq,
+		durable:   seq,
+	}
+}
+
+// subscribe adds a subscriber, which is sent the entries after the
+// returned sequence.
+func (h *changeHub) subscribe() (*changeSub, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, 0, errors.New("WAL is closed")
+	}
+	s := &changeSub{ch: make(chan []byte, changeSubBuffer)}
+	h.subs[s] = struct{}{}
+	return s, h.published, nil
+}
+
+func (h *changeHub) unsubscribe(s *changeSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.ch)
+	}
+}
+
+// hold takes the entry just appended at seq. One whose write settled
+// already is only waiting to be durable.
+func (h *changeHub) hold(seq int64, data []byte, settled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.held[seq] = &heldChange{data: data, settled: settled, stored: settled}
+}
+
+// settle records whether the write logged at seq was stored.
+func (h *changeHub) settle(seq int64, stored bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.held[seq]; ok {
+		c.settled, c.stored = true, stored
+		h.releaseLocked()
+	}
+}
+
+// durableTo records that the entries up to seq are on disk.
+func (h *changeHub) durableTo(seq int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seq > h.durable {
+		h.durable = seq
+		h.releaseLocked()
+	}
+}
+
+// skipTo moves past seq, for sequence numbers no entry was logged under.
+func (h *changeHub) skipTo(seq int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seq > h.published {
+		h.published = seq
+	}
+	if seq > h.durable {
+		h.durable = seq
+	}
+	for held := range h.held {
+		if held <= seq {
+			delete(h.held, held)
+		}
+	}
+	h.releaseLocked()
+}
+
+// releaseLocked passes on, in order, the entries that are settled and
+// durable. Caller must hold h.mu.
+func (h *changeHub) releaseLocked() {
+	for h.published < h.durable {
+		c, ok := h.held[h.published+1]
+		if !ok || !c.settled {
+			return
+		}
+		delete(h.held, h.published+1)
+		h.published++
+		if c.stored {
+			h.publishLocked(c.data)
+		}
+	}
+}
+
+// publishLocked passes an entry on without blocking the writer: a
+// subscriber with a full buffer is dropped instead. Caller must hold h.mu.
+func (h *changeHub) publishLocked(data []byte) {
+	for s := range h.subs {
+		select {
+		case s.ch <- data:
+		default:
+			delete(h.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+func (h *changeHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		delete(h.subs, s)
+		close(s.ch)
+	}
+}
+
+// Watch calls fn with each change matching opts, in commit order, until
+// ctx is done or fn returns an error, which Watch then returns. Only
+// logged writes are seen. Resuming from a token replays the events since,
+// from the WAL and its archive, before the live ones; ErrChangeHistoryLost
+// means that history has been pruned.
+func (e *Engine) Watch(ctx context.Context, opts WatchOptions, fn func(*ChangeEvent) error) error {
+	opts.Filter = canonicalizeAnyMap(opts.Filter)
+	return e.walv2.watch(ctx, opts, fn)
+}
+
+func (w *WALv2) watch(ctx context.Context, opts WatchOptions, fn func(*ChangeEvent) error) error {
+	var pos ResumeToken // last event seen
+	started := opts.ResumeAfter != nil
+	if started {
+		pos = *opts.ResumeAfter
+	}
+
+	deliver := func(entry *WALEntryV2) error {
+		if entry.Sequence < pos.Seq {
+			return nil
+		}
+		for i, ev := range changeEvents(entry) {
+			if entry.Sequence == pos.Seq && i <= pos.Index {
+				continue
+			}
+			pos = ResumeToken{Seq: entry.Sequence, Index: i}
+			if !opts.matches(ev) {
+				continue
+			}
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		pos = ResumeToken{Seq: entry.Sequence, Index: wholeEntry}
+		return nil
+	}
+
+	for {
+		// Subscribing and reading the position together splits the
+		// stream exactly between the files and the live entries
+		w.mu.Lock()
+		sub, seq, err := w.changes.subscribe()
+		live, archived := w.fileStatsLocked()
+		w.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if !started {
+			pos = ResumeToken{Seq: seq, Index: wholeEntry}
+			started = true
+		}
+		if pos.Seq > seq {
+			w.changes.unsubscribe(sub)
+			return fmt.Errorf("resume token %s is ahead of the WAL (sequence %d)", pos, seq)
+		}
+		if pos.Seq < seq || (pos.Seq == seq && pos.Index != wholeEntry) {
+			if err := w.replayChanges(append(archived, live...), pos, seq, deliver); err != nil {
+				w.changes.unsubscribe(sub)
+				return err
+			}
+		}
+
+		for lagged := false; !lagged; {
+			select {
+			case <-ctx.Done():
+				w.changes.unsubscribe(sub)
+				return ctx.Err()
+			case data, ok := <-sub.ch:
+				if !ok {
+					// Fell behind or closed: catch up from the files
+					lagged = true
+					break
+				}
+				entry, err := decodeWALEntry(data)
+				if err == nil {
+					err = deliver(entry)
+				}
+				if err != nil {
+					w.changes.unsubscribe(sub)
+					return err
+				}
+			}
+		}
+	}
+}
+
+// replayChanges reads the entries after pos up to seq back from files and
+// passes them to deliver. They must follow on from pos without a hole.
+func (w *WALv2) replayChanges(files []WALFileStats, pos ResumeToken, seq int64, deliver func(*WALEntryV2) error) error {
+	next := pos.Seq + 1
+	if pos.Index != wholeEntry {
+		next = pos.Seq
+	}
+	from := next
+
+	archiveDir := ""
+	if w.cfg.EnableWALArchive {
+		archiveDir = w.cfg.WALArchiveDir
+	}
+
+	// Failed writes are skipped, as on the live path. An abort may come
+	// after seq, but it was logged before its write settled, so the files
+	// as they were when seq was read hold it.
+	aborted := map[int64]bool{}
+	_, err := walkWAL(files, archiveDir, WALFilter{FromSeq: from, Op: "abort"}, func(entry *WALEntryV2) error {
+		aborted[entry.Aborts] = true
+		return nil
+	}, func(*WALCorruption) error { return nil })
+	if err != nil {
+		return err
+	}
+
+	_, err = walkWAL(files, archiveDir, WALFilter{FromSeq: from, ToSeq: seq}, func(entry *WALEntryV2) error {
+		if entry.Sequence != next {
+			return fmt.Errorf("%w: entries %d to %d are missing", ErrChangeHistoryLost, next, entry.Sequence-1)
+		}
+		next++
+		if aborted[entry.Sequence] {
+			return nil
+		}
+		return deliver(entry)
+	}, func(c *WALCorruption) error {
+		return fmt.Errorf("%w: %v", ErrChangeHistoryLost, c)
+	})
+	if err != nil {
+		return err
+	}
+	if next <= seq {
+		return fmt.Errorf("%w: entries %d to %d are missing", ErrChangeHistoryLost, next, seq)
+	}
+	return nil
+}
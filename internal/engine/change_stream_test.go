@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"testDB/internal/types"
+)
+
+var errWatchDone = errors.New("done")
+
+// collectChanges watches e until n events matching opts have arrived.
+func collectChanges(t *testing.T, e *Engine, opts WatchOptions, n int) []*ChangeEvent {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var got []*ChangeEvent
+	err := e.Watch(ctx, opts, func(ev *ChangeEvent) error {
+		got = append(got, ev)
+		if len(got) == n {
+			return errWatchDone
+		}
+		return nil
+	})
+	if err != errWatchDone {
+		t.Fatalf("Watch ended with %v after %d of %d events", err, len(got), n)
+	}
+	return got
+}
+
+func TestChangeStream(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.WALSyncMode = WALSyncAsync
+	e := openTestEngine(t, cfg)
+
+	start := ResumeToken{Seq: e.walv2.LastSequence(), Index: wholeEntry}
+	for i := 1; i <= 3; i++ {
+		insertAll(t, e, "c", types.Document{"_id": fmt.Sprint(i), "n": i})
+	}
+	insertAll(t, e, "other", types.Document{"_id": "x"})
+	if _, err := e.Update("db", "c", map[string]any{}, map[string]any{"$set": map[string]any{"seen": true}}, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Delete("db", "c", map[string]any{"_id": "3"}, false, true); err != nil {
+		t.Fatal(err)
+	}
+	// The second event of the multi-document update
+	mid := ResumeToken{Seq: start.Seq + 5, Index: 1}
+
+	// Resuming replays the history from the WAL, one event per document
+	for _, tc := range []struct {
+		name string
+		opts WatchOptions
+		want string
+	}{
+		{
+			name: "history",
+			opts: WatchOptions{DB: "db", Collection: "c", ResumeAfter: &start},
+			want: "insert:1,insert:2,insert:3,update:1,update:2,update:3,delete:3",
+		},
+		{
+			name: "filter",
+			opts: WatchOptions{DB: "db", Collection: "c", Filter: map[string]any{"n": map[string]any{"$gte": json.Number("2")}}, ResumeAfter: &start},
+			want: "insert:2,insert:3,update:2,update:3",
+		},
+		{
+			name: "resume inside an entry",
+			opts: WatchOptions{DB: "db", ResumeAfter: &mid},
+			want: "update:3,delete:3",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			events := collectChanges(t, e, tc.opts, strings.Count(tc.want, ",")+1)
+			var got []string
+			for _, ev := range events {
+				got = append(got, ev.Op+":"+ev.ID)
+				switch ev.Op {
+				case "update":
+					if ev.Doc["seen"] != true {
+						t.Fatalf("Update event without its image: %+v", ev)
+					}
+				case "delete":
+					if ev.Doc != nil {
+						t.Fatalf("Delete event with a document: %+v", ev)
+					}
+				}
+			}
+			if strings.Join(got, ",") != tc.want {
+				t.Fatalf("Expected %s, got %s", tc.want, strings.Join(got, ","))
+			}
+		})
+	}
+
+	t.Run("lagging watcher catches up from the files", func(t *testing.T) {
+		const n = changeSubBuffer + 100
+		start := ResumeToken{Seq: e.walv2.LastSequence(), Index: wholeEntry}
+		release := make(chan struct{})
+		done := make(chan error, 1)
+		var ids []string
+		go func() {
+			done <- e.Watch(context.Background(), WatchOptions{DB: "db", Collection: "lag", ResumeAfter: &start}, func(ev *ChangeEvent) error {
+				if len(ids) == 0 {
+					<-release
+				}
+				ids = append(ids, ev.ID)
+				if len(ids) == n {
+					return errWatchDone
+				}
+				return nil
+			})
+		}()
+		for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+			e.walv2.changes.mu.Lock()
+			subscribed = len(e.walv2.changes.subs) == 1
+			e.walv2.changes.mu.Unlock()
+		}
+		for i := 0; i < n; i++ {
+			insertAll(t, e, "lag", types.Document{"_id": fmt.Sprint(i)})
+		}
+		close(release)
+		if err := <-done; err != errWatchDone {
+			t.Fatalf("Lagging watcher ended with %v after %d events", err, len(ids))
+		}
+		for i, id := range ids {
+			if id != fmt.Sprint(i) {
+				t.Fatalf("Event %d is for %s", i, id)
+			}
+		}
+	})
+
+	t.Run("history dropped without archiving is lost", func(t *testing.T) {
+		cfg := testConfig(t)
+		cfg.EnableWALArchive = false
+		e := openTestEngine(t, cfg)
+		insertAll(t, e, "c", types.Document{"_id": "a"})
+		if err := e.checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		insertAll(t, e, "c", types.Document{"_id": "b"})
+		err := e.Watch(context.Background(), WatchOptions{ResumeAfter: &ResumeToken{}}, func(*ChangeEvent) error { return errWatchDone })
+		if !errors.Is(err, ErrChangeHistoryLost) {
+			t.Fatalf("Expected the lost history to be reported, got %v", err)
+		}
+	})
+}
+
+func TestChangeStreamWaitsForStoredWrites(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.WALSyncMode = WALSyncAsync
+	e := openTestEngine(t, cfg)
+	insertAll(t, e, "c", types.Document{"_id": "a"})
+	if err := e.walv2.committer.flush(); err != nil {
+		t.Fatal(err)
+	}
+	start := ResumeToken{Seq: e.walv2.LastSequence(), Index: wholeEntry}
+	db, _ := e.getOrCreateDB("db")
+	c, _ := db.getOrCreateCollection(e.cfg, "c")
+
+	type seen struct {
+		id      string
+		found   bool
+		durable bool
+	}
+	events := make(chan seen, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Watch(ctx, WatchOptions{DB: "db"}, func(ev *ChangeEvent) error {
+		docs, _ := e.Query("db", "c", map[string]any{"_id": ev.ID}, nil, 0, 0, nil)
+		e.walv2.changes.mu.Lock()
+		durable := ev.Seq <= e.walv2.changes.durable
+		e.walv2.changes.mu.Unlock()
+		events <- seen{ev.ID, len(docs) == 1, durable}
+		return nil
+	})
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		e.walv2.changes.mu.Lock()
+		subscribed = len(e.walv2.changes.subs) == 1
+		e.walv2.changes.mu.Unlock()
+	}
+
+	// A write that is logged but fails to store is never seen
+	seg := c.segmentMgr.activeSegment
+	seg.mu.Lock()
+	seg.Sealed = true
+	seg.mu.Unlock()
+	_, err := e.Insert("db", "c", types.Document{"_id": "lost"}, true)
+	seg.mu.Lock()
+	seg.Sealed = false
+	seg.mu.Unlock()
+	if err == nil {
+		t.Fatal("Expected the insert to fail")
+	}
+
+	insertAll(t, e, "c", types.Document{"_id": "b"})
+	select {
+	case ev := <-events:
+		if ev.id != "b" || !ev.found || !ev.durable {
+			t.Fatalf("Expected a durable, readable insert of b, got %+v", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("No event for the stored write")
+	}
+
+	// Nor is it when the stream resumes from the files
+	if err := e.walv2.committer.flush(); err != nil {
+		t.Fatal(err)
+	}
+	resumed := collectChanges(t, e, WatchOptions{DB: "db", ResumeAfter: &start}, 1)
+	if resumed[0].ID != "b" {
+		t.Fatalf("Expected the resumed stream to go on with b, got %s", resumed[0].ID)
+	}
+}
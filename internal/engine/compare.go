@@ -64,6 +64,9 @@ func compareNumbers(a, b any, op string) bool {
 }
 
 func toTime(v any) (time.Time, bool) {
+	if t, ok := v.(time.Time); ok {
+		return t, true
+	}
 	s, ok := v.(string)
 	if !ok {
 		return time.Time{}, false
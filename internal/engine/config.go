@@ -1,6 +1,10 @@
 package engine
 
-import "time"
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
 
 const (
 	DefaultDataDir      = "./data"
@@ -15,12 +19,26 @@ const (
 	DefaultCompactionThreshold   = 3
 	DefaultDeadSpaceThreshold    = 30
 
+	// Segment compression (applied when a segment is sealed or compacted)
+	DefaultSegmentCompression      = CompressionFlate
+	DefaultSegmentCompressionLevel = 6
+
 	// NEW: WAL settings
 	DefaultCheckpointInterval    = 60        // 60 seconds
 	DefaultCheckpointWALSize     = 10 * 1024 * 1024 // 10MB
 	DefaultWALSyncMode          = "batch"   // immediate/batch/async
 	DefaultWALBatchSize         = 100       // entries before fsync
 	DefaultWALBatchTimeout      = 1         // seconds
+
+	// WAL files and archive retention
+	DefaultWALSegmentSize  = 4 * 1024 * 1024
+	DefaultWALRetentionAge = 7 * 24 * time.Hour
+
+	// Group commit: how long a batch-mode leader waits for more writers
+	DefaultGroupCommitDelay = 2 * time.Millisecond
+
+	// Transactions left idle this long are aborted
+	DefaultTxnTimeout = 60 * time.Second
 )
 
 type WALSyncMode string
@@ -31,11 +49,36 @@ const (
 	WALSyncAsync     WALSyncMode = "async"     // fsync on timer (fastest, riskiest)
 )
 
+// WriteConcern says when a write is acknowledged to the caller.
+type WriteConcern string
+
+const (
+	// WriteConcernDefault follows WALSyncMode: immediate and batch wait
+	// for the fsync that covers the write, async doesn't.
+	WriteConcernDefault WriteConcern = ""
+	// WriteConcernAck returns once the change is logged and applied. The
+	// entry is in the OS page cache: it survives a crash of the server,
+	// not of the machine.
+	WriteConcernAck WriteConcern = "ack"
+	// WriteConcernFsync returns once the change is on disk, whatever
+	// WALSyncMode says.
+	WriteConcernFsync WriteConcern = "fsync"
+)
+
+// ParseWriteConcern validates a write concern given by a client.
+func ParseWriteConcern(s string) (WriteConcern, error) {
+	switch wc := WriteConcern(s); wc {
+	case WriteConcernDefault, WriteConcernAck, WriteConcernFsync:
+		return wc, nil
+	}
+	return "", fmt.Errorf("unknown writeConcern %q (expected \"ack\" or \"fsync\")", s)
+}
+
 type Config struct {
 	DataDir     string
 	DBsDir      string
 	WALDir      string
-	WALFile     string
+	WALFile     string // single-file WAL of older versions, converted at startup
 	WALArchiveDir string
 	MaxWALBytes int64
 	MaxDocBytes int
@@ -45,6 +88,12 @@ type Config struct {
 	DeadSpaceThreshold   int
 	EnableAutoCompaction bool
 
+	// Segment compression: codec for all collections, with optional
+	// per-collection overrides keyed by "db.collection".
+	SegmentCompression      string
+	SegmentCompressionLevel int
+	CollectionCompression   map[string]string
+
 	// NEW: WAL configuration
 	CheckpointInterval time.Duration
 	CheckpointWALSize  int64
@@ -52,6 +101,25 @@ type Config struct {
 	WALBatchSize      int
 	WALBatchTimeout   time.Duration
 	EnableWALArchive  bool
+
+	// The WAL is split into files of WALSegmentSize bytes. Archived files
+	// older than WALRetentionAge, beyond the newest WALRetentionCount, or
+	// over WALRetentionBytes in total are deleted; 0 disables a limit.
+	WALSegmentSize    int64
+	WALRetentionAge   time.Duration
+	WALRetentionCount int
+	WALRetentionBytes int64
+
+	// Segment appends follow WALSyncMode; in batch mode a group-commit
+	// leader waits up to GroupCommitDelay for WALBatchSize writers.
+	GroupCommitDelay time.Duration
+
+	// A transaction that goes TxnTimeout without an operation is aborted.
+	TxnTimeout time.Duration
+
+	// Convert every legacy data.db collection to segments at startup,
+	// after WAL replay (see Engine.MigrateToSegments)
+	MigrateLegacyOnStartup bool
 }
 
 func DefaultConfig() Config {
@@ -69,11 +137,64 @@ func DefaultConfig() Config {
 		DeadSpaceThreshold:   DefaultDeadSpaceThreshold,
 		EnableAutoCompaction: true,
 
+		SegmentCompression:      DefaultSegmentCompression,
+		SegmentCompressionLevel: DefaultSegmentCompressionLevel,
+
 		CheckpointInterval: time.Duration(DefaultCheckpointInterval) * time.Second,
 		CheckpointWALSize:  DefaultCheckpointWALSize,
 		WALSyncMode:       WALSyncBatch,
 		WALBatchSize:      DefaultWALBatchSize,
 		WALBatchTimeout:   time.Duration(DefaultWALBatchTimeout) * time.Second,
 		EnableWALArchive:  true,
+		WALSegmentSize:    DefaultWALSegmentSize,
+		WALRetentionAge:   DefaultWALRetentionAge,
+
+		GroupCommitDelay: DefaultGroupCommitDelay,
+		TxnTimeout:       DefaultTxnTimeout,
+	}
+}
+
+// WithDataDir returns cfg with the data, database and WAL paths moved
+// under dataDir, laid out as in the defaults.
+func (cfg Config) WithDataDir(dataDir string) Config {
+	cfg.DataDir = dataDir
+	cfg.DBsDir = filepath.Join(dataDir, "databases")
+	cfg.WALDir = filepath.Join(dataDir, "wal")
+	cfg.WALFile = filepath.Join(cfg.WALDir, "wal.log")
+	cfg.WALArchiveDir = filepath.Join(cfg.WALDir, "archive")
+	return cfg
+}
+
+func (cfg Config) validate() error {
+	if cfg.SegmentCompression != "" && !validCompression(cfg.SegmentCompression) {
+		return fmt.Errorf("unknown segment compression: %s", cfg.SegmentCompression)
 	}
-}
\ No newline at end of file
+	for ns, codec := range cfg.CollectionCompression {
+		if !validCompression(codec) {
+			return fmt.Errorf("unknown segment compression for %s: %s", ns, codec)
+		}
+	}
+	return nil
+}
+
+// segmentOptions resolves the segment settings for one collection.
+func (cfg Config) segmentOptions(db, coll string) SegmentOptions {
+	opts := SegmentOptions{
+		Compression:      cfg.SegmentCompression,
+		CompressionLevel: cfg.SegmentCompressionLevel,
+		SyncMode:         cfg.WALSyncMode,
+		BatchSize:        cfg.WALBatchSize,
+		CommitDelay:      cfg.GroupCommitDelay,
+		SyncInterval:     cfg.WALBatchTimeout,
+
+		CompactionThreshold: cfg.CompactionThreshold,
+		DeadSpaceThreshold:  cfg.DeadSpaceThreshold,
+	}
+	if codec, ok := cfg.CollectionCompression[db+"."+coll]; ok {
+		opts.Compression = codec
+	}
+	if opts.Compression == "" {
+		opts.Compression = CompressionNone
+	}
+	return opts
+}
@@ -3,6 +3,7 @@ package engine
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -10,11 +11,23 @@ import (
 )
 
 func (c *Collection) saveLocked() error {
-	// Deduplicate by _id (preserve last occurrence)
+	unique := dedupeByID(c.Docs)
+
+	b, err := json.MarshalIndent(unique, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(c.DataFile, b, 0666)
+}
+
+// dedupeByID drops every document whose _id appears again later in docs,
+// keeping the order of the survivors. Documents without a string _id are
+// all kept.
+func dedupeByID(docs []types.Document) []types.Document {
 	seen := map[string]bool{}
-	uniqueRev := make([]types.Document, 0, len(c.Docs))
-	for i := len(c.Docs) - 1; i >= 0; i-- {
-		d := c.Docs[i]
+	uniqueRev := make([]types.Document, 0, len(docs))
+	for i := len(docs) - 1; i >= 0; i-- {
+		d := docs[i]
 		idStr := ""
 		if id, ok := d["_id"].(string); ok {
 			idStr = id
@@ -33,12 +46,7 @@ func (c *Collection) saveLocked() error {
 	for i := len(uniqueRev) - 1; i >= 0; i-- {
 		unique = append(unique, uniqueRev[i])
 	}
-
-	b, err := json.MarshalIndent(unique, "", "  ")
-	if err != nil {
-		return err
-	}
-	return atomicWriteFile(c.DataFile, b, 0666)
+	return unique
 }
 
 func (e *Engine) flushAll() error {
@@ -49,7 +57,17 @@ func (e *Engine) flushAll() error {
 		db.mu.RLock()
 		for _, c := range db.collections {
 			c.mu.Lock()
-			_ = c.saveLocked()
+			if c.useSegments && c.segmentMgr != nil {
+				// Appends may not be fsynced yet in batch/async mode; the WAL
+				// must not be checkpointed past them until they are.
+				if err := c.segmentMgr.Sync(); err != nil {
+					c.mu.Unlock()
+					db.mu.RUnlock()
+					return err
+				}
+			} else {
+				_ = c.saveLocked()
+			}
 			c.mu.Unlock()
 		}
 		db.mu.RUnlock()
@@ -92,8 +110,24 @@ func (e *Engine) loadSnapshots() error {
 			// so useSegments was always false during startup, which meant
 			// the duplicate-guard in Insert() never triggered during WAL
 			// replay → every doc got inserted twice on restart.
-			segMgr, segErr := NewSegmentManager(collDir)
-			useSegs := (segErr == nil)
+			//
+			// A data.db with no segments next to it is a legacy collection
+			// that was never migrated: keep reading it (see MigrateToSegments).
+			// An interrupted migration's staging directory is discarded.
+			os.RemoveAll(filepath.Join(collDir, MigrationStagingDir))
+			_, statErr := os.Stat(dataFile)
+			legacy := statErr == nil && !hasSegmentFiles(collDir)
+
+			var segMgr *SegmentManager
+			useSegs := false
+			if !legacy {
+				var segErr error
+				segMgr, segErr = NewSegmentManagerWithOptions(collDir, e.cfg.segmentOptions(dbName, cName))
+				useSegs = (segErr == nil)
+				if useSegs && statErr == nil {
+					fmt.Printf("⚠️  %s/%s: segments found, ignoring %s\n", dbName, cName, dataFile)
+				}
+			}
 
 			var docs []types.Document
 
@@ -114,30 +148,7 @@ func (e *Engine) loadSnapshots() error {
 						for i := range docs {
 							docs[i] = canonicalizeDocument(docs[i])
 						}
-						// Deduplicate by _id (preserve last occurrence)
-						seen := map[string]bool{}
-						uniqueRev := make([]types.Document, 0, len(docs))
-						for i := len(docs) - 1; i >= 0; i-- {
-							d := docs[i]
-							idStr := ""
-							if id, ok := d["_id"].(string); ok {
-								idStr = id
-							}
-							if idStr == "" {
-								uniqueRev = append(uniqueRev, d)
-								continue
-							}
-							if _, ok := seen[idStr]; ok {
-								continue
-							}
-							seen[idStr] = true
-							uniqueRev = append(uniqueRev, d)
-						}
-						uniq := make([]types.Document, 0, len(uniqueRev))
-						for i := len(uniqueRev) - 1; i >= 0; i-- {
-							uniq = append(uniq, uniqueRev[i])
-						}
-						docs = uniq
+						docs = dedupeByID(docs)
 					}
 				}
 			}
@@ -0,0 +1,311 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"testDB/internal/types"
+)
+
+// Binary document encoding (BSON-like) used for segment payloads.
+//
+// document := [count:4] element*
+// element  := [type:1] [keyLen:2] [key] value
+// array    := [count:4] ([type:1] value)*
+//
+// Keys are written in sorted order so the same document always encodes
+// to the same bytes.
+
+const (
+	docTypeFloat64  byte = 0x01
+	docTypeString   byte = 0x02
+	docTypeDocument byte = 0x03
+	docTypeArray    byte = 0x04
+	docTypeBinary   byte = 0x05
+	docTypeBool     byte = 0x08
+	docTypeDatetime byte = 0x09 // int64 unix nanoseconds, UTC
+	docTypeNull     byte = 0x0A
+	docTypeInt64    byte = 0x12
+)
+
+var errDocTruncated = errors.New("document encoding truncated")
+
+// encodeDocument serializes doc into the binary document format.
+func encodeDocument(doc map[string]any) ([]byte, error) {
+	return appendDocument(make([]byte, 0, 256), doc)
+}
+
+func appendDocument(buf []byte, doc map[string]any) ([]byte, error) {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(keys)))
+	for _, k := range keys {
+		if len(k) > math.MaxUint16 {
+			return nil, fmt.Errorf("field name too long: %d bytes", len(k))
+		}
+		typ, err := valueType(doc[k])
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", k, err)
+		}
+		buf = append(buf, typ)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(k)))
+		buf = append(buf, k...)
+		if buf, err = appendValue(buf, typ, doc[k]); err != nil {
+			return nil, fmt.Errorf("field %q: %w", k, err)
+		}
+	}
+	return buf, nil
+}
+
+func valueType(v any) (byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return docTypeNull, nil
+	case bool:
+		return docTypeBool, nil
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return docTypeInt64, nil
+	case uint, uint64:
+		if toUint64(x) > math.MaxInt64 {
+			return docTypeFloat64, nil
+		}
+		return docTypeInt64, nil
+	case float32, float64:
+		return docTypeFloat64, nil
+	case json.Number:
+		return valueType(canonicalizeAny(x))
+	case string:
+		return docTypeString, nil
+	case time.Time:
+		return docTypeDatetime, nil
+	case []byte:
+		return docTypeBinary, nil
+	case types.Document, map[string]any:
+		return docTypeDocument, nil
+	case []any:
+		return docTypeArray, nil
+	default:
+		return 0, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+func appendValue(buf []byte, typ byte, v any) ([]byte, error) {
+	switch typ {
+	case docTypeNull:
+		return buf, nil
+	case docTypeBool:
+		if v.(bool) {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case docTypeInt64:
+		return binary.LittleEndian.AppendUint64(buf, uint64(toInt64(v))), nil
+	case docTypeFloat64:
+		var f float64
+		switch x := v.(type) {
+		case float32:
+			f = float64(x)
+		case float64:
+			f = x
+		case uint, uint64:
+			f = float64(toUint64(x))
+		case json.Number:
+			f, _ = x.Float64()
+		}
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(f)), nil
+	case docTypeString:
+		s := v.(string)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+		return append(buf, s...), nil
+	case docTypeDatetime:
+		return binary.LittleEndian.AppendUint64(buf, uint64(v.(time.Time).UnixNano())), nil
+	case docTypeBinary:
+		b := v.([]byte)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b)))
+		return append(buf, b...), nil
+	case docTypeDocument:
+		switch m := v.(type) {
+		case types.Document:
+			return appendDocument(buf, m)
+		case map[string]any:
+			return appendDocument(buf, m)
+		}
+	case docTypeArray:
+		arr := v.([]any)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(arr)))
+		for i, it := range arr {
+			t, err := valueType(it)
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+			buf = append(buf, t)
+			if buf, err = appendValue(buf, t, it); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("unknown value type 0x%02x", typ)
+}
+
+func toInt64(v any) int64 {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case int8:
+		return int64(x)
+	case int16:
+		return int64(x)
+	case int32:
+		return int64(x)
+	case int64:
+		return x
+	case uint8:
+		return int64(x)
+	case uint16:
+		return int64(x)
+	case uint32:
+		return int64(x)
+	case uint, uint64:
+		return int64(toUint64(x))
+	case json.Number:
+		i, _ := x.Int64()
+		return i
+	}
+	return 0
+}
+
+func toUint64(v any) uint64 {
+	switch x := v.(type) {
+	case uint:
+		return uint64(x)
+	case uint64:
+		return x
+	}
+	return 0
+}
+
+// decodeDocument parses a binary document. Nested documents decode to
+// map[string]any, matching canonicalizeAny.
+func decodeDocument(b []byte) (types.Document, error) {
+	m, n, err := readDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(b) {
+		return nil, fmt.Errorf("document encoding has %d trailing bytes", len(b)-n)
+	}
+	return types.Document(m), nil
+}
+
+func readDocument(b []byte) (map[string]any, int, error) {
+	if len(b) < 4 {
+		return nil, 0, errDocTruncated
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	pos := 4
+	// Every element needs at least 3 bytes (type + key length)
+	if count > (len(b)-pos)/3 {
+		return nil, 0, errDocTruncated
+	}
+
+	m := make(map[string]any, count)
+	for i := 0; i < count; i++ {
+		if pos+3 > len(b) {
+			return nil, 0, errDocTruncated
+		}
+		typ := b[pos]
+		keyLen := int(binary.LittleEndian.Uint16(b[pos+1:]))
+		pos += 3
+		if pos+keyLen > len(b) {
+			return nil, 0, errDocTruncated
+		}
+		key := string(b[pos : pos+keyLen])
+		pos += keyLen
+
+		v, n, err := readValue(typ, b[pos:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("field %q: %w", key, err)
+		}
+		m[key] = v
+		pos += n
+	}
+	return m, pos, nil
+}
+
+func readValue(typ byte, b []byte) (any, int, error) {
+	switch typ {
+	case docTypeNull:
+		return nil, 0, nil
+	case docTypeBool:
+		if len(b) < 1 {
+			return nil, 0, errDocTruncated
+		}
+		return b[0] != 0, 1, nil
+	case docTypeInt64:
+		if len(b) < 8 {
+			return nil, 0, errDocTruncated
+		}
+		return int64(binary.LittleEndian.Uint64(b)), 8, nil
+	case docTypeFloat64:
+		if len(b) < 8 {
+			return nil, 0, errDocTruncated
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), 8, nil
+	case docTypeDatetime:
+		if len(b) < 8 {
+			return nil, 0, errDocTruncated
+		}
+		return time.Unix(0, int64(binary.LittleEndian.Uint64(b))).UTC(), 8, nil
+	case docTypeString, docTypeBinary:
+		if len(b) < 4 {
+			return nil, 0, errDocTruncated
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n > len(b)-4 {
+			return nil, 0, errDocTruncated
+		}
+		if typ == docTypeString {
+			return string(b[4 : 4+n]), 4 + n, nil
+		}
+		out := make([]byte, n)
+		copy(out, b[4:4+n])
+		return out, 4 + n, nil
+	case docTypeDocument:
+		return readDocument(b)
+	case docTypeArray:
+		if len(b) < 4 {
+			return nil, 0, errDocTruncated
+		}
+		count := int(binary.LittleEndian.Uint32(b))
+		pos := 4
+		if count > len(b)-pos {
+			return nil, 0, errDocTruncated
+		}
+		arr := make([]any, 0, count)
+		for i := 0; i < count; i++ {
+			if pos >= len(b) {
+				return nil, 0, errDocTruncated
+			}
+			t := b[pos]
+			pos++
+			v, n, err := readValue(t, b[pos:])
+			if err != nil {
+				return nil, 0, fmt.Errorf("index %d: %w", i, err)
+			}
+			arr = append(arr, v)
+			pos += n
+		}
+		return arr, pos, nil
+	}
+	return nil, 0, fmt.Errorf("unknown value type 0x%02x", typ)
+}
@@ -3,6 +3,7 @@ package engine
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 	"testDB/internal/types"
@@ -17,6 +18,9 @@ type Engine struct {
 
 	cfg Config
 	walv2 *WALv2 
+
+	txnMu sync.Mutex
+	txns  map[string]*Txn // open transactions by ID
 }
 
 type Database struct {
@@ -43,17 +47,33 @@ type Collection struct {
 
 type WALEntry struct {
 	TS         int64          `json:"ts"`
-	Op         string         `json:"op"` // insert|update|delete
+	Op         string         `json:"op"` // insert|update|delete|abort
 	DB         string         `json:"db"`
 	Collection string         `json:"collection"`
 	Doc        types.Document `json:"doc,omitempty"`
 	Filter     map[string]any `json:"filter,omitempty"`
 	Update     map[string]any `json:"update,omitempty"`
 	Multi      bool           `json:"multi,omitempty"`
+
+	// Physical changes: the _ids an update or delete touched and, for
+	// updates, the resulting documents. Replay applies these instead of
+	// re-running Filter/Update, which older WAL files still carry.
+	IDs  []string         `json:"ids,omitempty"`
+	Docs []types.Document `json:"docs,omitempty"`
+
+	// Ops are the changes of a transaction (Op "txn"), logged as one
+	// entry so replay applies all of them or none.
+	Ops []WALEntry `json:"ops,omitempty"`
+
+	// Aborts is the LSN of the logged write an abort entry cancels.
+	Aborts int64 `json:"aborts,omitempty"`
 }
 
 
 func New(cfg Config) (*Engine, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 	if err := ensureDirs(cfg); err != nil {
 		return nil, err
 	}
@@ -61,6 +81,7 @@ func New(cfg Config) (*Engine, error) {
 	e := &Engine{
 		databases: map[string]*Database{},
 		cfg:       cfg,
+		txns:      map[string]*Txn{},
 	}
 
 	// Initialize WAL v2
@@ -75,18 +96,21 @@ func New(cfg Config) (*Engine, error) {
 		return nil, err
 	}
 
+	// A checkpointed WAL may be empty: continue numbering after the
+	// highest LSN storage already holds
+	walv2.AdvanceSequence(e.maxDurableLSN())
+
 	// Replay WAL
 	if err := e.replayWALv2(); err != nil {
 		return nil, err
 	}
 
+	if cfg.MigrateLegacyOnStartup {
+		e.migrateLegacyCollections()
+	}
+
 	// Start auto-checkpoint
-	walv2.StartAutoCheckpoint(func() error {
-    if err := e.flushAll(); err != nil {
-        return err
-    }
-    return e.walv2.Checkpoint() // clear WAL after durable snapshot
-})
+	walv2.StartAutoCheckpoint(e.checkpoint)
 
 	return e, nil
 }
@@ -134,7 +158,7 @@ func (db *Database) getOrCreateCollection(cfg Config, collName string) (*Collect
 	dataFile := collectionDataFile(cfg, db.Name, collName)
 
 	// Try to create segment manager
-	segMgr, segErr := NewSegmentManager(collDir)
+	segMgr, segErr := NewSegmentManagerWithOptions(collDir, cfg.segmentOptions(db.Name, collName))
 	useSegs := (segErr == nil)
 
 	c := &Collection{
@@ -154,25 +178,16 @@ func (db *Database) getOrCreateCollection(cfg Config, collName string) (*Collect
 }
 
 // docExistsInSegments checks if a document with the given ID already exists
-// in segment storage. Used during WAL replay to prevent duplicates.
+// in segment storage. Used to reject duplicate _id values.
 func (c *Collection) docExistsInSegments(docID string) bool {
 	if !c.useSegments || c.segmentMgr == nil {
 		return false
 	}
-	docs, err := c.segmentMgr.ReadAll()
-	if err != nil {
-		return false
-	}
-	for _, d := range docs {
-		if id, ok := d["_id"].(string); ok && id == docID {
-			return true
-		}
-	}
-	return false
+	return c.segmentMgr.Has(docID)
 }
 
 // docExistsInDocs checks if a document with the given ID already exists
-// in the in-memory Docs slice. Used during WAL replay to prevent duplicates.
+// in the in-memory Docs slice. Used to reject duplicate _id values.
 func (c *Collection) docExistsInDocs(docID string) bool {
 	for _, d := range c.Docs {
 		if id, ok := d["_id"].(string); ok && id == docID {
@@ -182,7 +197,105 @@ func (c *Collection) docExistsInDocs(docID string) bool {
 	return false
 }
 
+// getDocLocked returns the stored document with the given _id. Caller must
+// hold c.mu.
+func (c *Collection) getDocLocked(docID string) (types.Document, bool, error) {
+	if c.useSegments && c.segmentMgr != nil {
+		return c.segmentMgr.Get(docID)
+	}
+	for _, d := range c.Docs {
+		if fmt.Sprintf("%v", d["_id"]) == docID {
+			return d, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// putDocLocked stores doc as the current image of its _id, replacing any
+// earlier one, and keeps the secondary indexes in step. lsn is the WAL
+// entry the change comes from. Caller must hold
+// c.mu and wait on the returned ticket after releasing it.
+func (c *Collection) putDocLocked(doc types.Document, lsn int64) (commitTicket, error) {
+	docID := fmt.Sprintf("%v", doc["_id"])
+	old, exists, err := c.getDocLocked(docID)
+	if err != nil {
+		return commitTicket{}, err
+	}
+
+	var ticket commitTicket
+	if c.useSegments && c.segmentMgr != nil {
+		if ticket, err = c.segmentMgr.appendDoc(docID, doc, lsn); err != nil {
+			return commitTicket{}, err
+		}
+	} else {
+		replaced := false
+		for i, d := range c.Docs {
+			if fmt.Sprintf("%v", d["_id"]) == docID {
+				c.Docs[i] = doc
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.Docs = append(c.Docs, doc)
+		}
+		if err := c.saveLocked(); err != nil {
+			return commitTicket{}, err
+		}
+	}
+
+	if exists {
+		c.unindexDocLocked(old)
+	} else {
+		for _, idx := range c.Indexes {
+			val := getIndexValue(doc, idx.Field)
+			idx.Entries[val] = append(idx.Entries[val], docID)
+		}
+	}
+	c.indexDocLocked(doc)
+	return ticket, nil
+}
+
+// removeDocLocked deletes the document with the given _id, if any. Caller
+// must hold c.mu and wait on the returned ticket after releasing it.
+func (c *Collection) removeDocLocked(docID string, lsn int64) (bool, commitTicket, error) {
+	old, exists, err := c.getDocLocked(docID)
+	if err != nil || !exists {
+		return false, commitTicket{}, err
+	}
+
+	var ticket commitTicket
+	if c.useSegments && c.segmentMgr != nil {
+		if ticket, err = c.segmentMgr.deleteDoc(docID, lsn); err != nil {
+			return false, commitTicket{}, err
+		}
+	} else {
+		kept := make([]types.Document, 0, len(c.Docs))
+		for _, d := range c.Docs {
+			if fmt.Sprintf("%v", d["_id"]) != docID {
+				kept = append(kept, d)
+			}
+		}
+		c.Docs = kept
+		if err := c.saveLocked(); err != nil {
+			return false, commitTicket{}, err
+		}
+	}
+	c.unindexDocLocked(old)
+	return true, ticket, nil
+}
+
 func (e *Engine) Insert(dbName, collName string, doc types.Document, doLog bool) (string, error) {
+	return e.insert(dbName, collName, doc, doLog, WriteConcernDefault)
+}
+
+// InsertWithConcern logs and inserts doc, returning once it is as durable
+// as wc asks.
+func (e *Engine) InsertWithConcern(dbName, collName string, doc types.Document, wc WriteConcern) (string, error) {
+	return e.insert(dbName, collName, doc, true, wc)
+}
+
+func (e *Engine) insert(dbName, collName string, doc types.Document, doLog bool, wc WriteConcern) (string, error) {
 	db, err := e.getOrCreateDB(dbName)
 	if err != nil {
 		return "", err
@@ -203,61 +316,225 @@ func (e *Engine) Insert(dbName, collName string, doc types.Document, doLog bool)
 	}
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	docID, ticket, err := e.insertLocked(db, c, doc, doLog)
+	c.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
 
+	// Wait for durability outside c.mu so concurrent writers share fsyncs
+	if err := ticket.Wait(wc); err != nil {
+		return "", err
+	}
+	return docID, nil
+}
+
+// insertLocked stores a canonicalized doc. Caller must hold c.mu and wait
+// on the returned ticket after releasing it.
+func (e *Engine) insertLocked(db *Database, c *Collection, doc types.Document, doLog bool) (string, writeTicket, error) {
 	if _, ok := doc["_id"]; !ok {
 		doc["_id"] = NewObjectID() // A1: ObjectId-like sortable id
 	}
 	if _, ok := doc["_created"]; !ok {
 		doc["_created"] = time.Now().Unix()
 	}
+	doc["_version"] = int64(1)
 
 	docID := fmt.Sprintf("%v", doc["_id"])
 
-	// During WAL replay: skip insert if the document already exists in storage.
-	// This prevents duplicates caused by: loadSnapshots (loads from segments)
-	// followed by replayWALv2 (re-inserts the same docs from WAL).
-	if e.replaying {
-		if c.useSegments && c.segmentMgr != nil {
-			if c.docExistsInSegments(docID) {
-				// Doc already loaded from snapshot — WAL replay is redundant, skip it.
-				return docID, nil
-			}
-		} else {
-			if c.docExistsInDocs(docID) {
-				return docID, nil
-			}
+	// Reject duplicate _id values. (WAL replay doesn't come through here:
+	// it compares entry LSNs with what storage holds, see replayEntry.)
+	exists := false
+	if c.useSegments && c.segmentMgr != nil {
+		exists = c.docExistsInSegments(docID)
+	} else {
+		exists = c.docExistsInDocs(docID)
+	}
+	if exists {
+		return "", writeTicket{}, fmt.Errorf("duplicate _id: %s", docID)
+	}
+
+	for _, idx := range c.Indexes {
+		val := getIndexValue(doc, idx.Field)
+		if idx.Unique && len(idx.Entries[val]) > 0 {
+			return "", writeTicket{}, fmt.Errorf("duplicate value for unique index: %s", idx.Field)
 		}
 	}
 
+	// Write-ahead: log first so the stored record carries the entry's LSN
+	lsn, walTicket, err := e.logWrite(doLog, WALEntry{TS: time.Now().Unix(), Op: "insert", DB: db.Name, Collection: c.Name, Doc: doc})
+	if err != nil {
+		return "", writeTicket{}, err
+	}
+	stored := false
+	defer func() { e.settleWrite(lsn, stored) }()
+
 	// Use segments if available, otherwise fallback to old method
+	ticket := writeTicket{wal: walTicket}
 	if c.useSegments && c.segmentMgr != nil {
-		if err := c.segmentMgr.Append(docID, doc); err != nil {
-			return "", err
+		t, err := c.segmentMgr.appendDoc(docID, doc, lsn)
+		if err != nil {
+			return "", writeTicket{}, e.failWrite(lsn, err)
 		}
+		ticket.store = t
 	} else {
 		// Old method (backward compatibility)
 		c.Docs = append(c.Docs, doc)
 		if err := c.saveLocked(); err != nil {
-			return "", err
+			return "", writeTicket{}, e.failWrite(lsn, err)
 		}
 	}
+	c.indexDocLocked(doc)
 
 	for _, idx := range c.Indexes {
 		val := getIndexValue(doc, idx.Field)
-		if idx.Unique && len(idx.Entries[val]) > 0 {
-			return "", fmt.Errorf("duplicate value for unique index: %s", idx.Field)
-		}
 		idx.Entries[val] = append(idx.Entries[val], docID)
 	}
 
-	if doLog && !e.replaying {
-		_ = e.walAppend(WALEntry{TS: time.Now().Unix(), Op: "insert", DB: db.Name, Collection: c.Name, Doc: doc})
+	stored = true
+	return docID, ticket, nil
+}
+
+// candidateDocsLocked returns the documents that may match filter. When
+// the planner picks an index (or the primary key) only those documents
+// are read; otherwise every live document is returned. Caller must hold
+// c.mu.
+func (c *Collection) candidateDocsLocked(filter map[string]any) ([]types.Document, error) {
+	// Fast path: try to use index to reduce scanned documents
+	if ids, ok := c.candidateIDsByIndex(filter); ok {
+		return c.docsByIDsLocked(ids)
 	}
 
-	return docID, nil
+	// Slow path: full collection scan, skipping segments whose zone maps
+	// rule out a match
+	if c.useSegments && c.segmentMgr != nil {
+		return c.segmentMgr.Scan(filter)
+	}
+	return c.Docs, nil
+}
+
+// docsByIDsLocked fetches the live documents with the given IDs, skipping
+// unknown IDs and duplicates. Caller must hold c.mu.
+func (c *Collection) docsByIDsLocked(ids []string) ([]types.Document, error) {
+	idSet := make(map[string]bool, len(ids))
+	out := make([]types.Document, 0, len(ids))
+
+	if c.useSegments && c.segmentMgr != nil {
+		for _, id := range ids {
+			if idSet[id] {
+				continue
+			}
+			idSet[id] = true
+			d, ok, err := c.segmentMgr.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, d)
+			}
+		}
+		return out, nil
+	}
+
+	for _, id := range ids {
+		idSet[id] = true
+	}
+	for _, d := range c.Docs {
+		if docID, ok := d["_id"].(string); ok && idSet[docID] {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// readView is what a query reads: the collection as of one moment, taken
+// under c.mu and read after releasing it.
+type readView struct {
+	ids  []string         // candidates from an index, if one applied
+	snap *SegmentSnapshot // segment storage
+	docs []types.Document // legacy storage
+
+	plan     *QueryPlan // how the candidates were found, and the plans passed over
+	rejected []*QueryPlan
+	keys     int // index entries the plan examined
+}
+
+// readViewLocked captures the documents that may match filter, the way
+// candidateDocsLocked picks them. Caller must hold c.mu and release the
+// view once read.
+func (c *Collection) readViewLocked(filter map[string]any) (*readView, error) {
+	plan, rejected := c.planLocked(filter)
+
+	var v *readView
+	keys := 0
+	switch {
+	case plan.run != nil:
+		var ids []string
+		ids, keys = plan.run()
+		var err error
+		if v, err = c.idsViewLocked(ids); err != nil {
+			return nil, err
+		}
+	case c.useSegments && c.segmentMgr != nil:
+		v = &readView{snap: c.segmentMgr.Snapshot()}
+	default:
+		// Updates replace c.Docs entries in place
+		v = &readView{docs: append([]types.Document(nil), c.Docs...)}
+	}
+	v.plan, v.rejected, v.keys = plan, rejected, keys
+	return v, nil
+}
+
+// idsViewLocked captures the documents with ids. Caller must hold c.mu and
+// release the view once read.
+func (c *Collection) idsViewLocked(ids []string) (*readView, error) {
+	if len(ids) == 0 {
+		return &readView{}, nil
+	}
+	if c.useSegments && c.segmentMgr != nil {
+		// Index entries change in place under c.mu
+		return &readView{ids: append([]string(nil), ids...), snap: c.segmentMgr.Snapshot()}, nil
+	}
+	docs, err := c.docsByIDsLocked(ids)
+	return &readView{docs: docs}, err
+}
+
+// candidates returns the documents of the view that may match filter.
+func (v *readView) candidates(filter map[string]any) ([]types.Document, error) {
+	if v.snap == nil {
+		return v.docs, nil
+	}
+	if v.ids == nil {
+		return v.snap.Scan(filter)
+	}
+
+	seen := make(map[string]bool, len(v.ids))
+	out := make([]types.Document, 0, len(v.ids))
+	for _, id := range v.ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		d, ok, err := v.snap.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, d)
+		}
+	}
+	return out, nil
 }
 
+func (v *readView) release() {
+	if v.snap != nil {
+		v.snap.Release()
+	}
+}
+
+// Query returns the documents matching filter, sorted, paged and projected.
+// It reads a snapshot of the collection taken when it starts, so writers
+// only wait for the snapshot to be taken, never for the scan or the sort.
 func (e *Engine) Query(
 	dbName, collName string,
 	filter map[string]any,
@@ -265,76 +542,59 @@ func (e *Engine) Query(
 	limit, skip int,
 	projection map[string]int,
 ) ([]types.Document, error) {
+	res, _, err := e.query(dbName, collName, filter, sortSpec, limit, skip, projection)
+	return res, err
+}
+
+// Explain runs a query as Query does, and also reports the plan it used,
+// the plans it rejected and what running it took.
+func (e *Engine) Explain(
+	dbName, collName string,
+	filter map[string]any,
+	sortSpec map[string]int,
+	limit, skip int,
+	projection map[string]int,
+) ([]types.Document, *QueryExplain, error) {
+	return e.query(dbName, collName, filter, sortSpec, limit, skip, projection)
+}
+
+func (e *Engine) query(
+	dbName, collName string,
+	filter map[string]any,
+	sortSpec map[string]int,
+	limit, skip int,
+	projection map[string]int,
+) ([]types.Document, *QueryExplain, error) {
+	start := time.Now()
 
 	db, err := e.getOrCreateDB(dbName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	c, err := db.getOrCreateCollection(e.cfg, collName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	var out []types.Document
-
-	// ────────────────────────────────────────────────────────────────
-	// Fast path: try to use index to reduce scanned documents
-	// ────────────────────────────────────────────────────────────────
-	if ids, ok := c.candidateIDsByIndex(filter); ok && len(ids) > 0 {
-
-		// Get all docs (from segments or memory)
-		var allDocs []types.Document
-		if c.useSegments && c.segmentMgr != nil {
-			var err error
-			allDocs, err = c.segmentMgr.ReadAll()
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			allDocs = c.Docs
-		}
-
-		// Create ID set for fast lookup
-		idSet := make(map[string]bool)
-		for _, id := range ids {
-			idSet[id] = true
-		}
-
-		out = make([]types.Document, 0, len(ids))
-		for _, d := range allDocs {
-			if docID, ok := d["_id"].(string); ok && idSet[docID] {
-				// Safety / correctness: re-check full filter
-				if matchesFilter(d, filter) {
-					out = append(out, d)
-				}
-			}
-		}
-
-	} else {
-		// Slow path: full collection scan
-		var allDocs []types.Document
+	view, err := c.readViewLocked(filter)
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer view.release()
 
-		if c.useSegments && c.segmentMgr != nil {
-			// Read from segments
-			var err error
-			allDocs, err = c.segmentMgr.ReadAll()
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			// Old method: use in-memory Docs
-			allDocs = c.Docs
-		}
+	candidates, err := view.candidates(filter)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		out = make([]types.Document, 0, len(allDocs)/4)
-		for _, d := range allDocs {
-			if matchesFilter(d, filter) {
-				out = append(out, d)
-			}
+	// Safety / correctness: re-check full filter (index candidates are a superset)
+	out := make([]types.Document, 0, len(candidates)/4)
+	for _, d := range candidates {
+		if matchesFilter(d, filter) {
+			out = append(out, d)
 		}
 	}
 
@@ -352,10 +612,35 @@ func (e *Engine) Query(
 	res := make([]types.Document, len(out))
 	copy(res, out)
 
-	return res, nil
+	explain := &QueryExplain{
+		Plan:          view.plan,
+		RejectedPlans: view.rejected,
+		KeysExamined:  view.keys,
+		DocsExamined:  len(candidates),
+		Returned:      len(res),
+		ElapsedMicros: time.Since(start).Microseconds(),
+	}
+	return res, explain, nil
 }
 
 func (e *Engine) Update(dbName, collName string, filter map[string]any, update map[string]any, multi bool, doLog bool) (int, error) {
+	return e.update(dbName, collName, filter, update, multi, nil, doLog, WriteConcernDefault)
+}
+
+// UpdateWithConcern logs and applies update, returning once the change is
+// as durable as wc asks.
+func (e *Engine) UpdateWithConcern(dbName, collName string, filter map[string]any, update map[string]any, multi bool, wc WriteConcern) (int, error) {
+	return e.update(dbName, collName, filter, update, multi, nil, true, wc)
+}
+
+// UpdateIfVersion applies update to the first document matching filter,
+// provided its _version is still version; otherwise it fails with
+// ErrVersionConflict and changes nothing.
+func (e *Engine) UpdateIfVersion(dbName, collName string, filter map[string]any, update map[string]any, version int64, wc WriteConcern) (int, error) {
+	return e.update(dbName, collName, filter, update, false, &version, true, wc)
+}
+
+func (e *Engine) update(dbName, collName string, filter map[string]any, update map[string]any, multi bool, ifVersion *int64, doLog bool, wc WriteConcern) (int, error) {
 	db, err := e.getOrCreateDB(dbName)
 	if err != nil {
 		return 0, err
@@ -369,68 +654,151 @@ func (e *Engine) Update(dbName, collName string, filter map[string]any, update m
 	}
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	images, ticket, err := e.updateLocked(db, c, filter, update, multi, ifVersion, doLog)
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := ticket.Wait(wc); err != nil {
+		return 0, err
+	}
+	return len(images), nil
+}
 
-	// Get all docs
+// updateLocked applies update to the matching docs, each of which must be
+// at *ifVersion unless it is nil, and returns their new images. Caller must
+// hold c.mu and wait on the returned ticket after releasing it.
+func (e *Engine) updateLocked(db *Database, c *Collection, filter map[string]any, update map[string]any, multi bool, ifVersion *int64, doLog bool) ([]types.Document, writeTicket, error) {
+	return e.rewriteLocked(db, c, filter, multi, ifVersion, doLog, func(d types.Document) (types.Document, error) {
+		nd := cloneDocument(d)
+		return nd, applyUpdateOperators(nd, update)
+	})
+}
+
+// replaceLocked replaces the first doc matching filter with replacement,
+// keeping its _id and _created. Caller must hold c.mu and wait on the
+// returned ticket after releasing it.
+func (e *Engine) replaceLocked(db *Database, c *Collection, filter map[string]any, replacement types.Document, doLog bool) ([]types.Document, writeTicket, error) {
+	for k := range replacement {
+		if strings.HasPrefix(k, "$") {
+			return nil, writeTicket{}, fmt.Errorf("replacement can't contain operator %s", k)
+		}
+	}
+	return e.rewriteLocked(db, c, filter, false, nil, doLog, func(d types.Document) (types.Document, error) {
+		nd := canonicalizeDocument(replacement)
+		if id, ok := nd["_id"]; ok && fmt.Sprintf("%v", id) != fmt.Sprintf("%v", d["_id"]) {
+			return nil, fmt.Errorf("replacement can't change _id of %v", d["_id"])
+		}
+		nd["_id"] = d["_id"]
+		if created, ok := d["_created"]; ok {
+			nd["_created"] = created
+		}
+		return nd, nil
+	})
+}
+
+// rewriteLocked replaces each matching doc with the image change derives
+// from it, logged as one update. Caller must hold c.mu and wait on the
+// returned ticket after releasing it.
+func (e *Engine) rewriteLocked(db *Database, c *Collection, filter map[string]any, multi bool, ifVersion *int64, doLog bool, change func(types.Document) (types.Document, error)) ([]types.Document, writeTicket, error) {
+	// Segments: only read candidate docs. Legacy: walk c.Docs in place.
 	var allDocs []types.Document
 	if c.useSegments && c.segmentMgr != nil {
 		var err error
-		allDocs, err = c.segmentMgr.ReadAll()
+		allDocs, err = c.candidateDocsLocked(filter)
 		if err != nil {
-			return 0, err
+			return nil, writeTicket{}, err
 		}
 	} else {
 		allDocs = c.Docs
 	}
 
-	updated := 0
+	// Work out every new image before anything is logged or written
+	var pos []int
+	var ids []string
+	var images []types.Document
 	for i := range allDocs {
 		d := allDocs[i]
 		if matchesFilter(d, filter) {
-			if err := applyUpdateOperators(d, update); err != nil {
-				return 0, err
+			if err := checkVersion(d, ifVersion); err != nil {
+				return nil, writeTicket{}, err
 			}
-			d["_updated"] = time.Now().Unix()
-
-			// A1 doc size limit after update
-			if err := enforceDocSizeLimit(d, e.cfg.MaxDocBytes); err != nil {
-				return 0, err
+			nd, err := change(d)
+			if err != nil {
+				return nil, writeTicket{}, err
 			}
+			nd["_updated"] = time.Now().Unix()
+			nd["_version"] = DocVersion(d) + 1
 
-			// If using segments, append updated doc
-			if c.useSegments && c.segmentMgr != nil {
-				docID := fmt.Sprintf("%v", d["_id"])
-				if err := c.segmentMgr.Append(docID, d); err != nil {
-					return 0, err
-				}
+			// A1 doc size limit after update
+			if err := enforceDocSizeLimit(nd, e.cfg.MaxDocBytes); err != nil {
+				return nil, writeTicket{}, err
 			}
 
-			updated++
+			pos = append(pos, i)
+			ids = append(ids, fmt.Sprintf("%v", nd["_id"]))
+			images = append(images, nd)
 			if !multi {
 				break
 			}
 		}
 	}
+	if len(images) == 0 {
+		return nil, writeTicket{}, nil
+	}
 
-	if updated > 0 {
+	lsn, walTicket, err := e.logWrite(doLog, WALEntry{TS: time.Now().Unix(), Op: "update", DB: db.Name, Collection: c.Name, IDs: ids, Docs: images})
+	if err != nil {
+		return nil, writeTicket{}, err
+	}
+	stored := false
+	defer func() { e.settleWrite(lsn, stored) }()
+
+	ticket := writeTicket{wal: walTicket}
+	for k, i := range pos {
+		d, nd := allDocs[i], images[k]
+		// If using segments, append updated doc
 		if c.useSegments && c.segmentMgr != nil {
-			// Segment storage handles updates via append
-			// (already appended in the loop)
-		} else {
-			// Old method
-			c.Docs = allDocs // Update in-memory
-			if err := c.saveLocked(); err != nil {
-				return 0, err
+			t, err := c.segmentMgr.appendDoc(ids[k], nd, lsn)
+			if err != nil {
+				return nil, writeTicket{}, e.failWrite(lsn, err)
 			}
+			ticket.store = t
 		}
-		if doLog && !e.replaying {
-			_ = e.walAppend(WALEntry{TS: time.Now().Unix(), Op: "update", DB: db.Name, Collection: c.Name, Filter: filter, Update: update, Multi: multi})
+		allDocs[i] = nd
+		c.unindexDocLocked(d)
+		c.indexDocLocked(nd)
+	}
+
+	if !c.useSegments || c.segmentMgr == nil {
+		// Old method
+		c.Docs = allDocs // Update in-memory
+		if err := c.saveLocked(); err != nil {
+			return nil, writeTicket{}, e.failWrite(lsn, err)
 		}
 	}
-	return updated, nil
+	stored = true
+	return images, ticket, nil
 }
 
 func (e *Engine) Delete(dbName, collName string, filter map[string]any, multi bool, doLog bool) (int, error) {
+	return e.delete(dbName, collName, filter, multi, nil, doLog, WriteConcernDefault)
+}
+
+// DeleteWithConcern logs and applies the delete, returning once it is as
+// durable as wc asks.
+func (e *Engine) DeleteWithConcern(dbName, collName string, filter map[string]any, multi bool, wc WriteConcern) (int, error) {
+	return e.delete(dbName, collName, filter, multi, nil, true, wc)
+}
+
+// DeleteIfVersion deletes the first document matching filter, provided its
+// _version is still version; otherwise it fails with ErrVersionConflict
+// and deletes nothing.
+func (e *Engine) DeleteIfVersion(dbName, collName string, filter map[string]any, version int64, wc WriteConcern) (int, error) {
+	return e.delete(dbName, collName, filter, false, &version, true, wc)
+}
+
+func (e *Engine) delete(dbName, collName string, filter map[string]any, multi bool, ifVersion *int64, doLog bool, wc WriteConcern) (int, error) {
 	db, err := e.getOrCreateDB(dbName)
 	if err != nil {
 		return 0, err
@@ -441,21 +809,35 @@ func (e *Engine) Delete(dbName, collName string, filter map[string]any, multi bo
 	}
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	deleted, ticket, err := e.deleteLocked(db, c, filter, multi, ifVersion, doLog)
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := ticket.Wait(wc); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
 
-	// Get all docs
+// deleteLocked removes the matching docs, each of which must be at
+// *ifVersion unless it is nil. Caller must hold c.mu and wait on the
+// returned ticket after releasing it.
+func (e *Engine) deleteLocked(db *Database, c *Collection, filter map[string]any, multi bool, ifVersion *int64, doLog bool) (int, writeTicket, error) {
+	// Segments: only read candidate docs. Legacy: rebuild c.Docs without matches.
 	var allDocs []types.Document
 	if c.useSegments && c.segmentMgr != nil {
 		var err error
-		allDocs, err = c.segmentMgr.ReadAll()
+		allDocs, err = c.candidateDocsLocked(filter)
 		if err != nil {
-			return 0, err
+			return 0, writeTicket{}, err
 		}
 	} else {
 		allDocs = c.Docs
 	}
 
-	deleted := 0
+	var ids []string
+	var removed []types.Document
 	var newDocs []types.Document
 
 	if !c.useSegments {
@@ -463,48 +845,52 @@ func (e *Engine) Delete(dbName, collName string, filter map[string]any, multi bo
 	}
 
 	for _, d := range allDocs {
-		if matchesFilter(d, filter) {
-			// Delete from segments (tombstone)
-			if c.useSegments && c.segmentMgr != nil {
-				docID := fmt.Sprintf("%v", d["_id"])
-				if err := c.segmentMgr.Delete(docID); err != nil {
-					return 0, err
-				}
-			}
-
-			deleted++
-			if !multi && deleted == 1 {
-				if !c.useSegments {
-					continue
-				} else {
-					break
-				}
-			}
-			if multi {
-				if !c.useSegments {
-					continue
-				}
+		if (multi || len(ids) == 0) && matchesFilter(d, filter) {
+			if err := checkVersion(d, ifVersion); err != nil {
+				return 0, writeTicket{}, err
 			}
+			ids = append(ids, fmt.Sprintf("%v", d["_id"]))
+			removed = append(removed, d)
+			continue
 		}
 
 		if !c.useSegments {
 			newDocs = append(newDocs, d)
 		}
 	}
+	if len(ids) == 0 {
+		return 0, writeTicket{}, nil
+	}
 
-	if deleted > 0 {
-		if !c.useSegments {
-			c.Docs = newDocs
-			if err := c.saveLocked(); err != nil {
-				return 0, err
+	lsn, walTicket, err := e.logWrite(doLog, WALEntry{TS: time.Now().Unix(), Op: "delete", DB: db.Name, Collection: c.Name, IDs: ids})
+	if err != nil {
+		return 0, writeTicket{}, err
+	}
+	stored := false
+	defer func() { e.settleWrite(lsn, stored) }()
+
+	ticket := writeTicket{wal: walTicket}
+	for k, d := range removed {
+		// Delete from segments (tombstone)
+		if c.useSegments && c.segmentMgr != nil {
+			t, err := c.segmentMgr.deleteDoc(ids[k], lsn)
+			if err != nil {
+				return 0, writeTicket{}, e.failWrite(lsn, err)
 			}
+			ticket.store = t
 		}
-		if doLog && !e.replaying {
-			_ = e.walAppend(WALEntry{TS: time.Now().Unix(), Op: "delete", DB: db.Name, Collection: c.Name, Filter: filter, Multi: multi})
+		c.unindexDocLocked(d)
+	}
+
+	if !c.useSegments {
+		c.Docs = newDocs
+		if err := c.saveLocked(); err != nil {
+			return 0, writeTicket{}, e.failWrite(lsn, err)
 		}
 	}
 
-	return deleted, nil
+	stored = true
+	return len(ids), ticket, nil
 }
 
 func (e *Engine) Databases() []string {
@@ -542,8 +928,7 @@ func (e *Engine) Stats(dbName string) map[string]any {
 			totalColl++
 			c.mu.RLock()
 			if c.useSegments && c.segmentMgr != nil {
-				docs, _ := c.segmentMgr.ReadAll()
-				totalDocs += len(docs)
+				totalDocs += c.segmentMgr.Count()
 			} else {
 				totalDocs += len(c.Docs)
 			}
@@ -558,8 +943,7 @@ func (e *Engine) Stats(dbName string) map[string]any {
 		for _, c := range db.collections {
 			c.mu.RLock()
 			if c.useSegments && c.segmentMgr != nil {
-				docs, _ := c.segmentMgr.ReadAll()
-				totalDocs += len(docs)
+				totalDocs += c.segmentMgr.Count()
 			} else {
 				totalDocs += len(c.Docs)
 			}
@@ -573,35 +957,47 @@ func (e *Engine) Stats(dbName string) map[string]any {
 
 // Shutdown closes all segments cleanly
 func (e *Engine) Shutdown() error {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
-
 	fmt.Println("Shutting down AstraDB...")
 
-	for _, db := range e.databases {
-		db.mu.RLock()
-		for _, c := range db.collections {
-			c.mu.Lock()
-			if c.useSegments && c.segmentMgr != nil {
-				fmt.Printf("Compacting %s/%s\n", db.Name, c.Name)
-				_ = c.segmentMgr.Compact()
-				_ = c.segmentMgr.Close()
-			}
-			c.mu.Unlock()
+	e.forEachCollection(func(db *Database, c *Collection) {
+		c.mu.Lock()
+		if c.useSegments && c.segmentMgr != nil {
+			fmt.Printf("Compacting %s/%s\n", db.Name, c.Name)
+			_ = c.segmentMgr.Compact()
 		}
-		db.mu.RUnlock()
+		c.mu.Unlock()
+	})
+
+	// The checkpoint flushes the segments, so they are closed after it
+	err := e.checkpoint()
+	if err != nil {
+		fmt.Printf("⚠️  Checkpoint at shutdown failed: %v\n", err)
 	}
-	_ = e.flushAll()
-	_ = e.walv2.Checkpoint()
+
+	e.forEachCollection(func(db *Database, c *Collection) {
+		c.mu.Lock()
+		if c.useSegments && c.segmentMgr != nil {
+			_ = c.segmentMgr.Close()
+		}
+		c.mu.Unlock()
+	})
 
 	fmt.Println("Shutdown complete")
-	return nil
+	return err
 }
 
 
 
-// StartAutoCompaction starts background compaction for all collections
-func (e *Engine) StartAutoCompaction(interval time.Duration) {
+// StartAutoCompaction starts background compaction for all collections,
+// driven by cfg.CompactionInterval and the compaction thresholds.
+// Segments are merged without holding the collection lock.
+func (e *Engine) StartAutoCompaction() {
+	if !e.cfg.EnableAutoCompaction || e.cfg.CompactionInterval <= 0 {
+		fmt.Println("⏸️  Auto-compaction disabled")
+		return
+	}
+	interval := time.Duration(e.cfg.CompactionInterval) * time.Second
+
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
@@ -623,13 +1019,17 @@ func (e *Engine) StartAutoCompaction(interval time.Duration) {
 				db.mu.RUnlock()
 
 				for _, c := range collections {
-					c.mu.Lock()
-					if c.useSegments && c.segmentMgr != nil {
-						if len(c.segmentMgr.segments) >= 3 {
-							_ = c.segmentMgr.Compact()
-						}
+					sm := c.segments()
+					if sm == nil {
+						continue
+					}
+					run, err := sm.MaybeCompact()
+					if err != nil {
+						fmt.Printf("❌ Auto-compaction of %s/%s failed: %v\n", db.Name, c.Name, err)
+					} else if run != nil {
+						fmt.Printf("✅ Compacted %s/%s (%s): %d segments, reclaimed %d bytes in %dms\n",
+							db.Name, c.Name, run.Reason, len(run.Segments), run.Reclaimed, run.DurationMs)
 					}
-					c.mu.Unlock()
 				}
 			}
 		}
@@ -650,13 +1050,67 @@ func (e *Engine) CompactCollection(dbName, collName string) error {
 		return err
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	if sm := c.segments(); sm != nil {
+		return sm.Compact()
+	}
 
-	if c.useSegments && c.segmentMgr != nil {
-		return c.segmentMgr.Compact()
+	return nil
+}
+
+// Scrub checks every segment of a collection and reports corrupt records
+// with their offsets.
+func (e *Engine) Scrub(dbName, collName string) (*ScrubReport, error) {
+	return e.scrub(dbName, collName, false)
+}
+
+// RepairCollection scrubs a collection and rewrites each damaged segment
+// with its readable records, moving the damaged file to quarantine/.
+// Records that could not be read are lost.
+func (e *Engine) RepairCollection(dbName, collName string) (*ScrubReport, error) {
+	return e.scrub(dbName, collName, true)
+}
+
+func (e *Engine) scrub(dbName, collName string, repair bool) (*ScrubReport, error) {
+	db, err := e.getOrCreateDB(dbName)
+	if err != nil {
+		return nil, err
+	}
+	c, err := db.getOrCreateCollection(e.cfg, collName)
+	if err != nil {
+		return nil, err
+	}
+
+	sm := c.segments()
+	if sm == nil {
+		return nil, fmt.Errorf("collection %s/%s is not stored in segments", db.Name, c.Name)
 	}
 
+	report, err := sm.Scrub(repair)
+	if report != nil {
+		report.Database, report.Collection = db.Name, c.Name
+	}
+	if err != nil {
+		return report, err
+	}
+
+	if repair && len(report.Quarantined) > 0 {
+		c.mu.Lock()
+		err = c.rebuildIndexesLocked()
+		c.mu.Unlock()
+	}
+	return report, err
+}
+
+// segments returns the collection's segment manager, or nil for legacy
+// collections. The manager does its own locking, so long operations such
+// as compaction don't need c.mu.
+func (c *Collection) segments() *SegmentManager {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.useSegments {
+		return c.segmentMgr
+	}
 	return nil
 }
 
@@ -13,19 +13,23 @@ func matchesFilter(doc types.Document, filter map[string]any) bool {
 		return true
 	}
 
-	// top-level logical
+	// top-level logical; the field conditions beside them must hold too
 	if orVal, ok := filter["$or"]; ok {
 		arr, ok := orVal.([]any)
 		if !ok || len(arr) == 0 {
 			return false
 		}
+		matched := false
 		for _, item := range arr {
 			m, ok := item.(map[string]any)
 			if ok && matchesFilter(doc, m) {
-				return true
+				matched = true
+				break
 			}
 		}
-		return false
+		if !matched {
+			return false
+		}
 	}
 
 	if andVal, ok := filter["$and"]; ok {
@@ -42,7 +46,6 @@ func matchesFilter(doc types.Document, filter map[string]any) bool {
 				return false
 			}
 		}
-		return true
 	}
 
 	// field conditions
@@ -84,6 +87,10 @@ func matchesFilter(doc types.Document, filter map[string]any) bool {
 					if !compareNumbers(got, opVal, "<=") {
 						return false
 					}
+				case "$eq":
+					if !exists || compareAny(got, opVal) != 0 {
+						return false
+					}
 				case "$ne":
 					if compareAny(got, opVal) == 0 {
 						return false
@@ -210,7 +217,7 @@ func matchElemMatch(got any, subFilter map[string]any) bool {
 }
 
 func applyUpdateOperators(doc types.Document, update map[string]any) error {
-	// Support: $set, $inc, $unset, $push, $pull, $rename
+	// Support: $set, $inc, $unset, $push, $pull, $rename, $setOnInsert
 	for op, payload := range update {
 		switch op {
 		case "$set":
@@ -305,6 +312,12 @@ func applyUpdateOperators(doc types.Document, update map[string]any) error {
 				}
 			}
 
+		case "$setOnInsert":
+			// Only an upsert that inserts applies it, see upsertDocument
+			if _, ok := payload.(map[string]any); !ok {
+				return errors.New("$setOnInsert must be object")
+			}
+
 		default:
 			return errors.New("unsupported update operator: " + op)
 		}
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// groupCommitter shares fsyncs between concurrent writers.
+//
+// Every write takes a ticket (a sequence number). Waiting on a ticket makes
+// the caller either the leader, which runs one fsync covering every write
+// issued so far, or a follower that sleeps until a leader's fsync covers it.
+//
+//	immediate - a waiter becomes leader as soon as no fsync is running
+//	batch     - the leader first waits up to delay for batchSize writes
+//	async     - tickets complete at once; a background loop fsyncs on a timer
+type groupCommitter struct {
+	mode      WALSyncMode
+	batchSize int
+	delay     time.Duration // batch mode: how long a leader waits for the batch to fill
+	interval  time.Duration // async mode: background fsync period
+	syncFn    func() error
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	written  uint64 // last ticket handed out
+	synced   uint64 // every ticket <= synced is durable
+	syncing  bool
+	errSeq   uint64 // tickets <= errSeq (and > synced) failed with err
+	err      error
+	full     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// commitTicket identifies one write. The zero ticket is always durable.
+type commitTicket struct {
+	gc  *groupCommitter
+	seq uint64
+}
+
+func newGroupCommitter(mode WALSyncMode, batchSize int, delay, interval time.Duration, syncFn func() error) *groupCommitter {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	gc := &groupCommitter{
+		mode:      mode,
+		batchSize: batchSize,
+		delay:     delay,
+		interval:  interval,
+		syncFn:    syncFn,
+		full:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	gc.cond = sync.NewCond(&gc.mu)
+
+	if mode == WALSyncAsync && interval > 0 {
+		go gc.asyncLoop()
+	}
+	return gc
+}
+
+// noteWrite hands out a ticket for a write that has just been issued.
+// Callers must invoke it while still holding the lock that orders their
+// writes, so ticket order matches file order.
+func (gc *groupCommitter) noteWrite() commitTicket {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	gc.written++
+	if gc.written-gc.synced >= uint64(gc.batchSize) {
+		select {
+		case gc.full <- struct{}{}:
+		default:
+		}
+	}
+	return commitTicket{gc: gc, seq: gc.written}
+}
+
+// markSynced records that everything written so far is durable, e.g. after
+// a segment was sealed (which fsyncs it) outside the committer.
+func (gc *groupCommitter) markSynced() {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.written > gc.synced {
+		gc.synced = gc.written
+		gc.cond.Broadcast()
+	}
+}
+
+// Wait blocks until the write is durable under the committer's mode.
+func (t commitTicket) Wait() error {
+	if t.gc == nil || t.seq == 0 {
+		return nil
+	}
+	return t.gc.wait(t.seq)
+}
+
+// Sync blocks until the write is on disk, whatever the committer's mode.
+func (t commitTicket) Sync() error {
+	if t.gc == nil || t.seq == 0 {
+		return nil
+	}
+	return t.gc.waitFor(t.seq, false)
+}
+
+func (gc *groupCommitter) wait(seq uint64) error {
+	if gc.mode == WALSyncAsync {
+		return nil
+	}
+	return gc.waitFor(seq, gc.mode == WALSyncBatch)
+}
+
+func (gc *groupCommitter) waitFor(seq uint64, gather bool) error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	for gc.synced < seq {
+		if gc.err != nil && seq <= gc.errSeq {
+			return gc.err
+		}
+		if gc.syncing {
+			gc.cond.Wait()
+			continue
+		}
+		gc.leadLocked(gather)
+	}
+	return nil
+}
+
+// leadLocked runs one fsync for every write issued so far. With gather set
+// it first waits up to gc.delay for a full batch to accumulate.
+// Called with gc.mu held; releases it while waiting and syncing.
+func (gc *groupCommitter) leadLocked(gather bool) {
+	gc.syncing = true
+
+	if gather && gc.delay > 0 && gc.written-gc.synced < uint64(gc.batchSize) {
+		gc.mu.Unlock()
+		timer := time.NewTimer(gc.delay)
+		select {
+		case <-gc.full:
+		case <-timer.C:
+		}
+		timer.Stop()
+		gc.mu.Lock()
+	}
+
+	target := gc.written
+	gc.mu.Unlock()
+	err := gc.syncFn()
+	gc.mu.Lock()
+
+	gc.syncing = false
+	if err != nil {
+		gc.err = err
+		gc.errSeq = target
+	} else if target > gc.synced {
+		gc.synced = target
+		gc.err = nil
+	}
+	gc.cond.Broadcast()
+}
+
+func (gc *groupCommitter) asyncLoop() {
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gc.stop:
+			return
+		case <-ticker.C:
+			gc.mu.Lock()
+			if gc.written > gc.synced && !gc.syncing {
+				gc.leadLocked(false)
+			}
+			gc.mu.Unlock()
+		}
+	}
+}
+
+// flush makes every write issued so far durable, regardless of mode.
+func (gc *groupCommitter) flush() error {
+	gc.mu.Lock()
+	seq := gc.written
+	gc.mu.Unlock()
+
+	return gc.waitFor(seq, false)
+}
+
+// pending returns how many writes are not known to be durable yet.
+func (gc *groupCommitter) pending() uint64 {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.written - gc.synced
+}
+
+func (gc *groupCommitter) close() {
+	gc.stopOnce.Do(func() { close(gc.stop) })
+}
+
+// writeTicket tracks the durability of one change: its WAL entry and the
+// records that store it.
+type writeTicket struct {
+	wal   commitTicket
+	store commitTicket
+}
+
+// Wait blocks until the change is as durable as wc asks.
+func (t writeTicket) Wait(wc WriteConcern) error {
+	switch wc {
+	case WriteConcernAck:
+		return nil
+	case WriteConcernFsync:
+		if err := t.wal.Sync(); err != nil {
+			return err
+		}
+		return t.store.Sync()
+	}
+	if err := t.wal.Wait(); err != nil {
+		return err
+	}
+	return t.store.Wait()
+}
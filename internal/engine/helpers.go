@@ -7,6 +7,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -22,17 +23,45 @@ func ensureDirs(cfg Config) error {
 			return err
 		}
 	}
-	if _, err := os.Stat(cfg.WALFile); os.IsNotExist(err) {
-		return os.WriteFile(cfg.WALFile, []byte(""), 0666)
-	}
 	return nil
 }
 
 func mkdirAll(p string) error { return os.MkdirAll(p, 0755) }
 
+// syncDir fsyncs dir, so that files renamed into it or removed from it stay
+// that way after a crash. Windows can't open a directory for syncing, and
+// makes renames durable without it.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func atomicWriteFile(path string, data []byte, perm os.FileMode) error {
 	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, perm); err != nil {
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// Flush before the rename so a crash can't leave an empty file in place
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
 		return err
 	}
 	return os.Rename(tmp, path)
@@ -162,6 +191,36 @@ func applyProjection(docs []types.Document, proj map[string]int) []types.Documen
 	return out
 }
 
+// cloneDocument deep-copies doc so it can be modified without affecting
+// readers that still hold the original.
+func cloneDocument(doc types.Document) types.Document {
+	if doc == nil {
+		return nil
+	}
+	return types.Document(cloneValue(map[string]any(doc)).(map[string]any))
+}
+
+func cloneValue(v any) any {
+	switch x := v.(type) {
+	case types.Document:
+		return cloneValue(map[string]any(x))
+	case map[string]any:
+		m := make(map[string]any, len(x))
+		for k, vv := range x {
+			m[k] = cloneValue(vv)
+		}
+		return m
+	case []any:
+		out := make([]any, len(x))
+		for i, it := range x {
+			out[i] = cloneValue(it)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
 func enforceDocSizeLimit(doc types.Document, max int) error {
 	b, _ := json.Marshal(doc)
 	if len(b) > max {
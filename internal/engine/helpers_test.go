@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"testDB/internal/types"
+)
+
+// testConfig returns the default config rooted in a directory of t's own,
+// emptied now and removed when t ends.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	dir := "./test_" + strings.ReplaceAll(t.Name(), "/", "_")
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return DefaultConfig().WithDataDir(dir)
+}
+
+// openTestEngine opens an engine on cfg and shuts it down when t ends.
+// Opening a second one on the same cfg without shutting the first down
+// restarts as after a crash.
+func openTestEngine(t *testing.T, cfg Config) *Engine {
+	t.Helper()
+	e, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Shutdown() })
+	return e
+}
+
+// insertAll inserts docs into db/coll.
+func insertAll(t *testing.T, e *Engine, coll string, docs ...types.Document) {
+	t.Helper()
+	for _, d := range docs {
+		if _, err := e.Insert("db", coll, d, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// queryAll returns the documents of db/coll matching filter.
+func queryAll(t *testing.T, e *Engine, coll string, filter map[string]any) []types.Document {
+	t.Helper()
+	docs, err := e.Query("db", coll, filter, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return docs
+}
@@ -174,6 +174,13 @@ func (e *Engine) CreateIndex(dbName, collName string, fields []string, indexType
 		m.Status = "ready"
 		m.UpdatedAt = time.Now().Unix()
 		c.IndexMetas[name] = m
+		// Writes only maintain indexes whose own copy says ready
+		if idx := c.IndexesHash[name]; idx != nil {
+			idx.Meta = m
+		}
+		if idx := c.IndexesBTree[name]; idx != nil {
+			idx.Meta = m
+		}
 		return c.saveIndexMetas(e.cfg)
 	}
 
@@ -286,3 +293,127 @@ func toKeyString(v any) string {
 		strings.TrimSpace(toString(v)),
 		"|", "_"), "\n", " "), "\r", " "))
 }
+
+// ---------- maintenance ----------
+
+// indexDocLocked adds doc to every ready hash/btree index.
+// Caller must hold c.mu for writing.
+func (c *Collection) indexDocLocked(doc types.Document) {
+	id, _ := doc["_id"].(string)
+	if id == "" {
+		return
+	}
+	for _, idx := range c.IndexesHash {
+		if idx.Meta.Status != "ready" {
+			continue
+		}
+		key := compoundKey(doc, idx.Meta.Fields)
+		idx.Entries[key] = append(idx.Entries[key], id)
+	}
+	for _, idx := range c.IndexesBTree {
+		if idx.Meta.Status != "ready" {
+			continue
+		}
+		k, ok := btreeDocKey(idx, doc)
+		if !ok {
+			continue
+		}
+		if _, exists := idx.Map[k]; !exists {
+			pos := sort.SearchFloat64s(idx.Keys, k)
+			idx.Keys = append(idx.Keys, 0)
+			copy(idx.Keys[pos+1:], idx.Keys[pos:])
+			idx.Keys[pos] = k
+		}
+		idx.Map[k] = append(idx.Map[k], id)
+	}
+}
+
+// unindexDocLocked removes doc from every hash/btree index.
+// Caller must hold c.mu for writing.
+func (c *Collection) unindexDocLocked(doc types.Document) {
+	id, _ := doc["_id"].(string)
+	if id == "" {
+		return
+	}
+	for _, idx := range c.IndexesHash {
+		key := compoundKey(doc, idx.Meta.Fields)
+		ids := removeID(idx.Entries[key], id)
+		if len(ids) == 0 {
+			delete(idx.Entries, key)
+		} else {
+			idx.Entries[key] = ids
+		}
+	}
+	for _, idx := range c.IndexesBTree {
+		k, ok := btreeDocKey(idx, doc)
+		if !ok {
+			continue
+		}
+		ids := removeID(idx.Map[k], id)
+		if len(ids) > 0 {
+			idx.Map[k] = ids
+			continue
+		}
+		delete(idx.Map, k)
+		pos := sort.SearchFloat64s(idx.Keys, k)
+		if pos < len(idx.Keys) && idx.Keys[pos] == k {
+			idx.Keys = append(idx.Keys[:pos], idx.Keys[pos+1:]...)
+		}
+	}
+}
+
+// rebuildIndexesLocked rebuilds every built hash/btree index from the
+// collection's current documents, e.g. after a repair dropped some.
+// Caller must hold c.mu for writing.
+func (c *Collection) rebuildIndexesLocked() error {
+	var snap []types.Document
+	if c.useSegments && c.segmentMgr != nil {
+		var err error
+		if snap, err = c.segmentMgr.ReadAll(); err != nil {
+			return err
+		}
+	} else {
+		snap = c.Docs
+	}
+
+	for name, idx := range c.IndexesHash {
+		rebuilt, err := buildHashIndex(idx.Meta, snap)
+		if err != nil {
+			return err
+		}
+		c.IndexesHash[name] = rebuilt
+	}
+	for name, idx := range c.IndexesBTree {
+		rebuilt, err := buildBTreeIndex(idx.Meta, snap)
+		if err != nil {
+			return err
+		}
+		c.IndexesBTree[name] = rebuilt
+	}
+	return nil
+}
+
+// btreeDocKey extracts the btree key for doc, mirroring buildBTreeIndex.
+func btreeDocKey(idx *BTreeIndex, doc types.Document) (float64, bool) {
+	v, ok := getNestedField(doc, idx.Meta.Fields[0])
+	if !ok || v == nil {
+		return 0, false
+	}
+	if idx.Kind == "number" {
+		return toNumber(v)
+	}
+	t, ok := toTime(v)
+	if !ok {
+		return 0, false
+	}
+	return float64(t.UnixNano()), true
+}
+
+func removeID(ids []string, id string) []string {
+	for i, x := range ids {
+		if x == id {
+			return append(ids[:i:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
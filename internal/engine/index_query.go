@@ -12,17 +12,13 @@ func (c *Collection) findByID(id string) (types.Document, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	// Support segments
+	// Support segments: primary-key lookup reads a single record
 	if c.useSegments && c.segmentMgr != nil {
-		docs, err := c.segmentMgr.ReadAll()
-		if err == nil {
-			for _, d := range docs {
-				if s, ok := d["_id"].(string); ok && s == id {
-					return d, true
-				}
-			}
+		d, ok, err := c.segmentMgr.Get(id)
+		if err != nil || !ok {
+			return nil, false
 		}
-		return nil, false
+		return d, true
 	}
 
 	for _, d := range c.Docs {
@@ -33,65 +29,18 @@ func (c *Collection) findByID(id string) (types.Document, bool) {
 	return nil, false
 }
 
-// candidateIDsByIndex returns candidate doc IDs using an index, if one applies.
+// candidateIDsByIndex returns the ids of the documents that may match
+// filter, found with the plan the planner picks; false means that plan is
+// a collection scan.
 // IMPORTANT: caller must already hold c.mu (read or write) — this function
 // does NOT acquire c.mu to avoid a double-lock deadlock.
-// (Query holds c.mu.RLock before calling this.)
 func (c *Collection) candidateIDsByIndex(filter map[string]any) ([]string, bool) {
-	// ── NO c.mu.RLock here ── caller already holds it
-
-	// --- 1) Range (btree) ---
-	for field, want := range filter {
-		opMap, ok := want.(map[string]any)
-		if !ok {
-			continue
-		}
-		if hasRangeOp(opMap) {
-			name := indexName("btree", []string{field})
-			idx, ok := c.IndexesBTree[name]
-			if !ok || idx.Meta.Status != "ready" {
-				continue
-			}
-			ids := btreeRangeLookup(idx, opMap)
-			return ids, true
-		}
-	}
-
-	// --- 2) Hash (multi-field equality) ---
-	bestName := ""
-	bestFields := 0
-	for name, meta := range c.IndexMetas {
-		if meta.Type != "hash" || meta.Status != "ready" {
-			continue
-		}
-		ok := true
-		for _, f := range meta.Fields {
-			if _, exists := filter[f]; !exists {
-				ok = false
-				break
-			}
-			if _, isOp := filter[f].(map[string]any); isOp {
-				ok = false
-				break
-			}
-		}
-		if ok && len(meta.Fields) > bestFields {
-			bestFields = len(meta.Fields)
-			bestName = name
-		}
-	}
-
-	if bestName != "" {
-		idx := c.IndexesHash[bestName]
-		if idx == nil {
-			return nil, false
-		}
-		key := compoundKey(types.Document(filter), c.IndexMetas[bestName].Fields)
-		ids := idx.Entries[key]
-		return ids, true
+	plan, _ := c.planLocked(filter)
+	if plan.run == nil {
+		return nil, false
 	}
-
-	return nil, false
+	ids, _ := plan.run()
+	return ids, true
 }
 
 func hasRangeOp(m map[string]any) bool {
@@ -104,30 +53,31 @@ func hasRangeOp(m map[string]any) bool {
 	return false
 }
 
-func btreeRangeLookup(idx *BTreeIndex, opMap map[string]any) []string {
+// btreeBounds returns the span of idx.Keys within the range ops bound,
+// or false if a bound isn't of the index's kind.
+func btreeBounds(idx *BTreeIndex, ops map[string]any) (int, int, bool) {
 	loSet, hiSet := false, false
 	var lo, hi float64
 	loInc, hiInc := false, false
 
-	if v, ok := opMap["$gt"]; ok {
-		loSet = true
-		loInc = false
-		lo = btreeKey(idx, v)
-	}
-	if v, ok := opMap["$gte"]; ok {
-		loSet = true
-		loInc = true
-		lo = btreeKey(idx, v)
-	}
-	if v, ok := opMap["$lt"]; ok {
-		hiSet = true
-		hiInc = false
-		hi = btreeKey(idx, v)
-	}
-	if v, ok := opMap["$lte"]; ok {
-		hiSet = true
-		hiInc = true
-		hi = btreeKey(idx, v)
+	for _, b := range []struct {
+		op        string
+		lower     bool
+		inclusive bool
+	}{{"$gt", true, false}, {"$gte", true, true}, {"$lt", false, false}, {"$lte", false, true}} {
+		v, ok := ops[b.op]
+		if !ok {
+			continue
+		}
+		k, ok := btreeKey(idx, v)
+		if !ok {
+			return 0, 0, false
+		}
+		if b.lower {
+			loSet, lo, loInc = true, k, b.inclusive
+		} else {
+			hiSet, hi, hiInc = true, k, b.inclusive
+		}
 	}
 
 	keys := idx.Keys
@@ -149,35 +99,19 @@ func btreeRangeLookup(idx *BTreeIndex, opMap map[string]any) []string {
 			return keys[i] >= hi
 		})
 	}
-
-	if start < 0 {
-		start = 0
-	}
-	if end > len(keys) {
-		end = len(keys)
+	if start > end {
+		start = end
 	}
-	if start >= end {
-		return []string{}
-	}
-
-	out := []string{}
-	for _, k := range keys[start:end] {
-		out = append(out, idx.Map[k]...)
-	}
-	return out
+	return start, end, true
 }
 
-func btreeKey(idx *BTreeIndex, v any) float64 {
+func btreeKey(idx *BTreeIndex, v any) (float64, bool) {
 	if idx.Kind == "number" {
-		n, ok := toNumber(v)
-		if ok {
-			return n
-		}
-		return 0
+		return toNumber(v)
 	}
 	t, ok := toTime(v)
-	if ok {
-		return float64(t.UnixNano())
+	if !ok {
+		return 0, false
 	}
-	return 0
+	return float64(t.UnixNano()), true
 }
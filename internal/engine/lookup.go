@@ -0,0 +1,352 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"testDB/internal/types"
+)
+
+// lookupSpec is a parsed $lookup stage.
+type lookupSpec struct {
+	from         string
+	localField   string
+	foreignField string
+	as           string
+	let          map[string]any
+	pipeline     []map[string]any // nil when the stage has none
+}
+
+// lookupStage joins each doc with documents of another collection of the
+// same database, adding them as an array at as. It takes these forms:
+//
+//	{from, localField, foreignField, as}
+//	{from, localField, foreignField, pipeline, as}
+//	{from, let, pipeline, as}
+//	{from, pipeline, as}
+//
+// With localField and foreignField, a doc is joined with the documents of
+// from whose foreignField equals its localField, or one of its elements if
+// that is an array; missing fields count as null. They are looked up in an
+// index on foreignField when the planner finds one worth using: the
+// primary key for _id, a hash index on foreignField alone, or a btree
+// index on it. A pipeline is then
+// run over each doc's matches. Without them, the pipeline runs over all of
+// from. In the pipeline, "$$name" stands for let's name, evaluated against
+// the doc being joined.
+//
+// Only one collection lock is ever held: the stages run after the local
+// collection's lock is released, and the foreign collection's is taken just
+// long enough to look up candidates and snapshot them, as for Query. So
+// joins can't deadlock, whatever order collections are joined in, a
+// collection joined with itself included.
+func (e *Engine) lookupStage(db *Database, docs []types.Document, spec any) ([]types.Document, error) {
+	ls, err := parseLookup(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: $lookup: %v", ErrInvalidPipeline, err)
+	}
+	fc, err := db.getOrCreateCollection(e.cfg, ls.from)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches [][]types.Document
+	switch {
+	case ls.localField != "":
+		if matches, err = e.lookupEqual(fc, docs, ls); err != nil {
+			return nil, err
+		}
+	case ls.let == nil:
+		// Uncorrelated: every doc gets the same output
+		joined, err := e.aggregate(db, fc, ls.pipeline)
+		if err != nil {
+			return nil, err
+		}
+		matches = make([][]types.Document, len(docs))
+		for i := range docs {
+			matches[i] = joined
+		}
+	}
+
+	out := make([]types.Document, len(docs))
+	for i, d := range docs {
+		var joined []types.Document
+		if ls.pipeline != nil && (ls.localField != "" || ls.let != nil) {
+			pipeline, err := ls.bind(d)
+			if err != nil {
+				return nil, fmt.Errorf("%w: $lookup: %v", ErrInvalidPipeline, err)
+			}
+			if ls.localField != "" {
+				joined, err = e.runStages(db, matches[i], pipeline)
+			} else {
+				joined, err = e.aggregate(db, fc, pipeline)
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			joined = matches[i]
+		}
+
+		arr := make([]any, len(joined))
+		for k, j := range joined {
+			arr[k] = map[string]any(j)
+		}
+		nd := cloneDocument(d)
+		setNestedField(nd, ls.as, arr)
+		out[i] = nd
+	}
+	return out, nil
+}
+
+func parseLookup(spec any) (*lookupSpec, error) {
+	m, ok := spec.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("must be an object")
+	}
+	ls := &lookupSpec{}
+	for _, f := range []struct {
+		name string
+		dst  *string
+	}{{"from", &ls.from}, {"localField", &ls.localField}, {"foreignField", &ls.foreignField}, {"as", &ls.as}} {
+		if v, ok := m[f.name]; ok {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("%s must be a non-empty string", f.name)
+			}
+			*f.dst = s
+		}
+	}
+	if ls.from == "" || ls.as == "" {
+		return nil, fmt.Errorf("from and as are required")
+	}
+	if (ls.localField == "") != (ls.foreignField == "") {
+		return nil, fmt.Errorf("localField and foreignField go together")
+	}
+
+	if v, ok := m["pipeline"]; ok {
+		pipeline, err := parsePipeline(v)
+		if err != nil {
+			return nil, err
+		}
+		ls.pipeline = pipeline
+	} else if ls.localField == "" {
+		return nil, fmt.Errorf("localField and foreignField, or pipeline, are required")
+	}
+	if v, ok := m["let"]; ok {
+		let, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("let must be an object")
+		}
+		if ls.pipeline == nil {
+			return nil, fmt.Errorf("let requires pipeline")
+		}
+		for name := range let {
+			if name == "" || strings.ContainsAny(name, "$.") {
+				return nil, fmt.Errorf("invalid variable name %q", name)
+			}
+		}
+		ls.let = let
+	}
+	return ls, nil
+}
+
+// parsePipeline reads a pipeline nested in a stage, as decoded from JSON.
+func parsePipeline(v any) ([]map[string]any, error) {
+	var pipeline []map[string]any
+	switch x := v.(type) {
+	case []map[string]any:
+		pipeline = x
+	case []any:
+		for _, item := range x {
+			stage, _ := item.(map[string]any)
+			pipeline = append(pipeline, stage)
+		}
+	default:
+		return nil, fmt.Errorf("pipeline must be an array")
+	}
+	for i, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("pipeline stage %d must be an object with one key", i)
+		}
+	}
+	return pipeline, nil
+}
+
+// bind returns the pipeline with each "$$name" replaced by let's name, as
+// it evaluates against doc.
+func (ls *lookupSpec) bind(doc types.Document) ([]map[string]any, error) {
+	if ls.let == nil {
+		return ls.pipeline, nil
+	}
+	vars := make(map[string]any, len(ls.let))
+	for name, expr := range ls.let {
+		vars[name] = evalExpr(doc, expr)
+	}
+
+	pipeline := make([]map[string]any, len(ls.pipeline))
+	for i, stage := range ls.pipeline {
+		v, err := bindVars(stage, vars)
+		if err != nil {
+			return nil, err
+		}
+		pipeline[i] = v.(map[string]any)
+	}
+	return pipeline, nil
+}
+
+// bindVars copies v, replacing "$$name" and "$$name.path" strings with
+// the values vars gives them.
+func bindVars(v any, vars map[string]any) (any, error) {
+	switch x := v.(type) {
+	case string:
+		if !strings.HasPrefix(x, "$$") {
+			return x, nil
+		}
+		name, path, _ := strings.Cut(x[2:], ".")
+		val, ok := vars[name]
+		if !ok {
+			return nil, fmt.Errorf("undefined variable %s", x)
+		}
+		if path == "" {
+			return val, nil
+		}
+		m, _ := val.(map[string]any)
+		got, _ := getNestedField(m, path)
+		return got, nil
+	case map[string]any:
+		m := make(map[string]any, len(x))
+		for k, vv := range x {
+			b, err := bindVars(vv, vars)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = b
+		}
+		return m, nil
+	case []any:
+		out := make([]any, len(x))
+		for i, vv := range x {
+			b, err := bindVars(vv, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = b
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// lookupEqual returns, for each doc, the documents of fc whose
+// foreignField equals its localField.
+func (e *Engine) lookupEqual(fc *Collection, docs []types.Document, ls *lookupSpec) ([][]types.Document, error) {
+	local := make([][]string, len(docs))
+	keys := map[string]any{}
+	for i, d := range docs {
+		v, ok := getNestedField(d, ls.localField)
+		for _, val := range joinValues(v, ok) {
+			k, err := joinKey(val)
+			if err != nil {
+				continue // can't equal anything stored
+			}
+			local[i] = append(local[i], k)
+			keys[k] = val
+		}
+	}
+	if len(keys) == 0 {
+		return make([][]types.Document, len(docs)), nil
+	}
+
+	fc.mu.RLock()
+	view, err := fc.lookupViewLocked(ls.foreignField, keys)
+	fc.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer view.release()
+	foreign, err := view.candidates(map[string]any{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Bucket the foreign documents by each value of foreignField
+	buckets := map[string][]int{}
+	for n, fd := range foreign {
+		v, ok := getNestedField(fd, ls.foreignField)
+		for _, val := range joinValues(v, ok) {
+			if k, err := joinKey(val); err == nil {
+				buckets[k] = append(buckets[k], n)
+			}
+		}
+	}
+
+	matches := make([][]types.Document, len(docs))
+	for i, ks := range local {
+		var hits []int
+		seen := map[int]bool{}
+		for _, k := range ks {
+			for _, n := range buckets[k] {
+				if !seen[n] {
+					seen[n] = true
+					hits = append(hits, n)
+				}
+			}
+		}
+		sort.Ints(hits)
+		for _, n := range hits {
+			matches[i] = append(matches[i], foreign[n])
+		}
+	}
+	return matches, nil
+}
+
+// lookupViewLocked captures the documents whose field may equal one of
+// the values in keys: those an index on field lists, or every document if
+// some value can't be looked up in one. Indexed documents come in _id
+// order, so a join comes out the same every time. Caller must hold c.mu and
+// release the view once read.
+func (c *Collection) lookupViewLocked(field string, keys map[string]any) (*readView, error) {
+	var ids []string
+	for _, v := range keys {
+		found, ok := c.idsByValueLocked(field, v)
+		if !ok {
+			return c.readViewLocked(map[string]any{})
+		}
+		ids = append(ids, found...)
+	}
+	sort.Strings(ids)
+	return c.idsViewLocked(ids)
+}
+
+// idsByValueLocked returns the ids of the documents whose field may
+// equal v, if the planner finds them with an index. Caller must hold c.mu.
+func (c *Collection) idsByValueLocked(field string, v any) ([]string, bool) {
+	switch v.(type) {
+	case map[string]any, []any:
+		// Indexes don't compare whole objects
+		return nil, false
+	}
+	return c.candidateIDsByIndex(map[string]any{field: v})
+}
+
+// joinValues returns the values a join field matches on: each element of
+// an array, and null for a missing field.
+func joinValues(v any, ok bool) []any {
+	if !ok {
+		return []any{nil}
+	}
+	if arr, isArr := v.([]any); isArr {
+		return arr
+	}
+	return []any{v}
+}
+
+// joinKey identifies a join value. Numbers that are equal get the same
+// key whatever their type.
+func joinKey(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
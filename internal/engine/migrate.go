@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"testDB/internal/types"
+)
+
+const (
+	// MigrationStagingDir holds the segments of a migration in progress,
+	// inside the collection directory. A leftover one is removed on startup.
+	MigrationStagingDir = "migrating"
+
+	// MigratedSuffix is appended to data.db once its documents live in
+	// segments.
+	MigratedSuffix = ".migrated"
+)
+
+// MigrationReport describes one data.db to segments conversion.
+type MigrationReport struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Documents  int    `json:"documents"`
+	Segments   int    `json:"segments"`
+	LegacyFile string `json:"legacy_file"` // where data.db was moved
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// MigrateToSegments converts a legacy collection, stored as a single JSON
+// data.db, into segments. The documents are written to a staging directory
+// first and their count is checked before and after the segments are moved
+// into place; only then is data.db renamed to data.db.migrated and the
+// collection switched over. Until the segments are moved into place data.db
+// is authoritative; from then on startup prefers the segments even while
+// data.db is still there (see loadSnapshots), which is safe because they
+// already hold every document. A crash at any point leaves the collection
+// readable.
+//
+// The collection lock is held throughout: requests for this collection
+// wait for the migration, every other collection is unaffected.
+func (e *Engine) MigrateToSegments(dbName, collName string) (*MigrationReport, error) {
+	db, err := e.getOrCreateDB(dbName)
+	if err != nil {
+		return nil, err
+	}
+	c, err := db.getOrCreateCollection(e.cfg, collName)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.useSegments && c.segmentMgr != nil {
+		return nil, fmt.Errorf("collection %s/%s is already stored in segments", db.Name, c.Name)
+	}
+	return e.migrateLocked(db, c)
+}
+
+// migrateLocked does the work of MigrateToSegments. Caller must hold c.mu.
+func (e *Engine) migrateLocked(db *Database, c *Collection) (*MigrationReport, error) {
+	start := time.Now()
+	collDir := collectionDir(e.cfg, db.Name, c.Name)
+	opts := e.cfg.segmentOptions(db.Name, c.Name)
+
+	docs := dedupeByID(c.Docs)
+	for _, d := range docs {
+		if _, ok := d["_id"]; !ok {
+			return nil, errors.New("migrate: document without _id")
+		}
+	}
+
+	// 1. Write every document into a staging segment set
+	staging := filepath.Join(collDir, MigrationStagingDir)
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	staged, err := NewSegmentManagerWithOptions(staging, opts)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	abort := func(err error) (*MigrationReport, error) {
+		os.RemoveAll(staging)
+		return nil, fmt.Errorf("migrate %s/%s: %w", db.Name, c.Name, err)
+	}
+	// data.db holds every change logged for the collection so far, and
+	// new ones wait for c.mu: stamp the documents with the current LSN so
+	// replay doesn't apply those changes a second time
+	lsn := e.walv2.LastSequence()
+	for _, d := range docs {
+		// Durability comes from the Sync below, not per document
+		if _, err := staged.appendDoc(fmt.Sprintf("%v", d["_id"]), d, lsn); err != nil {
+			staged.Close()
+			return abort(err)
+		}
+	}
+	if err := staged.Sync(); err != nil {
+		staged.Close()
+		return abort(err)
+	}
+	got := staged.Count()
+	if err := staged.Close(); err != nil {
+		return abort(err)
+	}
+	if got != len(docs) {
+		return abort(fmt.Errorf("staged %d documents, expected %d", got, len(docs)))
+	}
+
+	// 2. Move the segments into place. Whatever a failed segment manager
+	// left behind is kept in quarantine/ rather than deleted.
+	segDir := filepath.Join(collDir, "segments")
+	if _, err := os.Stat(segDir); err == nil {
+		qdir := filepath.Join(collDir, QuarantineDir)
+		if err := os.MkdirAll(qdir, 0755); err != nil {
+			return abort(err)
+		}
+		if err := os.Rename(segDir, filepath.Join(qdir, "segments."+time.Now().Format("20060102T150405.000"))); err != nil {
+			return abort(err)
+		}
+	}
+	if err := os.Rename(filepath.Join(staging, "segments"), segDir); err != nil {
+		return abort(err)
+	}
+	os.RemoveAll(staging)
+	unplace := func(err error) (*MigrationReport, error) {
+		os.RemoveAll(segDir)
+		return nil, fmt.Errorf("migrate %s/%s: %w", db.Name, c.Name, err)
+	}
+	if err := syncDir(collDir); err != nil {
+		return unplace(err)
+	}
+
+	// 3. Reopen in place and count again
+	sm, err := NewSegmentManagerWithOptions(collDir, opts)
+	if err != nil {
+		return unplace(err)
+	}
+	if got := sm.Count(); got != len(docs) {
+		sm.Close()
+		return unplace(fmt.Errorf("reopened segments hold %d documents, expected %d", got, len(docs)))
+	}
+	segments := len(sm.segments)
+
+	// 4. Retire data.db; from here on the segments are authoritative
+	legacy := c.DataFile + MigratedSuffix
+	if err := os.Rename(c.DataFile, legacy); err != nil && !errors.Is(err, os.ErrNotExist) {
+		sm.Close()
+		return unplace(err)
+	}
+
+	c.segmentMgr = sm
+	c.useSegments = true
+	c.Docs = []types.Document{}
+	if err := c.rebuildIndexesLocked(); err != nil {
+		return nil, err
+	}
+	// The segments win on startup under either name of data.db, so the
+	// migration is done; this only keeps data.db from coming back
+	if err := syncDir(collDir); err != nil {
+		return nil, fmt.Errorf("migrate %s/%s: %w", db.Name, c.Name, err)
+	}
+
+	return &MigrationReport{
+		Database:   db.Name,
+		Collection: c.Name,
+		Documents:  len(docs),
+		Segments:   segments,
+		LegacyFile: legacy,
+		DurationMs: time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// migrateLegacyCollections migrates every collection still stored in
+// data.db. Failures are reported and leave the collection on the legacy
+// path.
+func (e *Engine) migrateLegacyCollections() {
+	e.forEachCollection(func(db *Database, c *Collection) {
+		c.mu.Lock()
+		if c.useSegments && c.segmentMgr != nil {
+			c.mu.Unlock()
+			return
+		}
+		report, err := e.migrateLocked(db, c)
+		c.mu.Unlock()
+
+		if err != nil {
+			fmt.Printf("❌ Migration of %s/%s failed, staying on data.db: %v\n", db.Name, c.Name, err)
+			return
+		}
+		fmt.Printf("✅ Migrated %s/%s to segments: %d documents in %dms\n",
+			db.Name, c.Name, report.Documents, report.DurationMs)
+	})
+}
+
+// hasSegmentFiles reports whether a collection directory holds any segment.
+func hasSegmentFiles(collDir string) bool {
+	ids, err := listSegmentFiles(filepath.Join(collDir, "segments"))
+	return err == nil && len(ids) > 0
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"testDB/internal/types"
+)
+
+func TestMigrateToSegments(t *testing.T) {
+	dir := "./test_migrate"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.DataDir = dir
+	cfg.DBsDir = filepath.Join(dir, "databases")
+	cfg.WALDir = filepath.Join(dir, "wal")
+	cfg.WALFile = filepath.Join(dir, "wal", "wal.log")
+	cfg.WALArchiveDir = filepath.Join(dir, "wal", "archive")
+	cfg.EnableWALArchive = false
+
+	// A collection from before segments existed: data.db only
+	collDir := collectionDir(cfg, "shop", "items")
+	if err := os.MkdirAll(collDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := `[{"_id":"a","n":1},{"_id":"b","n":2},{"_id":"a","n":3},{"_id":"c","n":4}]`
+	if err := os.WriteFile(filepath.Join(collDir, "data.db"), []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := e.Query("shop", "items", nil, nil, 0, 0, nil)
+	if err != nil || len(docs) != 3 {
+		t.Fatalf("Expected the 3 legacy docs before migrating, got %d (%v)", len(docs), err)
+	}
+
+	report, err := e.MigrateToSegments("shop", "items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Documents != 3 {
+		t.Fatalf("Expected 3 migrated docs, got %d", report.Documents)
+	}
+	if _, err := os.Stat(filepath.Join(collDir, "data.db")); !os.IsNotExist(err) {
+		t.Fatalf("data.db should have been renamed, stat err=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(collDir, "data.db"+MigratedSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.MigrateToSegments("shop", "items"); err == nil {
+		t.Fatal("Expected a second migration to be refused")
+	}
+
+	// The collection keeps working, now on segments
+	if _, err := e.Insert("shop", "items", types.Document{"_id": "d", "n": 5}, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := e.Update("shop", "items", map[string]any{"_id": "a"}, map[string]any{"$set": map[string]any{"n": 6}}, false, true); err != nil || n != 1 {
+		t.Fatalf("Update after migration: %d, %v", n, err)
+	}
+	e.Shutdown()
+
+	e, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Shutdown()
+	docs, err = e.Query("shop", "items", map[string]any{"_id": "a"}, nil, 0, 0, nil)
+	if err != nil || len(docs) != 1 || fmt.Sprint(docs[0]["n"]) != "6" {
+		t.Fatalf("Expected a with n=6 after restart, got %v (%v)", docs, err)
+	}
+	if stats := e.Stats("shop"); stats["documents"] != 4 {
+		t.Fatalf("Expected 4 docs after restart, got %v", stats["documents"])
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package engine
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("mmap not supported on this platform")
+
+// Segments are read with positional reads on this platform.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package engine
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errMmapUnsupported = errors.New("mmap not supported on this platform")
+
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, errors.New("segment too large to map")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
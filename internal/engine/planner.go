@@ -0,0 +1,300 @@
+package engine
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// The planner decides how a query finds the documents that may match its
+// filter. Each way of using the collection's indexes becomes a plan, costed
+// in document reads, and the cheapest wins:
+//
+//	ID_LOOKUP  _id equals a string: read that one document
+//	IXSCAN     equality on every field of a hash index, or equality or a
+//	           range on the field of a btree index
+//	INTERSECT  the documents two or more IXSCANs all list
+//	OR         a $or each branch of which has an index plan: their union
+//	COLLSCAN   read every document
+//
+// A hash IXSCAN knows exactly how many entries its key has. A btree
+// IXSCAN estimates from the index's cardinality: the share of its distinct
+// keys in range, times the size of the collection. An INTERSECT assumes
+// its inputs are independent. Every plan reads a superset of the matches;
+// the filter is applied to what it reads.
+
+// indexKeyCost is what examining one index entry costs, in document reads.
+const indexKeyCost = 0.25
+
+// maxIntersect caps how many IXSCANs an INTERSECT combines.
+const maxIntersect = 3
+
+// QueryPlan is one way of finding the documents that may match a filter.
+type QueryPlan struct {
+	Stage         string       `json:"stage"`
+	Index         string       `json:"index,omitempty"`
+	Cardinality   int          `json:"cardinality,omitempty"` // distinct keys in Index
+	EstimatedKeys int          `json:"estimatedKeys"`
+	EstimatedDocs int          `json:"estimatedDocs"`
+	Cost          float64      `json:"cost"`
+	Inputs        []*QueryPlan `json:"inputs,omitempty"`
+
+	// run returns the ids the plan finds and how many index entries it
+	// examined. It is nil for COLLSCAN, and must be called under the
+	// same hold of c.mu as planned it.
+	run func() ([]string, int)
+}
+
+// QueryExplain reports how a query ran: the plan it used and those it
+// rejected, cheapest first, and what running it took.
+type QueryExplain struct {
+	Plan          *QueryPlan   `json:"plan"`
+	RejectedPlans []*QueryPlan `json:"rejectedPlans"`
+	KeysExamined  int          `json:"keysExamined"`
+	DocsExamined  int          `json:"docsExamined"`
+	Returned      int          `json:"returned"`
+	ElapsedMicros int64        `json:"elapsedMicros"`
+}
+
+// planLocked returns the cheapest plan for filter, and the others it
+// considered, cheapest first. Caller must hold c.mu.
+func (c *Collection) planLocked(filter map[string]any) (*QueryPlan, []*QueryPlan) {
+	return c.plansLocked(filter, c.countLocked())
+}
+
+func (c *Collection) plansLocked(filter map[string]any, n int) (*QueryPlan, []*QueryPlan) {
+	plans := c.indexPlansLocked(filter, n)
+	if or := c.orPlanLocked(filter, n); or != nil {
+		plans = append(plans, or)
+	}
+	plans = append(plans, &QueryPlan{Stage: "COLLSCAN", EstimatedDocs: n, Cost: float64(n)})
+
+	// On a tie an index plan beats the scan
+	sort.SliceStable(plans, func(i, j int) bool { return plans[i].Cost < plans[j].Cost })
+	return plans[0], plans[1:]
+}
+
+// countLocked returns how many live documents the collection holds.
+// Caller must hold c.mu.
+func (c *Collection) countLocked() int {
+	if c.useSegments && c.segmentMgr != nil {
+		return c.segmentMgr.Count()
+	}
+	return len(c.Docs)
+}
+
+// indexPlansLocked returns the ID_LOOKUP, IXSCAN and INTERSECT plans for
+// the field conditions of filter and of its $and items. Caller must hold
+// c.mu.
+func (c *Collection) indexPlansLocked(filter map[string]any, n int) []*QueryPlan {
+	conds := []map[string]any{filter}
+	if items, ok := filter["$and"].([]any); ok {
+		for _, item := range items {
+			if m, ok := item.(map[string]any); ok {
+				conds = append(conds, m)
+			}
+		}
+	}
+
+	var plans, scans []*QueryPlan
+	for _, m := range conds {
+		if v, ok := equalityValue(m, "_id"); ok {
+			if id, ok := v.(string); ok {
+				plans = append(plans, costed(&QueryPlan{
+					Stage:         "ID_LOOKUP",
+					EstimatedKeys: 1,
+					EstimatedDocs: 1,
+					run:           func() ([]string, int) { return []string{id}, 1 },
+				}))
+			}
+		}
+		for _, name := range mapKeysSorted(c.IndexesHash) {
+			if p := c.hashPlanLocked(name, m); p != nil {
+				scans = append(scans, p)
+			}
+		}
+		for _, name := range mapKeysSorted(c.IndexesBTree) {
+			if p := c.btreePlanLocked(name, m, n); p != nil {
+				scans = append(scans, p)
+			}
+		}
+	}
+	plans = append(plans, scans...)
+
+	sort.SliceStable(scans, func(i, j int) bool { return scans[i].Cost < scans[j].Cost })
+	for k := 2; k <= len(scans) && k <= maxIntersect; k++ {
+		plans = append(plans, intersectPlan(scans[:k], n))
+	}
+	return plans
+}
+
+// hashPlanLocked returns an IXSCAN of the hash index name, if m pins each
+// of its fields to a value. Caller must hold c.mu.
+func (c *Collection) hashPlanLocked(name string, m map[string]any) *QueryPlan {
+	idx := c.IndexesHash[name]
+	if idx == nil || c.IndexMetas[name].Status != "ready" {
+		return nil
+	}
+	parts := make([]string, 0, len(idx.Meta.Fields))
+	for _, f := range idx.Meta.Fields {
+		v, ok := equalityValue(m, f)
+		if !ok {
+			return nil
+		}
+		parts = append(parts, toKeyString(v))
+	}
+
+	ids := idx.Entries[strings.Join(parts, "|")]
+	return costed(&QueryPlan{
+		Stage:         "IXSCAN",
+		Index:         name,
+		Cardinality:   len(idx.Entries),
+		EstimatedKeys: len(ids),
+		EstimatedDocs: len(ids),
+		run:           func() ([]string, int) { return ids, len(ids) },
+	})
+}
+
+// btreePlanLocked returns an IXSCAN of the btree index name, if m bounds
+// its field. Caller must hold c.mu.
+func (c *Collection) btreePlanLocked(name string, m map[string]any, n int) *QueryPlan {
+	idx := c.IndexesBTree[name]
+	if idx == nil || c.IndexMetas[name].Status != "ready" {
+		return nil
+	}
+	field := idx.Meta.Fields[0]
+
+	var bounds map[string]any
+	if ops, ok := m[field].(map[string]any); ok && hasRangeOp(ops) {
+		bounds = ops
+	} else if v, ok := equalityValue(m, field); ok {
+		bounds = map[string]any{"$gte": v, "$lte": v}
+	} else {
+		return nil
+	}
+	start, end, ok := btreeBounds(idx, bounds)
+	if !ok {
+		return nil
+	}
+
+	est := 0
+	if len(idx.Keys) > 0 {
+		est = int(math.Ceil(float64(end-start) * float64(n) / float64(len(idx.Keys))))
+	}
+	return costed(&QueryPlan{
+		Stage:         "IXSCAN",
+		Index:         name,
+		Cardinality:   len(idx.Keys),
+		EstimatedKeys: est,
+		EstimatedDocs: est,
+		run: func() ([]string, int) {
+			var ids []string
+			for _, k := range idx.Keys[start:end] {
+				ids = append(ids, idx.Map[k]...)
+			}
+			return ids, len(ids)
+		},
+	})
+}
+
+// intersectPlan returns an INTERSECT of inputs.
+func intersectPlan(inputs []*QueryPlan, n int) *QueryPlan {
+	p := &QueryPlan{Stage: "INTERSECT", Inputs: append([]*QueryPlan(nil), inputs...)}
+	share := 1.0
+	for _, in := range inputs {
+		p.EstimatedKeys += in.EstimatedKeys
+		if n > 0 {
+			share *= float64(in.EstimatedDocs) / float64(n)
+		}
+	}
+	p.EstimatedDocs = int(math.Ceil(share * float64(n)))
+
+	p.run = func() ([]string, int) {
+		ids, keys := p.Inputs[0].run()
+		for _, in := range p.Inputs[1:] {
+			got, k := in.run()
+			keys += k
+			listed := make(map[string]bool, len(got))
+			for _, id := range got {
+				listed[id] = true
+			}
+			var kept []string
+			for _, id := range ids {
+				if listed[id] {
+					kept = append(kept, id)
+				}
+			}
+			ids = kept
+		}
+		return ids, keys
+	}
+	return costed(p)
+}
+
+// orPlanLocked returns an OR of the best plan for each branch of filter's
+// $or, unless one of them is a collection scan. Caller must hold c.mu.
+func (c *Collection) orPlanLocked(filter map[string]any, n int) *QueryPlan {
+	items, ok := filter["$or"].([]any)
+	if !ok || len(items) == 0 {
+		return nil
+	}
+
+	p := &QueryPlan{Stage: "OR"}
+	for _, item := range items {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue // matches nothing
+		}
+		best, _ := c.plansLocked(m, n)
+		if best.run == nil {
+			return nil
+		}
+		p.Inputs = append(p.Inputs, best)
+		p.EstimatedKeys += best.EstimatedKeys
+		p.EstimatedDocs += best.EstimatedDocs
+		p.Cost += best.Cost
+	}
+
+	p.run = func() ([]string, int) {
+		var ids []string
+		keys := 0
+		seen := map[string]bool{}
+		for _, in := range p.Inputs {
+			got, k := in.run()
+			keys += k
+			for _, id := range got {
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		return ids, keys
+	}
+	return p
+}
+
+// costed sets p's cost from its estimates.
+func costed(p *QueryPlan) *QueryPlan {
+	p.Cost = float64(p.EstimatedDocs) + indexKeyCost*float64(p.EstimatedKeys)
+	return p
+}
+
+// equalityValue returns the single value m pins field to, if any: a plain
+// value or $eq. Objects and arrays aren't indexed as values.
+func equalityValue(m map[string]any, field string) (any, bool) {
+	v, ok := m[field]
+	if !ok {
+		return nil, false
+	}
+	if ops, isOps := v.(map[string]any); isOps {
+		if v, ok = ops["$eq"]; !ok {
+			return nil, false
+		}
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+		return nil, false
+	}
+	return v, true
+}
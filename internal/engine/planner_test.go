@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"testDB/internal/types"
+)
+
+func TestQueryPlanner(t *testing.T) {
+	e := openTestEngine(t, testConfig(t))
+
+	// cat: 10 values of 20 docs; flag: "b" on 20 docs, "a" on the other 180; n: 0..199
+	doc := func(i int) types.Document {
+		flag := "a"
+		if i%20 < 2 {
+			flag = "b"
+		}
+		return types.Document{"_id": fmt.Sprintf("d%d", i), "cat": fmt.Sprintf("c%d", i%10), "flag": flag, "n": i}
+	}
+	for i := 0; i < 100; i++ {
+		insertAll(t, e, "items", doc(i))
+	}
+	for _, idx := range []struct{ field, kind string }{{"cat", "hash"}, {"flag", "hash"}, {"n", "btree"}} {
+		if err := e.CreateIndex("db", "items", []string{idx.field}, idx.kind, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Documents written after the indexes are built must be found through them
+	for i := 100; i < 200; i++ {
+		insertAll(t, e, "items", doc(i))
+	}
+
+	explain := func(t *testing.T, filter map[string]any, wantStage string, wantReturned int) *QueryExplain {
+		t.Helper()
+		docs, ex, err := e.Explain("db", "items", filter, nil, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ex.Plan.Stage != wantStage || ex.Returned != wantReturned || len(docs) != wantReturned {
+			b, _ := json.Marshal(ex)
+			t.Fatalf("%v: expected %s returning %d, got %d docs and %s", filter, wantStage, wantReturned, len(docs), b)
+		}
+		if ex.Plan.Stage != "COLLSCAN" && ex.RejectedPlans[len(ex.RejectedPlans)-1].Stage != "COLLSCAN" {
+			t.Fatalf("%v: expected the scan to be rejected last, got %+v", filter, ex.RejectedPlans)
+		}
+		return ex
+	}
+
+	for _, tc := range []struct {
+		name     string
+		filter   map[string]any
+		stage    string
+		returned int
+		check    func(*QueryExplain) bool
+	}{
+		{
+			name:     "id lookup",
+			filter:   map[string]any{"_id": "d5"},
+			stage:    "ID_LOOKUP",
+			returned: 1,
+			check:    func(ex *QueryExplain) bool { return ex.KeysExamined == 1 && ex.DocsExamined == 1 },
+		},
+		{
+			name:     "hash index",
+			filter:   map[string]any{"cat": "c3"},
+			stage:    "IXSCAN",
+			returned: 20,
+			check: func(ex *QueryExplain) bool {
+				return ex.Plan.Index == "hash:cat" && ex.Plan.Cardinality == 10 && ex.KeysExamined == 20 && ex.DocsExamined == 20
+			},
+		},
+		{
+			name:     "btree range",
+			filter:   map[string]any{"n": map[string]any{"$gte": 10, "$lt": 20}},
+			stage:    "IXSCAN",
+			returned: 10,
+			check: func(ex *QueryExplain) bool {
+				return ex.Plan.Index == "btree:n" && ex.Plan.EstimatedDocs == 10 && ex.DocsExamined == 10
+			},
+		},
+		{
+			name:   "empty index scan",
+			filter: map[string]any{"cat": "none"},
+			stage:  "IXSCAN",
+			check:  func(ex *QueryExplain) bool { return ex.DocsExamined == 0 },
+		},
+		{
+			// An index that selects most of the collection loses to a scan
+			name:     "unselective index",
+			filter:   map[string]any{"flag": "a"},
+			stage:    "COLLSCAN",
+			returned: 180,
+			check:    func(ex *QueryExplain) bool { return ex.DocsExamined == 200 && ex.RejectedPlans[0].Index == "hash:flag" },
+		},
+		{
+			// Two selective predicates: intersecting their indexes beats either
+			name:     "intersection",
+			filter:   map[string]any{"cat": "c1", "flag": "b"},
+			stage:    "INTERSECT",
+			returned: 10,
+			check: func(ex *QueryExplain) bool {
+				return len(ex.Plan.Inputs) == 2 && ex.KeysExamined == 40 && ex.DocsExamined == 10
+			},
+		},
+		{
+			name:     "or union",
+			filter:   map[string]any{"$or": []any{map[string]any{"cat": "c1"}, map[string]any{"n": map[string]any{"$lt": 5}}}},
+			stage:    "OR",
+			returned: 24,
+			check:    func(ex *QueryExplain) bool { return ex.DocsExamined == 24 && len(ex.Plan.Inputs) == 2 },
+		},
+		{
+			// No union unless every branch has an index plan
+			name:     "or with an unindexed branch",
+			filter:   map[string]any{"$or": []any{map[string]any{"cat": "c1"}, map[string]any{"nope": 1}}},
+			stage:    "COLLSCAN",
+			returned: 20,
+			check: func(ex *QueryExplain) bool {
+				for _, p := range ex.RejectedPlans {
+					if p.Stage == "OR" {
+						return false
+					}
+				}
+				return true
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if ex := explain(t, tc.filter, tc.stage, tc.returned); !tc.check(ex) {
+				t.Fatalf("Unexpected plan: %+v %+v", ex, ex.Plan)
+			}
+		})
+	}
+
+	t.Run("conditions beside $or", func(t *testing.T) {
+		docs := queryAll(t, e, "items", map[string]any{
+			"cat": "c1",
+			"$or": []any{map[string]any{"n": map[string]any{"$lt": 50}}, map[string]any{"n": map[string]any{"$gte": 190}}},
+		})
+		if len(docs) != 6 {
+			t.Fatalf("Expected 6 docs, got %d", len(docs))
+		}
+	})
+
+	t.Run("writes keep the indexes in step", func(t *testing.T) {
+		if _, err := e.Update("db", "items", map[string]any{"_id": "d3"}, map[string]any{"$set": map[string]any{"cat": "c4"}}, false, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Delete("db", "items", map[string]any{"_id": "d13"}, false, true); err != nil {
+			t.Fatal(err)
+		}
+		explain(t, map[string]any{"cat": "c3"}, "IXSCAN", 18)
+		explain(t, map[string]any{"cat": "c4"}, "IXSCAN", 21)
+	})
+}
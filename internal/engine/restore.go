@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RestoreOptions selects a base backup, the WAL to replay on top of it and
+// where to stop. With neither ToTime nor ToSeq set, every available entry
+// is replayed.
+type RestoreOptions struct {
+	BackupDir  string // made by Engine.Backup
+	ArchiveDir string // archived WAL files
+	WALDir     string // optional: the live WAL, for entries not archived yet
+
+	// Target is the configuration of the restored instance. Its DataDir
+	// must be empty or absent.
+	Target Config
+
+	ToTime time.Time // last commit time to include
+	ToSeq  int64     // last WAL sequence to include
+
+	// DryRun lists the entries that would be replayed, one JSON object per
+	// line on Out, and leaves Target untouched.
+	DryRun bool
+	Out    io.Writer
+}
+
+// RestoreReport summarizes a point-in-time restore.
+type RestoreReport struct {
+	BackupLSN int64     `json:"backup_lsn"`
+	FirstSeq  int64     `json:"first_seq,omitempty"` // first entry replayed
+	LastSeq   int64     `json:"last_seq"`            // position the restore stopped at
+	LastTime  time.Time `json:"last_time,omitempty"`
+	Entries   int       `json:"entries"`   // entries replayed (or listed)
+	InBackup  int       `json:"in_backup"` // entries the backup already held
+	Documents int       `json:"documents"` // documents changed by replay
+	DryRun    bool      `json:"dry_run"`
+}
+
+// restoreOp is the dry-run listing of one WAL entry.
+type restoreOp struct {
+	Seq        int64    `json:"seq"`
+	Time       string   `json:"time"`
+	Op         string   `json:"op"`
+	DB         string   `json:"db"`
+	Collection string   `json:"coll"`
+	IDs        []string `json:"ids,omitempty"`
+	Filter     any      `json:"filter,omitempty"` // entries logged before ids were
+}
+
+// Restore builds a data directory as of a point in time: it copies a base
+// backup into opts.Target and replays the archived WAL on top of it, in
+// sequence order, up to opts.ToTime or opts.ToSeq. Each entry is applied
+// whole, so the result is the state right after the last one included.
+//
+// Entries a collection's copy already holds, according to the backup
+// label, are skipped. A hole in the WAL between the backup and the target
+// is an error: replaying past it would produce a state that never existed.
+func Restore(opts RestoreOptions) (*RestoreReport, error) {
+	label, err := readBackupLabel(opts.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := readRestoreWAL(opts.ArchiveDir, opts.WALDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RestoreReport{BackupLSN: label.LSN, DryRun: opts.DryRun}
+	from := label.minLSN()
+	next := from + 1
+	// A write that failed stays out, even if the target falls before its abort
+	aborted := abortedWrites(all)
+	var replay []*WALEntryV2
+	for _, entry := range all {
+		if entry.Sequence <= from {
+			continue
+		}
+		if opts.ToSeq > 0 && entry.Sequence > opts.ToSeq {
+			break
+		}
+		if !opts.ToTime.IsZero() && entry.Timestamp > opts.ToTime.UnixNano() {
+			break
+		}
+		if entry.Sequence != next {
+			return nil, fmt.Errorf("WAL entries %d to %d are missing from the archive", next, entry.Sequence-1)
+		}
+		next = entry.Sequence + 1
+		if entry.Op == "abort" || aborted[entry.Sequence] {
+			continue
+		}
+
+		if lsn, ok := label.Collections[entry.DB+"/"+entry.Collection]; ok && entry.Sequence <= lsn {
+			report.InBackup++
+			continue
+		}
+		replay = append(replay, entry)
+	}
+	report.LastSeq = next - 1
+	if max := label.maxLSN(); report.LastSeq < max {
+		// A collection was copied after the target: it can't be rewound
+		return nil, fmt.Errorf("target is before the end of the base backup (LSN %d), use an older backup", max)
+	}
+	if opts.ToSeq > 0 && report.LastSeq < opts.ToSeq {
+		return nil, fmt.Errorf("target sequence %d is beyond the archived WAL (last %d)", opts.ToSeq, report.LastSeq)
+	}
+	report.Entries = len(replay)
+	if len(replay) > 0 {
+		report.FirstSeq = replay[0].Sequence
+		report.LastTime = time.Unix(0, replay[len(replay)-1].Timestamp).UTC()
+	}
+
+	if opts.DryRun {
+		if opts.Out == nil {
+			return report, nil
+		}
+		enc := json.NewEncoder(opts.Out)
+		for _, entry := range replay {
+			op := restoreOp{
+				Seq:        entry.Sequence,
+				Time:       time.Unix(0, entry.Timestamp).UTC().Format(time.RFC3339Nano),
+				Op:         entry.Op,
+				DB:         entry.DB,
+				Collection: entry.Collection,
+				IDs:        entry.IDs,
+			}
+			if entry.Op == "insert" {
+				op.IDs = []string{fmt.Sprintf("%v", entry.Doc["_id"])}
+			} else if len(entry.IDs) == 0 {
+				op.Filter = entry.Filter
+			}
+			if err := enc.Encode(op); err != nil {
+				return nil, err
+			}
+		}
+		return report, nil
+	}
+
+	// Lay down the base backup, then replay into it as a normal startup would
+	if err := requireEmptyDir(opts.Target.DataDir); err != nil {
+		return nil, err
+	}
+	if err := mkdirAll(opts.Target.DBsDir); err != nil {
+		return nil, err
+	}
+	if err := copyTree(filepath.Join(opts.BackupDir, "databases"), opts.Target.DBsDir); err != nil {
+		return nil, fmt.Errorf("copy base backup: %w", err)
+	}
+
+	cfg := opts.Target
+	cfg.EnableWALArchive = false
+	cfg.MigrateLegacyOnStartup = false
+	e, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	e.walMu.Lock()
+	e.replaying = true
+	for _, entry := range replay {
+		n, err := e.replayEntry(entry)
+		if err != nil {
+			e.replaying = false
+			e.walMu.Unlock()
+			e.Shutdown()
+			return nil, fmt.Errorf("WAL entry %d (%s %s/%s): %w", entry.Sequence, entry.Op, entry.DB, entry.Collection, err)
+		}
+		report.Documents += n
+	}
+	e.replaying = false
+	e.walMu.Unlock()
+
+	// New writes continue after the last entry restored
+	e.walv2.AdvanceSequence(report.LastSeq)
+	if err := e.Shutdown(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// readRestoreWAL reads the files of a WAL archive, plus the live WAL files
+// if walDir is set, and returns their entries in sequence order. Archives
+// written before the WAL was split into files overlap, so each sequence
+// is kept once.
+func readRestoreWAL(archiveDir, walDir string) ([]*WALEntryV2, error) {
+	var paths []string
+	if archiveDir != "" {
+		files, err := listArchivedWALFiles(archiveDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, f := range files {
+			paths = append(paths, f.path)
+		}
+	}
+	if walDir != "" {
+		files, err := listWALFiles(walDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, f := range files {
+			paths = append(paths, f.path)
+		}
+	}
+
+	bySeq := map[int64]*WALEntryV2{}
+	for _, path := range paths {
+		entries, err := readWALFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		for _, entry := range entries {
+			bySeq[entry.Sequence] = entry
+		}
+	}
+
+	out := make([]*WALEntryV2, 0, len(bySeq))
+	for _, entry := range bySeq {
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Sequence < out[j].Sequence })
+	return out, nil
+}
@@ -17,7 +17,12 @@ import (
 const (
 	SegmentSize    = 10 * 1024 * 1024 // 10MB per segment
 	SegmentMagic   = uint32(0x41535447) // "ASTG"
-	SegmentVersion = uint32(1)
+	SegmentVersion = uint32(3)
+
+	// Segment format versions
+	SegmentVersionJSON   = uint32(1) // payloads encoded with encoding/json
+	SegmentVersionBinary = uint32(2) // payloads encoded with encodeDocument
+	SegmentVersionLSN    = uint32(3) // records also carry the WAL LSN
 )
 
 type RecordType byte
@@ -33,7 +38,9 @@ type SegmentRecord struct {
 	Type   RecordType
 	DocID  string
 	Data   types.Document
+	LSN    int64 // WAL sequence of the change; 0 if it was never logged
 	Offset int64
+	Size   int64 // bytes the record occupies, including its length prefix
 }
 
 type Segment struct {
@@ -42,8 +49,26 @@ type Segment struct {
 	Size     int64
 	DocCount int
 	Sealed   bool
-	mu       sync.RWMutex
-	file     *os.File
+	Version  uint32 // on-disk format version from the header
+	Flags    uint32 // SegmentFlag* bits from the header
+	RawSize  int64  // logical (uncompressed) size of header + records
+
+	// Record bytes still referenced by the primary-key index, and bytes
+	// superseded by later writes or spent on tombstones. Maintained by the
+	// SegmentManager under its lock.
+	LiveBytes      int64
+	DeadBytes      int64
+	TombstoneBytes int64 // part of DeadBytes
+
+	TruncatedBytes int64 // torn tail cut off when the segment was opened
+
+	mu   sync.RWMutex
+	file *os.File
+
+	footer  *segmentFooter // set for segments with SegmentFlagFooter
+	mapped  []byte         // read-only mapping of a sealed segment (see mapLocked)
+	cacheMu sync.Mutex
+	cache   blockCache
 }
 
 // Create new segment
@@ -66,6 +91,10 @@ func NewSegment(dir string, id int) (*Segment, error) {
 		file:     file,
 		DocCount: 0,
 		Sealed:   false,
+		Version:  SegmentVersion,
+		Size:     segmentHeaderSize,
+		RawSize:  segmentHeaderSize,
+		cache:    blockCache{index: -1},
 	}
 
 	// Write header
@@ -85,9 +114,10 @@ func OpenSegment(path string, id int) (*Segment, error) {
 	}
 
 	seg := &Segment{
-		ID:   id,
-		Path: path,
-		file: file,
+		ID:    id,
+		Path:  path,
+		file:  file,
+		cache: blockCache{index: -1},
 	}
 
 	// Read header
@@ -103,19 +133,38 @@ func OpenSegment(path string, id int) (*Segment, error) {
 		return nil, err
 	}
 	seg.Size = info.Size()
+	seg.RawSize = seg.Size
+
+	// Sealed segments carry a footer (block index for compressed segments)
+	if seg.Flags&SegmentFlagFooter != 0 {
+		if err := seg.readFooter(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		seg.Sealed = true
+		seg.mapLocked()
+	}
 
 	return seg, nil
 }
 
 func (s *Segment) writeHeader() error {
-	header := make([]byte, 16)
-	binary.LittleEndian.PutUint32(header[0:4], SegmentMagic)
-	binary.LittleEndian.PutUint32(header[4:8], SegmentVersion)
-	binary.LittleEndian.PutUint32(header[8:12], 0) // DocCount
-	binary.LittleEndian.PutUint32(header[12:16], 0) // Reserved
+	if _, err := s.file.Write(encodeSegmentHeader(s.Version, 0, s.Flags)); err != nil {
+		return err
+	}
+	if s.Size < segmentHeaderSize {
+		s.Size, s.RawSize = segmentHeaderSize, segmentHeaderSize
+	}
+	return nil
+}
 
-	_, err := s.file.Write(header)
-	return err
+func encodeSegmentHeader(version uint32, docCount int, flags uint32) []byte {
+	header := make([]byte, segmentHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], SegmentMagic)
+	binary.LittleEndian.PutUint32(header[4:8], version)
+	binary.LittleEndian.PutUint32(header[8:12], uint32(docCount))
+	binary.LittleEndian.PutUint32(header[12:16], flags)
+	return header
 }
 
 func (s *Segment) readHeader() error {
@@ -130,86 +179,98 @@ func (s *Segment) readHeader() error {
 	}
 
 	version := binary.LittleEndian.Uint32(header[4:8])
-	if version != SegmentVersion {
+	if version < SegmentVersionJSON || version > SegmentVersion {
 		return errors.New("unsupported segment version")
 	}
+	s.Version = version
 
 	s.DocCount = int(binary.LittleEndian.Uint32(header[8:12]))
+	s.Flags = binary.LittleEndian.Uint32(header[12:16])
 	return nil
 }
 
 // Append record to segment
 func (s *Segment) Append(rec SegmentRecord) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	_, _, err := s.appendRecord(rec)
+	return err
+}
 
-	if s.Sealed {
-		return errors.New("segment is sealed")
-	}
+// appendRecord writes rec at the end of the segment and returns its offset
+// and size. The write itself happens without holding s.mu, so readers of
+// already-published records never wait for it; callers must serialize
+// appends to a segment (SegmentManager does so with writeMu).
+func (s *Segment) appendRecord(rec SegmentRecord) (int64, int64, error) {
+	s.mu.RLock()
+	file, offset, sealed, version := s.file, s.Size, s.Sealed, s.Version
+	s.mu.RUnlock()
 
-	// Seek to end
-	offset, err := s.file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return err
+	if sealed {
+		return 0, 0, errors.New("segment is sealed")
 	}
-	rec.Offset = offset
 
 	// Serialize data
 	var data []byte
+	var err error
 	if rec.Data != nil {
-		data, err = json.Marshal(rec.Data)
+		data, err = encodePayload(version, rec.Data)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
 	}
 
-	// Build record buffer
-	buf := make([]byte, 0, 1024)
-
-	// Type
+	// [totalLen:4][type:1][lsn:8][idLen:2][id][dataLen:4][data][crc:4]
+	// (no lsn before SegmentVersionLSN)
+	buf := make([]byte, 4, 4+1+8+2+len(rec.DocID)+4+len(data)+4)
 	buf = append(buf, byte(rec.Type))
-
-	// DocID length + DocID
-	docIDBytes := []byte(rec.DocID)
-	docIDLen := make([]byte, 2)
-	binary.LittleEndian.PutUint16(docIDLen, uint16(len(docIDBytes)))
-	buf = append(buf, docIDLen...)
-	buf = append(buf, docIDBytes...)
-
-	// Data length + Data
-	dataLen := make([]byte, 4)
-	binary.LittleEndian.PutUint32(dataLen, uint32(len(data)))
-	buf = append(buf, dataLen...)
+	if version >= SegmentVersionLSN {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(rec.LSN))
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(rec.DocID)))
+	buf = append(buf, rec.DocID...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
 	buf = append(buf, data...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
 
-	// CRC32
-	crcVal := crc32.ChecksumIEEE(buf)
-	crcBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(crcBytes, crcVal)
-	buf = append(buf, crcBytes...)
-
-	// Write total length first
-	totalLen := make([]byte, 4)
-	binary.LittleEndian.PutUint32(totalLen, uint32(len(buf)))
-	if _, err := s.file.Write(totalLen); err != nil {
-		return err
+	// Positional write: the file offset is never shared with readers
+	if _, err := file.WriteAt(buf, offset); err != nil {
+		return 0, 0, err
 	}
 
-	// Write record
-	if _, err := s.file.Write(buf); err != nil {
-		return err
-	}
+	// Durability is handled by the caller's group commit (see Sync); the
+	// header doc count is only rewritten when the segment is sealed or closed.
+	n := int64(len(buf))
+	s.mu.Lock()
+	s.DocCount++
+	s.Size = offset + n
+	s.RawSize = s.Size
+	s.mu.Unlock()
 
-	// Sync to disk
-	if err := s.file.Sync(); err != nil {
-		return err
-	}
+	return offset, n, nil
+}
 
-	s.DocCount++
-	s.Size = offset + int64(len(totalLen)) + int64(len(buf))
+// Sync flushes appended records to stable storage.
+func (s *Segment) Sync() error {
+	s.mu.RLock()
+	file, sealed := s.file, s.Sealed
+	s.mu.RUnlock()
 
-	// Update header
-	return s.updateHeaderDocCount()
+	if sealed {
+		// Seal already synced everything
+		return nil
+	}
+	// Sync without holding s.mu so appends can continue meanwhile
+	if err := file.Sync(); err != nil {
+		s.mu.RLock()
+		sealed = s.Sealed
+		s.mu.RUnlock()
+		if sealed {
+			// Sealed (and possibly rewritten) while we were syncing
+			return nil
+		}
+		return err
+	}
+	return nil
 }
 
 func (s *Segment) updateHeaderDocCount() error {
@@ -228,18 +289,20 @@ func (s *Segment) ReadAll() ([]SegmentRecord, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	// Seek past header
-	if _, err := s.file.Seek(16, io.SeekStart); err != nil {
-		return nil, err
+	if s.Flags&SegmentFlagCompressed != 0 {
+		return s.readAllCompressed()
 	}
 
 	records := make([]SegmentRecord, 0, s.DocCount)
 
-	for {
-		rec, err := s.readRecord()
-		if err == io.EOF {
+	offset := int64(segmentHeaderSize) // skip header
+	for offset < s.RawSize {
+		rec, n, err := s.readRecordAt(offset)
+		if n == 0 {
+			// Torn or unreadable length prefix - nothing after this point can be framed
 			break
 		}
+		offset += n
 		if err != nil {
 			// Skip corrupted record
 			continue
@@ -250,69 +313,124 @@ func (s *Segment) ReadAll() ([]SegmentRecord, error) {
 	return records, nil
 }
 
-func (s *Segment) readRecord() (SegmentRecord, error) {
-	var rec SegmentRecord
+// ReadAt reads the single record stored at offset.
+func (s *Segment) ReadAt(offset int64) (SegmentRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, _, err := s.readRecordAt(offset)
+	return rec, err
+}
+
+// readRecordAt reads the record at offset using positional reads, so it
+// never disturbs the file offset used by Append. It returns the number of
+// bytes the record occupies on disk (0 if even the length prefix is unreadable).
+func (s *Segment) readRecordAt(offset int64) (SegmentRecord, int64, error) {
+	if s.Flags&SegmentFlagCompressed != 0 {
+		return s.readCompressedAt(offset)
+	}
+	if s.mapped != nil {
+		rec, n, err := parseRecord(s.mapped[:s.RawSize], int(offset), s.Version)
+		rec.Offset = offset
+		rec.Size = n
+		return rec, n, err
+	}
 
 	// Read total length
-	totalLenBytes := make([]byte, 4)
-	if _, err := s.file.Read(totalLenBytes); err != nil {
-		return rec, err
+	var totalLenBytes [4]byte
+	if _, err := s.file.ReadAt(totalLenBytes[:], offset); err != nil {
+		return SegmentRecord{}, 0, err
+	}
+	totalLen := binary.LittleEndian.Uint32(totalLenBytes[:])
+	n := int64(4) + int64(totalLen)
+	if offset+n > s.RawSize {
+		return SegmentRecord{}, 0, io.ErrUnexpectedEOF
 	}
-	totalLen := binary.LittleEndian.Uint32(totalLenBytes)
 
 	// Read record data
 	buf := make([]byte, totalLen)
-	if _, err := io.ReadFull(s.file, buf); err != nil {
-		return rec, err
+	if _, err := s.file.ReadAt(buf, offset+4); err != nil {
+		return SegmentRecord{}, 0, err
 	}
 
+	rec, err := decodeRecord(buf, s.Version)
+	rec.Offset = offset
+	rec.Size = n
+	return rec, n, err
+}
+
+// parseRecord frames and decodes the record starting at pos in data.
+// Like readRecordAt it returns 0 bytes when the length prefix is unusable.
+func parseRecord(data []byte, pos int, version uint32) (SegmentRecord, int64, error) {
+	if pos < 0 || pos+4 > len(data) {
+		return SegmentRecord{}, 0, io.ErrUnexpectedEOF
+	}
+	totalLen := int(binary.LittleEndian.Uint32(data[pos:]))
+	if totalLen > len(data)-pos-4 {
+		return SegmentRecord{}, 0, io.ErrUnexpectedEOF
+	}
+	rec, err := decodeRecord(data[pos+4:pos+4+totalLen], version)
+	return rec, int64(4 + totalLen), err
+}
+
+// decodeRecord parses a record body (everything after the length prefix)
+// written by a segment of the given version and verifies its CRC.
+func decodeRecord(buf []byte, version uint32) (SegmentRecord, error) {
+	var rec SegmentRecord
+
 	// Parse record
 	offset := 0
 
 	// Type
 	if offset >= len(buf) {
-		return rec, io.EOF
+		return rec, io.ErrUnexpectedEOF
 	}
 	rec.Type = RecordType(buf[offset])
 	offset++
 
+	// LSN
+	if version >= SegmentVersionLSN {
+		if offset+8 > len(buf) {
+			return rec, io.ErrUnexpectedEOF
+		}
+		rec.LSN = int64(binary.LittleEndian.Uint64(buf[offset:]))
+		offset += 8
+	}
+
 	// DocID length
 	if offset+2 > len(buf) {
-		return rec, io.EOF
+		return rec, io.ErrUnexpectedEOF
 	}
 	docIDLen := binary.LittleEndian.Uint16(buf[offset : offset+2])
 	offset += 2
 
 	// DocID
 	if offset+int(docIDLen) > len(buf) {
-		return rec, io.EOF
+		return rec, io.ErrUnexpectedEOF
 	}
 	rec.DocID = string(buf[offset : offset+int(docIDLen)])
 	offset += int(docIDLen)
 
 	// Data length
 	if offset+4 > len(buf) {
-		return rec, io.EOF
+		return rec, io.ErrUnexpectedEOF
 	}
 	dataLen := binary.LittleEndian.Uint32(buf[offset : offset+4])
 	offset += 4
 
 	// Data
+	data := []byte(nil)
 	if dataLen > 0 {
 		if offset+int(dataLen) > len(buf) {
-			return rec, io.EOF
+			return rec, io.ErrUnexpectedEOF
 		}
-		var doc types.Document
-		if err := json.Unmarshal(buf[offset:offset+int(dataLen)], &doc); err != nil {
-			return rec, err
-		}
-		rec.Data = doc
+		data = buf[offset : offset+int(dataLen)]
 		offset += int(dataLen)
 	}
 
 	// CRC (verify)
 	if offset+4 > len(buf) {
-		return rec, io.EOF
+		return rec, io.ErrUnexpectedEOF
 	}
 	crcStored := binary.LittleEndian.Uint32(buf[offset:])
 	crcCalc := crc32.ChecksumIEEE(buf[:offset])
@@ -320,16 +438,51 @@ func (s *Segment) readRecord() (SegmentRecord, error) {
 		return rec, errors.New("CRC mismatch - corrupted record")
 	}
 
+	if data != nil {
+		doc, err := decodePayload(version, data)
+		if err != nil {
+			return rec, err
+		}
+		rec.Data = doc
+	}
+
 	return rec, nil
 }
 
+func encodePayload(version uint32, doc types.Document) ([]byte, error) {
+	if version == SegmentVersionJSON {
+		return json.Marshal(doc)
+	}
+	return encodeDocument(doc)
+}
+
+func decodePayload(version uint32, data []byte) (types.Document, error) {
+	if version == SegmentVersionJSON {
+		var doc types.Document
+		if err := decodeJSONUseNumber(data, &doc); err != nil {
+			return nil, err
+		}
+		return canonicalizeDocument(doc), nil
+	}
+	return decodeDocument(data)
+}
+
 // Seal segment (mark as read-only)
 func (s *Segment) Seal() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.Sealed {
+		return nil
+	}
+	if err := s.updateHeaderDocCount(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
 	s.Sealed = true
-	return s.file.Sync()
+	return nil
 }
 
 // Close segment
@@ -337,7 +490,18 @@ func (s *Segment) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.unmapLocked()
 	if s.file != nil {
+		if !s.Sealed {
+			if err := s.updateHeaderDocCount(); err != nil {
+				s.file.Close()
+				return err
+			}
+			if err := s.file.Sync(); err != nil {
+				s.file.Close()
+				return err
+			}
+		}
 		return s.file.Close()
 	}
 	return nil
@@ -0,0 +1,361 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Compaction reasons, recorded in CompactionRun.Reason
+const (
+	CompactionManual    = "manual"
+	CompactionDeadSpace = "dead_space"
+	CompactionSizeTier  = "size_tier"
+	CompactionUpgrade   = "format_upgrade"
+)
+
+const (
+	// Size tiers: tier 0 holds segments under compactionTierBase bytes, and
+	// each tier above it is compactionTierFactor times larger.
+	compactionTierBase   = 1024 * 1024
+	compactionTierFactor = 4
+
+	compactionHistoryLen = 20
+)
+
+// CompactionRun describes one finished compaction.
+type CompactionRun struct {
+	Reason      string    `json:"reason"`
+	Started     time.Time `json:"started"`
+	DurationMs  int64     `json:"duration_ms"`
+	Segments    []int     `json:"segments"` // merged segment IDs
+	Output      int       `json:"output"`   // ID of the compacted segment
+	LiveDocs    int       `json:"live_docs"`
+	BytesBefore int64     `json:"bytes_before"`
+	BytesAfter  int64     `json:"bytes_after"`
+	Reclaimed   int64     `json:"reclaimed_bytes"`
+}
+
+// movedRecord is a live record copied into a compacted segment.
+type movedRecord struct {
+	docID  string
+	from   recordLocation
+	offset int64
+	size   int64
+}
+
+func (s *Segment) deadRatio() float64 {
+	total := s.LiveBytes + s.DeadBytes
+	if total == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes) / float64(total)
+}
+
+// reclaimableRatio is the share of the segment compaction can always drop.
+// Tombstones are left out: unless every older segment is merged as well they
+// have to be carried into the compacted segment.
+func (s *Segment) reclaimableRatio() float64 {
+	total := s.LiveBytes + s.DeadBytes
+	if total == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes-s.TombstoneBytes) / float64(total)
+}
+
+func sizeTier(size int64) int {
+	tier := 0
+	for limit := int64(compactionTierBase); size >= limit; limit *= compactionTierFactor {
+		tier++
+	}
+	return tier
+}
+
+// sealedLocked returns every segment except the active one, in replay order.
+func (sm *SegmentManager) sealedLocked() []*Segment {
+	sealed := make([]*Segment, 0, len(sm.segments))
+	for _, seg := range sm.segments {
+		if seg != sm.activeSegment {
+			sealed = append(sealed, seg)
+		}
+	}
+	return sealed
+}
+
+// pickVictimsLocked applies the compaction policy:
+//
+//  1. segments in an older on-disk format, plus any sealed segment whose
+//     reclaimable share reaches DeadSpaceThreshold percent;
+//  2. otherwise the smallest size tier holding at least CompactionThreshold
+//     sealed segments.
+func (sm *SegmentManager) pickVictimsLocked() ([]*Segment, string) {
+	sealed := sm.sealedLocked()
+
+	var victims []*Segment
+	reason := CompactionUpgrade
+	for _, seg := range sealed {
+		if seg.Version != SegmentVersion {
+			victims = append(victims, seg)
+			continue
+		}
+		if t := sm.opts.DeadSpaceThreshold; t > 0 && seg.reclaimableRatio()*100 >= float64(t) {
+			victims = append(victims, seg)
+			reason = CompactionDeadSpace
+		}
+	}
+	if len(victims) > 0 {
+		return victims, reason
+	}
+
+	if sm.opts.CompactionThreshold > 1 {
+		tiers := make(map[int][]*Segment)
+		for _, seg := range sealed {
+			t := sizeTier(seg.RawSize)
+			tiers[t] = append(tiers[t], seg)
+		}
+		best := -1
+		for t, segs := range tiers {
+			if len(segs) >= sm.opts.CompactionThreshold && (best < 0 || t < best) {
+				best = t
+			}
+		}
+		if best >= 0 {
+			return tiers[best], CompactionSizeTier
+		}
+	}
+	return nil, ""
+}
+
+// Compact merges every sealed segment into one, dropping superseded records
+// and tombstones.
+func (sm *SegmentManager) Compact() error {
+	_, err := sm.runCompaction(func() ([]*Segment, string) {
+		return sm.sealedLocked(), CompactionManual
+	})
+	return err
+}
+
+// MaybeCompact runs one compaction if the policy picks any segments. It
+// returns nil when there was nothing to do.
+func (sm *SegmentManager) MaybeCompact() (*CompactionRun, error) {
+	return sm.runCompaction(sm.pickVictimsLocked)
+}
+
+// runCompaction merges the segments chosen by pick in three phases, so
+// readers and writers are only blocked at the start and the end:
+//
+//  1. under sm.mu: pick the victims and reserve the output segment ID;
+//  2. unlocked: copy the victims' live records into a new sealed segment;
+//  3. under sm.mu: publish the new set in the manifest, placing the output
+//     where the newest victim was, and repoint the index for every document
+//     not written in the meantime.
+//
+// The victims' files are removed once the new set is published and no
+// snapshot taken before that can read them.
+func (sm *SegmentManager) runCompaction(pick func() ([]*Segment, string)) (*CompactionRun, error) {
+	sm.compactMu.Lock()
+	defer sm.compactMu.Unlock()
+
+	sm.mu.Lock()
+	victims, reason := pick()
+	if len(victims) == 0 {
+		sm.mu.Unlock()
+		return nil, nil
+	}
+	// Tombstones can only be dropped when nothing older survives outside
+	// the output, i.e. when the victims are a prefix of the segment list.
+	prefix := true
+	for i, seg := range victims {
+		if sm.segments[i] != seg {
+			prefix = false
+			break
+		}
+	}
+	id := sm.nextSegmentID
+	sm.nextSegmentID++
+	sm.mu.Unlock()
+
+	start := time.Now()
+	compacted, moved, tombstones, err := sm.mergeSegments(id, victims, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	run := CompactionRun{
+		Reason:   reason,
+		Started:  start,
+		Segments: make([]int, 0, len(victims)),
+		Output:   compacted.ID,
+	}
+	victimSet := make(map[*Segment]bool, len(victims))
+	for _, seg := range victims {
+		victimSet[seg] = true
+		run.Segments = append(run.Segments, seg.ID)
+		run.BytesBefore += seg.Size
+	}
+	newest := victims[len(victims)-1]
+
+	sm.mu.Lock()
+	next := make([]*Segment, 0, len(sm.segments)-len(victims)+1)
+	for _, seg := range sm.segments {
+		if seg == newest {
+			next = append(next, compacted)
+		}
+		if !victimSet[seg] {
+			next = append(next, seg)
+		}
+	}
+	// Until the manifest is rewritten the compacted segment is an orphan;
+	// afterwards the victims are, so a crash on either side of this line
+	// is cleaned up on the next start.
+	if err := sm.writeManifestLocked(next); err != nil {
+		sm.mu.Unlock()
+		compacted.Close()
+		os.Remove(compacted.Path)
+		return nil, err
+	}
+
+	for _, m := range moved {
+		if cur, ok := sm.index[m.docID]; ok && cur == m.from {
+			sm.notePriorLocked(m.docID)
+			sm.index[m.docID] = recordLocation{segmentID: compacted.ID, offset: m.offset, size: m.size}
+			compacted.LiveBytes += m.size
+			run.LiveDocs++
+		} else {
+			// Written again during the merge; the newer record wins on replay
+			compacted.DeadBytes += m.size
+		}
+	}
+	compacted.DeadBytes += tombstones
+	compacted.TombstoneBytes += tombstones
+	sm.segments = next
+	sm.version++
+
+	var reclaim []*Segment
+	for _, seg := range victims {
+		if sm.retireLocked(seg, func() { removeSegment(seg) }) {
+			reclaim = append(reclaim, seg)
+		}
+	}
+
+	run.BytesAfter = compacted.Size
+	run.Reclaimed = run.BytesBefore - run.BytesAfter
+	run.DurationMs = time.Since(start).Milliseconds()
+	sm.recordRunLocked(run)
+	sm.mu.Unlock()
+
+	for _, seg := range reclaim {
+		removeSegment(seg)
+	}
+	return &run, nil
+}
+
+// removeSegment closes seg and deletes its file.
+func removeSegment(seg *Segment) {
+	seg.Close()
+	os.Remove(seg.Path)
+}
+
+// mergeSegments writes the live records of victims into a new sealed
+// segment. Liveness is checked against the primary-key index as the merge
+// goes; documents written after that check are fixed up by the caller.
+func (sm *SegmentManager) mergeSegments(id int, victims []*Segment, dropTombstones bool) (*Segment, []movedRecord, int64, error) {
+	compacted, err := NewSegment(sm.dir, id)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	fail := func(err error) (*Segment, []movedRecord, int64, error) {
+		compacted.Close()
+		os.Remove(compacted.Path)
+		return nil, nil, 0, err
+	}
+
+	var moved []movedRecord
+	var tombstones int64
+	kept := make(map[string]bool)
+
+	for _, seg := range victims {
+		records, err := seg.ReadAll()
+		if err != nil {
+			return fail(fmt.Errorf("read segment %06d: %w", seg.ID, err))
+		}
+
+		for _, rec := range records {
+			sm.mu.RLock()
+			loc, live := sm.index[rec.DocID]
+			sm.mu.RUnlock()
+
+			switch rec.Type {
+			case RecordInsert, RecordUpdate:
+				if !live || loc.segmentID != seg.ID || loc.offset != rec.Offset {
+					// Superseded
+					continue
+				}
+				out := SegmentRecord{Type: RecordInsert, DocID: rec.DocID, Data: rec.Data, LSN: rec.LSN}
+				offset, n, err := compacted.appendRecord(out)
+				if err != nil {
+					return fail(err)
+				}
+				moved = append(moved, movedRecord{docID: rec.DocID, from: loc, offset: offset, size: n})
+
+			case RecordDelete, RecordTombstone:
+				// Keep one tombstone per deleted document so it keeps
+				// shadowing older records in segments outside this merge
+				if dropTombstones || live || kept[rec.DocID] {
+					continue
+				}
+				_, n, err := compacted.appendRecord(SegmentRecord{Type: RecordTombstone, DocID: rec.DocID, LSN: rec.LSN})
+				if err != nil {
+					return fail(err)
+				}
+				kept[rec.DocID] = true
+				tombstones += n
+			}
+		}
+	}
+
+	if err := sm.sealSegment(compacted); err != nil {
+		return fail(err)
+	}
+	return compacted, moved, tombstones, nil
+}
+
+func (sm *SegmentManager) recordRunLocked(run CompactionRun) {
+	sm.runs++
+	sm.reclaimed += run.Reclaimed
+	sm.history = append(sm.history, run)
+	if len(sm.history) > compactionHistoryLen {
+		sm.history = sm.history[len(sm.history)-compactionHistoryLen:]
+	}
+}
+
+func (sm *SegmentManager) compactionStatsLocked() map[string]interface{} {
+	history := make([]CompactionRun, len(sm.history))
+	copy(history, sm.history)
+
+	return map[string]interface{}{
+		"runs":            sm.runs,
+		"reclaimed_bytes": sm.reclaimed,
+		"dead_threshold":  sm.opts.DeadSpaceThreshold,
+		"tier_threshold":  sm.opts.CompactionThreshold,
+		"history":         history,
+	}
+}
+
+// StartAutoCompaction runs policy-driven compaction in background
+func (sm *SegmentManager) StartAutoCompaction(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			run, err := sm.MaybeCompact()
+			if err != nil {
+				fmt.Printf("❌ Auto-compaction failed: %v\n", err)
+			} else if run != nil {
+				fmt.Printf("✅ Auto-compaction (%s) merged %d segments in %dms, reclaimed %d bytes\n",
+					run.Reason, len(run.Segments), run.DurationMs, run.Reclaimed)
+			}
+		}
+	}()
+}
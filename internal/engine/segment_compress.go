@@ -0,0 +1,445 @@
+package engine
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	SegmentBlockSize   = 64 * 1024          // target uncompressed bytes per block
+	SegmentFooterMagic = uint32(0x41535446) // "ASTF"
+
+	segmentHeaderSize  = 16
+	segmentTrailerSize = 12 // [footerLen:4][footerCRC:4][magic:4]
+)
+
+// Header flags (bytes 12:16)
+const (
+	SegmentFlagCompressed = uint32(1 << 0) // records stored as compressed blocks
+	SegmentFlagFooter     = uint32(1 << 1) // file ends with a footer + trailer
+)
+
+// Compression codecs
+const (
+	CompressionNone  = "none"
+	CompressionFlate = "flate"
+	CompressionZlib  = "zlib"
+)
+
+// segmentBlock describes one compressed block. Start and RawLen are in the
+// logical (uncompressed) offset space, so record offsets stay valid after
+// a segment is compressed.
+type segmentBlock struct {
+	Start  int64  // logical offset of the first record in the block
+	RawLen int64  // uncompressed length
+	Offset int64  // file offset of the compressed bytes
+	Len    int64  // compressed length
+	CRC    uint32 // CRC32 of the compressed bytes
+}
+
+// segmentFooter is stored at the end of sealed segments.
+type segmentFooter struct {
+	RawSize int64 // logical size (header + records)
+	Codec   string
+	Blocks  []segmentBlock // empty when the records are stored uncompressed
+	Stats   *segmentStats  // zone map; nil for segments sealed before zone maps
+}
+
+func validCompression(codec string) bool {
+	switch codec {
+	case CompressionNone, CompressionFlate, CompressionZlib:
+		return true
+	}
+	return false
+}
+
+func compressBlock(codec string, level int, raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch codec {
+	case CompressionFlate:
+		w, err = flate.NewWriter(&buf, level)
+	case CompressionZlib:
+		w, err = zlib.NewWriterLevel(&buf, level)
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %s", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressBlock(codec string, comp []byte, rawLen int64) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch codec {
+	case CompressionFlate:
+		r = flate.NewReader(bytes.NewReader(comp))
+	case CompressionZlib:
+		r, err = zlib.NewReader(bytes.NewReader(comp))
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %s", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	raw := make([]byte, rawLen)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (f *segmentFooter) encode() ([]byte, error) {
+	blocks := make([]any, 0, len(f.Blocks))
+	for _, b := range f.Blocks {
+		blocks = append(blocks, map[string]any{
+			"start": b.Start,
+			"raw":   b.RawLen,
+			"off":   b.Offset,
+			"len":   b.Len,
+			"crc":   int64(b.CRC),
+		})
+	}
+	doc := map[string]any{
+		"raw_size": f.RawSize,
+		"codec":    f.Codec,
+		"blocks":   blocks,
+	}
+	if f.Stats != nil {
+		doc["stats"] = f.Stats.toDoc()
+	}
+	return encodeDocument(doc)
+}
+
+func decodeSegmentFooter(b []byte) (*segmentFooter, error) {
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	f := &segmentFooter{RawSize: toInt64(doc["raw_size"])}
+	f.Codec, _ = doc["codec"].(string)
+
+	blocks, _ := doc["blocks"].([]any)
+	for _, it := range blocks {
+		m, ok := it.(map[string]any)
+		if !ok {
+			return nil, errors.New("invalid block entry in segment footer")
+		}
+		f.Blocks = append(f.Blocks, segmentBlock{
+			Start:  toInt64(m["start"]),
+			RawLen: toInt64(m["raw"]),
+			Offset: toInt64(m["off"]),
+			Len:    toInt64(m["len"]),
+			CRC:    uint32(toInt64(m["crc"])),
+		})
+	}
+	if stats, ok := doc["stats"].(map[string]any); ok {
+		f.Stats = segmentStatsFromDoc(stats)
+	}
+	return f, nil
+}
+
+// appendFooter writes footer + trailer to w.
+func appendFooter(w io.Writer, f *segmentFooter) (int64, error) {
+	payload, err := f.encode()
+	if err != nil {
+		return 0, err
+	}
+	trailer := make([]byte, segmentTrailerSize)
+	binary.LittleEndian.PutUint32(trailer[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(trailer[4:8], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(trailer[8:12], SegmentFooterMagic)
+
+	if _, err := w.Write(payload); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(trailer); err != nil {
+		return 0, err
+	}
+	return int64(len(payload) + len(trailer)), nil
+}
+
+// readFooter loads the footer of a segment whose header has SegmentFlagFooter.
+func (s *Segment) readFooter() error {
+	if s.Size < segmentHeaderSize+segmentTrailerSize {
+		return errors.New("segment too small for footer")
+	}
+	trailer := make([]byte, segmentTrailerSize)
+	if _, err := s.file.ReadAt(trailer, s.Size-segmentTrailerSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(trailer[8:12]) != SegmentFooterMagic {
+		return errors.New("invalid segment footer magic")
+	}
+	n := int64(binary.LittleEndian.Uint32(trailer[0:4]))
+	start := s.Size - segmentTrailerSize - n
+	if start < segmentHeaderSize {
+		return errors.New("invalid segment footer length")
+	}
+	payload := make([]byte, n)
+	if _, err := s.file.ReadAt(payload, start); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(trailer[4:8]) {
+		return errors.New("segment footer CRC mismatch")
+	}
+
+	footer, err := decodeSegmentFooter(payload)
+	if err != nil {
+		return err
+	}
+	s.footer = footer
+	s.RawSize = footer.RawSize
+	return nil
+}
+
+// writeFooter rewrites a sealed segment with a footer holding its zone map
+// and, unless codec is CompressionNone, with its records stored as
+// compressed blocks indexed by the footer. The new file is written next to
+// the old one and renamed over it, so a crash leaves either the old or the
+// new file; a leftover <seg>.tmp is removed when the SegmentManager opens
+// (see removeOrphans).
+func (s *Segment) writeFooter(codec string, level int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.Sealed {
+		return errors.New("only sealed segments can be given a footer")
+	}
+	if s.Flags&SegmentFlagFooter != 0 {
+		return nil
+	}
+
+	raw := make([]byte, s.RawSize-segmentHeaderSize)
+	if _, err := s.file.ReadAt(raw, segmentHeaderSize); err != nil {
+		return err
+	}
+
+	tmpPath := s.Path + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	flags := s.Flags | SegmentFlagFooter
+	if codec != CompressionNone {
+		flags |= SegmentFlagCompressed
+	}
+	if _, err := out.Write(encodeSegmentHeader(s.Version, s.DocCount, flags)); err != nil {
+		return fail(err)
+	}
+
+	footer := &segmentFooter{
+		RawSize: s.RawSize,
+		Codec:   codec,
+		Stats:   collectSegmentStats(raw, s.Version),
+	}
+	fileOff := int64(segmentHeaderSize)
+	if codec == CompressionNone {
+		if _, err := out.Write(raw); err != nil {
+			return fail(err)
+		}
+		fileOff += int64(len(raw))
+	}
+	pos := 0
+	for codec != CompressionNone && pos < len(raw) {
+		// Cut blocks on record boundaries so a record never spans two blocks
+		end := pos
+		for end+4 <= len(raw) {
+			n := 4 + int(binary.LittleEndian.Uint32(raw[end:]))
+			if end+n > len(raw) || (end > pos && end+n-pos > SegmentBlockSize) {
+				break
+			}
+			end += n
+		}
+		if end == pos {
+			// Torn tail - nothing framable remains
+			break
+		}
+
+		comp, err := compressBlock(codec, level, raw[pos:end])
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := out.Write(comp); err != nil {
+			return fail(err)
+		}
+		footer.Blocks = append(footer.Blocks, segmentBlock{
+			Start:  int64(segmentHeaderSize + pos),
+			RawLen: int64(end - pos),
+			Offset: fileOff,
+			Len:    int64(len(comp)),
+			CRC:    crc32.ChecksumIEEE(comp),
+		})
+		fileOff += int64(len(comp))
+		pos = end
+	}
+
+	n, err := appendFooter(out, footer)
+	if err != nil {
+		return fail(err)
+	}
+	if err := out.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Swap files (close first so the rename also works on Windows)
+	s.unmapLocked()
+	if err := s.file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, s.Path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.Path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+
+	s.file = file
+	s.Flags = flags
+	s.footer = footer
+	s.Size = fileOff + n
+	s.cache = blockCache{index: -1}
+	s.mapLocked()
+
+	// Until the directory is synced a crash may bring the old file back
+	return syncDir(filepath.Dir(s.Path))
+}
+
+// stats returns the segment's zone map, or nil if it has none (the active
+// segment, or one sealed before zone maps existed).
+func (s *Segment) stats() *segmentStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.footer == nil {
+		return nil
+	}
+	return s.footer.Stats
+}
+
+// blockCache keeps the most recently decompressed block of a segment.
+type blockCache struct {
+	index int
+	data  []byte
+}
+
+func (s *Segment) findBlock(offset int64) int {
+	blocks := s.footer.Blocks
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].Start+blocks[i].RawLen > offset
+	})
+	if i == len(blocks) || blocks[i].Start > offset {
+		return -1
+	}
+	return i
+}
+
+// readBlock returns the decompressed bytes of block i, verifying its CRC.
+// Caller must hold s.mu (read or write).
+func (s *Segment) readBlock(i int) ([]byte, error) {
+	s.cacheMu.Lock()
+	if s.cache.index == i && s.cache.data != nil {
+		data := s.cache.data
+		s.cacheMu.Unlock()
+		return data, nil
+	}
+	s.cacheMu.Unlock()
+
+	blk := s.footer.Blocks[i]
+	var comp []byte
+	if s.mapped != nil && blk.Offset+blk.Len <= int64(len(s.mapped)) {
+		comp = s.mapped[blk.Offset : blk.Offset+blk.Len]
+	} else {
+		comp = make([]byte, blk.Len)
+		if _, err := s.file.ReadAt(comp, blk.Offset); err != nil {
+			return nil, err
+		}
+	}
+	if crc32.ChecksumIEEE(comp) != blk.CRC {
+		return nil, fmt.Errorf("block %d CRC mismatch - corrupted block", i)
+	}
+	data, err := decompressBlock(s.footer.Codec, comp, blk.RawLen)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cacheMu.Lock()
+	s.cache = blockCache{index: i, data: data}
+	s.cacheMu.Unlock()
+	return data, nil
+}
+
+// readCompressedAt reads the record at a logical offset of a compressed segment.
+func (s *Segment) readCompressedAt(offset int64) (SegmentRecord, int64, error) {
+	i := s.findBlock(offset)
+	if i < 0 {
+		return SegmentRecord{}, 0, io.ErrUnexpectedEOF
+	}
+	data, err := s.readBlock(i)
+	if err != nil {
+		return SegmentRecord{}, 0, err
+	}
+	rec, n, err := parseRecord(data, int(offset-s.footer.Blocks[i].Start), s.Version)
+	rec.Offset = offset
+	rec.Size = n
+	return rec, n, err
+}
+
+// readAllCompressed decodes every record of a compressed segment.
+func (s *Segment) readAllCompressed() ([]SegmentRecord, error) {
+	records := make([]SegmentRecord, 0, s.DocCount)
+	for i, blk := range s.footer.Blocks {
+		data, err := s.readBlock(i)
+		if err != nil {
+			// Skip corrupted block
+			continue
+		}
+		pos := 0
+		for pos < len(data) {
+			rec, n, err := parseRecord(data, pos, s.Version)
+			if n == 0 {
+				break
+			}
+			rec.Offset = blk.Start + int64(pos)
+			rec.Size = n
+			pos += int(n)
+			if err != nil {
+				continue
+			}
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
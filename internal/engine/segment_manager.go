@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"testDB/internal/types"
 )
@@ -15,20 +15,103 @@ type SegmentManager struct {
 	segments      []*Segment
 	activeSegment *Segment
 	nextSegmentID int
+	generation    int64 // manifest generation
 	mu            sync.RWMutex
+	writeMu       sync.Mutex // serializes appends; taken before mu
+	compactMu     sync.Mutex // one compaction at a time; held by Close too
+	opts          SegmentOptions
+	committer     *groupCommitter // shares fsyncs of the active segment
+
+	// Primary-key index: docID -> location of its latest record.
+	// Tombstoned documents are removed from the map.
+	index map[string]recordLocation
+
+	// WAL positions: the highest LSN appended, and the highest one known
+	// to be on disk. Records reach a collection in LSN order, so every
+	// change up to durableLSN is stored.
+	appliedLSN int64
+	durableLSN int64
+
+	runs      int             // compactions since startup
+	history   []CompactionRun // most recent last, capped at compactionHistoryLen
+	reclaimed int64           // bytes freed by compaction since startup
+
+	quarantined []QuarantinedSegment // moved out of the live set since startup
+
+	// Snapshot reads (see segment_snapshot.go): version counts changes to
+	// the index, readers counts open snapshots by version, and prior and
+	// retired keep what those snapshots may still read.
+	version int64
+	readers map[int64]int
+	prior   map[string][]indexVersion // oldest first
+	retired []retiredSegment
+
+	// Zone-map pruning counters for Scan
+	scanned atomic.Int64 // segments considered
+	pruned  atomic.Int64 // segments skipped
 }
 
+// recordLocation points at a single record inside a segment.
+type recordLocation struct {
+	segmentID int
+	offset    int64
+	size      int64
+}
+
+// SegmentOptions controls how a collection's segments are stored.
+type SegmentOptions struct {
+	Compression      string // CompressionNone | CompressionFlate | CompressionZlib
+	CompressionLevel int    // compress/flate level
+
+	// Durability of appends, with the same meaning as for the WAL
+	SyncMode     WALSyncMode
+	BatchSize    int           // batch mode: writes per fsync
+	CommitDelay  time.Duration // batch mode: max wait for a batch to fill
+	SyncInterval time.Duration // async mode: background fsync period
+
+	// Compaction policy (see MaybeCompact)
+	CompactionThreshold int // compact once this many sealed segments share a size tier
+	DeadSpaceThreshold  int // compact a sealed segment once this percent of it is dead
+}
+
+func DefaultSegmentOptions() SegmentOptions {
+	return SegmentOptions{
+		Compression:      DefaultSegmentCompression,
+		CompressionLevel: DefaultSegmentCompressionLevel,
+		SyncMode:         WALSyncImmediate,
+		BatchSize:        DefaultWALBatchSize,
+		CommitDelay:      DefaultGroupCommitDelay,
+		SyncInterval:     time.Duration(DefaultWALBatchTimeout) * time.Second,
+
+		CompactionThreshold: DefaultCompactionThreshold,
+		DeadSpaceThreshold:  DefaultDeadSpaceThreshold,
+	}
+}
 
 func NewSegmentManager(collectionDir string) (*SegmentManager, error) {
+	return NewSegmentManagerWithOptions(collectionDir, DefaultSegmentOptions())
+}
+
+func NewSegmentManagerWithOptions(collectionDir string, opts SegmentOptions) (*SegmentManager, error) {
+	if !validCompression(opts.Compression) {
+		return nil, fmt.Errorf("unknown segment compression: %s", opts.Compression)
+	}
+
 	sm := &SegmentManager{
 		dir:      collectionDir,
 		segments: make([]*Segment, 0),
+		index:    make(map[string]recordLocation),
+		opts:     opts,
+		readers:  make(map[int64]int),
+		prior:    make(map[string][]indexVersion),
 	}
+	sm.committer = newGroupCommitter(opts.SyncMode, opts.BatchSize, opts.CommitDelay, opts.SyncInterval, sm.syncActive)
 
 	// Load existing segments
 	if err := sm.loadSegments(); err != nil {
 		return nil, err
 	}
+	sm.rebuildIndex()
 
 	// Create active segment if needed
 	if sm.activeSegment == nil {
@@ -40,6 +123,11 @@ func NewSegmentManager(collectionDir string) (*SegmentManager, error) {
 	return sm, nil
 }
 
+// loadSegments opens the segments listed in the manifest, in manifest order,
+// and removes any segment file the manifest doesn't reference. Collections
+// created before manifests existed adopt their segment files in ID order.
+// Segments too damaged to open are quarantined, and a torn write at the end
+// of the active segment is truncated.
 func (sm *SegmentManager) loadSegments() error {
 	segDir := filepath.Join(sm.dir, "segments")
 
@@ -47,83 +135,316 @@ func (sm *SegmentManager) loadSegments() error {
 		return err
 	}
 
-	entries, err := os.ReadDir(segDir)
+	manifest, err := readManifest(segDir)
+	if err != nil {
+		return err
+	}
+	onDisk, err := listSegmentFiles(segDir)
 	if err != nil {
 		return err
 	}
 
-	segmentIDs := make([]int, 0)
-	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".seg" {
-			var id int
-			if _, err := fmt.Sscanf(entry.Name(), "%06d.seg", &id); err == nil {
-				segmentIDs = append(segmentIDs, id)
-			}
+	order := onDisk
+	if manifest != nil {
+		order = manifest.Segments
+		sm.generation = manifest.Generation
+		sm.nextSegmentID = manifest.NextSegmentID
+		sm.durableLSN = manifest.DurableLSN
+	}
+	// Never hand out an ID that is still on disk, even an orphan's
+	for _, id := range onDisk {
+		if id >= sm.nextSegmentID {
+			sm.nextSegmentID = id + 1
 		}
 	}
 
-	sort.Ints(segmentIDs)
-
-	for _, id := range segmentIDs {
-		path := filepath.Join(segDir, fmt.Sprintf("%06d.seg", id))
+	live := make(map[int]bool, len(order))
+	dirty := manifest == nil
+	for _, id := range order {
+		live[id] = true
+		path := filepath.Join(segDir, segmentFileName(id))
 		seg, err := OpenSegment(path, id)
 		if err != nil {
-			// Skip corrupted segments
+			if !isSegmentFormatError(err) {
+				return fmt.Errorf("open segment %06d: %w", id, err)
+			}
+			// Damaged beyond opening: keep the file for inspection, but
+			// out of the live set
+			dst, qerr := sm.quarantine(path)
+			if qerr != nil {
+				return fmt.Errorf("segment %06d is unreadable (%v) and could not be quarantined: %w", id, err, qerr)
+			}
+			fmt.Printf("⚠️  Segment %06d is unreadable (%v); moved to %s\n", id, err, dst)
+			sm.quarantined = append(sm.quarantined, QuarantinedSegment{ID: id, File: dst, Reason: err.Error(), Time: time.Now()})
+			dirty = true
 			continue
 		}
-
+		seg.Sealed = true
 		sm.segments = append(sm.segments, seg)
+	}
 
-		if id >= sm.nextSegmentID {
-			sm.nextSegmentID = id + 1
+	// Only the last segment can be active, and only if it's not full.
+	// Segments written in an older format are never appended to;
+	// compaction rewrites them.
+	if n := len(sm.segments); n > 0 {
+		last := sm.segments[n-1]
+		if last.Flags&SegmentFlagFooter == 0 && last.Size < SegmentSize && last.Version == SegmentVersion {
+			last.Sealed = false
+			sm.activeSegment = last
+
+			torn, err := last.truncateTornTail()
+			if err != nil {
+				return fmt.Errorf("segment %06d: truncate torn tail: %w", last.ID, err)
+			}
+			if torn > 0 {
+				fmt.Printf("⚠️  Segment %06d: truncated %d bytes of torn writes\n", last.ID, torn)
+			}
 		}
+	}
 
-		// Last segment is active if not full
-		if !seg.Sealed && seg.Size < SegmentSize {
-			sm.activeSegment = seg
-		} else {
-			seg.Sealed = true
+	for _, seg := range sm.segments {
+		if seg != sm.activeSegment {
+			seg.mapSealed()
 		}
 	}
 
+	if dirty {
+		if err := sm.writeManifestLocked(sm.segments); err != nil {
+			return err
+		}
+	}
+	removeOrphans(segDir, live)
+
 	return nil
 }
 
+// createNewSegment adds an empty active segment and publishes it in the manifest.
 func (sm *SegmentManager) createNewSegment() error {
 	seg, err := NewSegment(sm.dir, sm.nextSegmentID)
 	if err != nil {
 		return err
 	}
+	sm.nextSegmentID++
+
+	segments := make([]*Segment, 0, len(sm.segments)+1)
+	segments = append(segments, sm.segments...)
+	segments = append(segments, seg)
+	if err := sm.writeManifestLocked(segments); err != nil {
+		seg.Close()
+		os.Remove(seg.Path)
+		return err
+	}
 
-	sm.segments = append(sm.segments, seg)
+	sm.segments = segments
 	sm.activeSegment = seg
-	sm.nextSegmentID++
 
 	return nil
 }
 
-// Append document
-func (sm *SegmentManager) Append(docID string, doc types.Document) error {
+// rebuildIndex replays every segment in order to rebuild the primary-key index.
+// Caller must hold sm.mu (or have exclusive access during startup).
+func (sm *SegmentManager) rebuildIndex() {
+	old := sm.index
+	sm.index = make(map[string]recordLocation)
+	for _, seg := range sm.segments {
+		seg.LiveBytes, seg.DeadBytes, seg.TombstoneBytes = 0, 0, 0
+	}
+
+	for _, seg := range sm.segments {
+		records, err := seg.ReadAll()
+		if err != nil {
+			continue
+		}
+		for _, rec := range records {
+			sm.applyToIndex(seg, rec)
+			if rec.LSN > sm.durableLSN {
+				sm.durableLSN = rec.LSN
+			}
+		}
+		// The header count is only rewritten on seal/close, so trust the scan
+		seg.DocCount = len(records)
+	}
+	if sm.durableLSN > sm.appliedLSN {
+		sm.appliedLSN = sm.durableLSN
+	}
+	sm.notePriorsLocked(old)
+}
+
+// applyToIndex points the index at rec and moves the bytes of the record it
+// supersedes from live to dead. Tombstones are dead from the start.
+func (sm *SegmentManager) applyToIndex(seg *Segment, rec SegmentRecord) {
+	if old, ok := sm.index[rec.DocID]; ok {
+		if prev := sm.segmentByID(old.segmentID); prev != nil {
+			prev.LiveBytes -= old.size
+			prev.DeadBytes += old.size
+		}
+	}
+
+	switch rec.Type {
+	case RecordInsert, RecordUpdate:
+		sm.index[rec.DocID] = recordLocation{segmentID: seg.ID, offset: rec.Offset, size: rec.Size}
+		seg.LiveBytes += rec.Size
+	case RecordDelete, RecordTombstone:
+		delete(sm.index, rec.DocID)
+		seg.DeadBytes += rec.Size
+		seg.TombstoneBytes += rec.Size
+	}
+}
+
+func (sm *SegmentManager) segmentByID(id int) *Segment {
+	for _, seg := range sm.segments {
+		if seg.ID == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// write appends rec to the active segment, rolling over to a new segment
+// when it is full, and publishes it in the primary-key index. Appends are
+// serialized by writeMu; sm.mu is only taken to roll over and to publish,
+// so readers never wait for the write itself. The returned ticket
+// completes once the record is durable.
+func (sm *SegmentManager) write(rec SegmentRecord) (commitTicket, error) {
+	sm.writeMu.Lock()
+	defer sm.writeMu.Unlock()
+
+	// activeSegment only changes under writeMu, so it is safe to read here
+	if sm.activeSegment.Size >= SegmentSize {
+		sm.mu.Lock()
+		err := sm.rollOverLocked()
+		sm.mu.Unlock()
+		if err != nil {
+			return commitTicket{}, err
+		}
+	}
+
+	seg := sm.activeSegment
+	offset, size, err := seg.appendRecord(rec)
+	if err != nil {
+		return commitTicket{}, err
+	}
+	rec.Offset, rec.Size = offset, size
+
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	sm.notePriorLocked(rec.DocID)
+	sm.applyToIndex(seg, rec)
+	if rec.LSN > sm.appliedLSN {
+		sm.appliedLSN = rec.LSN
+	}
+	return sm.committer.noteWrite(), nil
+}
+
+// rollOverLocked seals the active segment and starts a new one.
+// Caller must hold writeMu and sm.mu.
+func (sm *SegmentManager) rollOverLocked() error {
+	if err := sm.sealSegment(sm.activeSegment); err != nil {
+		return err
+	}
+	// Sealing synced every earlier write
+	sm.committer.markSynced()
+	sm.durableLSN = sm.appliedLSN
+	return sm.createNewSegment()
+}
+
+// syncActive fsyncs the active segment on behalf of the group committer.
+func (sm *SegmentManager) syncActive() error {
+	sm.mu.RLock()
+	seg, lsn := sm.activeSegment, sm.appliedLSN
+	sm.mu.RUnlock()
+
+	if err := seg.Sync(); err != nil {
+		return err
+	}
+	sm.mu.Lock()
+	if lsn > sm.durableLSN {
+		sm.durableLSN = lsn
+	}
+	sm.mu.Unlock()
+	return nil
+}
+
+// LSNs returns the highest WAL LSN appended to the collection and the
+// highest one known to be durable.
+func (sm *SegmentManager) LSNs() (applied, durable int64) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.appliedLSN, sm.durableLSN
+}
+
+// Sync makes every append so far durable, whatever the sync mode.
+func (sm *SegmentManager) Sync() error {
+	return sm.committer.flush()
+}
+
+// sealSegment marks seg read-only and rewrites it with a footer carrying
+// its zone map, compressing the records if enabled.
+func (sm *SegmentManager) sealSegment(seg *Segment) error {
+	if err := seg.Seal(); err != nil {
+		return err
+	}
+	return seg.writeFooter(sm.opts.Compression, sm.opts.CompressionLevel)
+}
 
+// Get returns the latest version of a single document, reading only its record.
+func (sm *SegmentManager) Get(docID string) (types.Document, bool, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	loc, ok := sm.index[docID]
+	if !ok {
+		return nil, false, nil
+	}
+	seg := sm.segmentByID(loc.segmentID)
+	if seg == nil {
+		return nil, false, fmt.Errorf("segment %d not found for doc %s", loc.segmentID, docID)
+	}
+	rec, err := seg.ReadAt(loc.offset)
+	if err != nil {
+		return nil, false, err
+	}
+	return rec.Data, true, nil
+}
+
+// Has reports whether a live document with docID exists.
+func (sm *SegmentManager) Has(docID string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	_, ok := sm.index[docID]
+	return ok
+}
+
+// Count returns the number of live documents.
+func (sm *SegmentManager) Count() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return len(sm.index)
+}
+
+// Append document and wait until it is durable under the sync mode
+func (sm *SegmentManager) Append(docID string, doc types.Document) error {
+	ticket, err := sm.appendDoc(docID, doc, 0)
+	if err != nil {
+		return err
+	}
+	return ticket.Wait()
+}
+
+// appendDoc writes doc without waiting for durability. Callers wait on the
+// ticket after releasing their own locks so concurrent writers can share
+// one fsync.
+func (sm *SegmentManager) appendDoc(docID string, doc types.Document, lsn int64) (commitTicket, error) {
 	rec := SegmentRecord{
 		Type:  RecordInsert,
 		DocID: docID,
 		Data:  doc,
+		LSN:   lsn,
 	}
 
-	// Check if active segment is full
-	if sm.activeSegment.Size >= SegmentSize {
-		if err := sm.activeSegment.Seal(); err != nil {
-			return err
-		}
-		if err := sm.createNewSegment(); err != nil {
-			return err
-		}
-	}
-
-	return sm.activeSegment.Append(rec)
+	return sm.write(rec)
 }
 
 // Read all documents
@@ -161,165 +482,131 @@ func (sm *SegmentManager) ReadAll() ([]types.Document, error) {
 	return docs, nil
 }
 
-// Delete document (append tombstone)
+// Scan returns the live documents of every segment whose zone map admits a
+// match for filter. Documents are not filtered individually; callers still
+// apply matchesFilter. Liveness comes from the primary-key index, so a
+// skipped segment can never let an older version of a document through.
+func (sm *SegmentManager) Scan(filter map[string]any) ([]types.Document, error) {
+	snap := sm.Snapshot()
+	defer snap.Release()
+	return snap.Scan(filter)
+}
+
+// Delete document (append tombstone) and wait until it is durable
 func (sm *SegmentManager) Delete(docID string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	ticket, err := sm.deleteDoc(docID, 0)
+	if err != nil {
+		return err
+	}
+	return ticket.Wait()
+}
 
+// deleteDoc appends a tombstone without waiting for durability.
+func (sm *SegmentManager) deleteDoc(docID string, lsn int64) (commitTicket, error) {
 	rec := SegmentRecord{
 		Type:  RecordTombstone,
 		DocID: docID,
 		Data:  nil,
+		LSN:   lsn,
 	}
 
-	// Check if active segment is full
-	if sm.activeSegment.Size >= SegmentSize {
-		if err := sm.activeSegment.Seal(); err != nil {
-			return err
-		}
-		if err := sm.createNewSegment(); err != nil {
-			return err
-		}
-	}
-
-	return sm.activeSegment.Append(rec)
+	return sm.write(rec)
 }
 
 // Close all segments
 func (sm *SegmentManager) Close() error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	// Let a running compaction finish first
+	sm.compactMu.Lock()
+	defer sm.compactMu.Unlock()
 
-	for _, seg := range sm.segments {
-		if err := seg.Close(); err != nil {
-			return err
-		}
-	}
-	return nil
-}
+	syncErr := sm.committer.flush()
+	sm.committer.close()
 
-// Compact segments (merge and remove tombstones)
-func (sm *SegmentManager) Compact() error {
+	sm.writeMu.Lock()
+	defer sm.writeMu.Unlock()
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	// Don't compact if only 1 segment
-	if len(sm.segments) <= 1 {
-		return nil
-	}
-
-	// Build latest state (skip tombstones)
-	docMap := make(map[string]types.Document)
-
-	for _, seg := range sm.segments[:len(sm.segments)-1] { // exclude active
-		records, err := seg.ReadAll()
-		if err != nil {
-			continue
-		}
-
-		for _, rec := range records {
-			switch rec.Type {
-			case RecordInsert, RecordUpdate:
-				docMap[rec.DocID] = rec.Data
-			case RecordDelete, RecordTombstone:
-				delete(docMap, rec.DocID)
-			}
-		}
+	if syncErr != nil {
+		return syncErr
 	}
 
-	// Create new compacted segment
-	compactedID := sm.nextSegmentID
-	compacted, err := NewSegment(sm.dir, compactedID)
-	if err != nil {
-		return err
+	// Snapshots still open read closed segments from here on
+	for _, r := range sm.retired {
+		r.reclaim()
 	}
-	sm.nextSegmentID++
+	sm.retired = nil
 
-	// Write all live documents
-	for docID, doc := range docMap {
-		rec := SegmentRecord{
-			Type:  RecordInsert,
-			DocID: docID,
-			Data:  doc,
-		}
-		if err := compacted.Append(rec); err != nil {
-			compacted.Close()
-			os.Remove(compacted.Path)
+	for _, seg := range sm.segments {
+		if err := seg.Close(); err != nil {
 			return err
 		}
 	}
-
-	compacted.Seal()
-
-	// Delete old segments
-	for _, seg := range sm.segments[:len(sm.segments)-1] {
-		seg.Close()
-		os.Remove(seg.Path)
-	}
-
-	// Update segment list
-	sm.segments = []*Segment{compacted, sm.activeSegment}
-
 	return nil
 }
 
-
-
-
-// StartAutoCompaction runs compaction in background
-func (sm *SegmentManager) StartAutoCompaction(interval time.Duration) {
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			sm.mu.RLock()
-			segCount := len(sm.segments)
-			sm.mu.RUnlock()
-
-			if segCount >= 3 {
-				fmt.Printf("🔄 Auto-compaction starting (%d segments)...\n", segCount)
-				
-				start := time.Now()
-				if err := sm.Compact(); err != nil {
-					fmt.Printf("❌ Auto-compaction failed: %v\n", err)
-				} else {
-					duration := time.Since(start)
-					fmt.Printf("✅ Auto-compaction completed in %v\n", duration)
-				}
-			}
-		}
-	}()
-}
-
 // GetStats returns segment statistics
 func (sm *SegmentManager) GetStats() map[string]interface{} {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
 	totalSize := int64(0)
+	totalRaw := int64(0)
+	totalLive := int64(0)
+	totalDead := int64(0)
 	totalDocs := 0
 	segmentInfo := make([]map[string]interface{}, 0)
 
 	for _, seg := range sm.segments {
 		seg.mu.RLock()
 		info := map[string]interface{}{
-			"id":     seg.ID,
-			"size":   seg.Size,
-			"docs":   seg.DocCount,
-			"sealed": seg.Sealed,
+			"id":         seg.ID,
+			"size":       seg.Size,
+			"raw_size":   seg.RawSize,
+			"docs":       seg.DocCount,
+			"sealed":     seg.Sealed,
+			"compressed": seg.Flags&SegmentFlagCompressed != 0,
+			"mapped":     seg.mapped != nil,
+			"live_bytes": seg.LiveBytes,
+			"dead_bytes": seg.DeadBytes,
+			"dead_ratio": seg.deadRatio(),
+		}
+		if seg.footer != nil && seg.footer.Stats != nil {
+			info["zone_map"] = seg.footer.Stats.summary()
 		}
+		totalSize += seg.Size
+		totalRaw += seg.RawSize
+		totalLive += seg.LiveBytes
+		totalDead += seg.DeadBytes
+		totalDocs += seg.DocCount
 		seg.mu.RUnlock()
 
 		segmentInfo = append(segmentInfo, info)
-		totalSize += seg.Size
-		totalDocs += seg.DocCount
+	}
+
+	ratio := 1.0
+	if totalSize > 0 {
+		ratio = float64(totalRaw) / float64(totalSize)
 	}
 
 	return map[string]interface{}{
-		"segment_count": len(sm.segments),
-		"total_size":    totalSize,
-		"total_docs":    totalDocs,
-		"segments":      segmentInfo,
+		"segment_count":       len(sm.segments),
+		"manifest_generation": sm.generation,
+		"applied_lsn":         sm.appliedLSN,
+		"durable_lsn":         sm.durableLSN,
+		"total_size":          totalSize,
+		"total_raw_size":      totalRaw,
+		"live_bytes":          totalLive,
+		"dead_bytes":          totalDead,
+		"compression":         sm.opts.Compression,
+		"compression_ratio":   ratio,
+		"total_docs":          totalDocs,
+		"segments":            segmentInfo,
+		"compaction":          sm.compactionStatsLocked(),
+		"snapshots":           sm.snapshotStatsLocked(),
+		"scan": map[string]interface{}{
+			"segments_scanned": sm.scanned.Load(),
+			"segments_pruned":  sm.pruned.Load(),
+		},
 	}
 }
\ No newline at end of file
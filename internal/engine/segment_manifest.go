@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const SegmentManifestFile = "MANIFEST"
+
+// segmentManifest lists the segments that make up a collection, in replay
+// order. It is the only source of truth for the live segment set: a segment
+// file that isn't listed is garbage, whatever its name. Switching sets
+// (e.g. after compaction) is a single atomic rewrite of this file.
+//
+// DurableLSN is a floor for the collection's durable LSN: compaction may
+// drop the records that carried the highest LSNs, so the value is saved
+// here whenever the set changes.
+type segmentManifest struct {
+	Generation    int64 `json:"generation"`
+	Segments      []int `json:"segments"`
+	NextSegmentID int   `json:"nextSegmentId"`
+	DurableLSN    int64 `json:"durableLsn,omitempty"`
+}
+
+func manifestPath(segDir string) string {
+	return filepath.Join(segDir, SegmentManifestFile)
+}
+
+// readManifest returns nil (and no error) when the collection has no manifest yet.
+func readManifest(segDir string) (*segmentManifest, error) {
+	b, err := os.ReadFile(manifestPath(segDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var m segmentManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid segment manifest: %w", err)
+	}
+	return &m, nil
+}
+
+func segmentFileName(id int) string {
+	return fmt.Sprintf("%06d.seg", id)
+}
+
+// listSegmentFiles returns the IDs of every segment file in segDir, sorted.
+func listSegmentFiles(segDir string) ([]int, error) {
+	entries, err := os.ReadDir(segDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".seg" {
+			var id int
+			if _, err := fmt.Sscanf(entry.Name(), "%06d.seg", &id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// writeManifestLocked persists the current segment set under a new generation.
+// Caller must hold sm.mu (or have exclusive access during startup).
+func (sm *SegmentManager) writeManifestLocked(segments []*Segment) error {
+	m := segmentManifest{
+		Generation:    sm.generation + 1,
+		Segments:      make([]int, 0, len(segments)),
+		NextSegmentID: sm.nextSegmentID,
+		DurableLSN:    sm.durableLSN,
+	}
+	for _, seg := range segments {
+		m.Segments = append(m.Segments, seg.ID)
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	segDir := filepath.Join(sm.dir, "segments")
+	if err := atomicWriteFile(manifestPath(segDir), b, 0644); err != nil {
+		return err
+	}
+	sm.generation = m.Generation
+	return nil
+}
+
+// removeOrphans deletes segment files that the manifest doesn't list, plus
+// leftovers of interrupted rewrites (*.tmp). These come from a crash between
+// creating a segment and publishing it, or between publishing a compacted
+// set and deleting the segments it replaced.
+func removeOrphans(segDir string, live map[int]bool) {
+	entries, err := os.ReadDir(segDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(segDir, name))
+			continue
+		}
+		var id int
+		if filepath.Ext(name) == ".seg" {
+			if _, err := fmt.Sscanf(name, "%06d.seg", &id); err == nil && !live[id] {
+				os.Remove(filepath.Join(segDir, name))
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package engine
+
+import "fmt"
+
+// Sealed segments never change, so they are read through a read-only
+// memory mapping where the platform supports it: records are decoded
+// straight from the mapped bytes and readers never touch the file offset.
+// Decoding copies everything it keeps (strings, binary values), so no
+// reference into the mapping outlives it.
+
+// mapLocked maps a sealed segment. Failure is not an error: the segment
+// falls back to positional reads. Caller must hold s.mu for writing.
+func (s *Segment) mapLocked() {
+	if !s.Sealed || s.mapped != nil || s.file == nil || s.Size <= 0 {
+		return
+	}
+	data, err := mmapFile(s.file, s.Size)
+	if err != nil {
+		if err != errMmapUnsupported {
+			fmt.Printf("⚠️  Segment %06d: mmap failed, using reads: %v\n", s.ID, err)
+		}
+		return
+	}
+	s.mapped = data
+}
+
+// mapSealed maps the segment if it is sealed.
+func (s *Segment) mapSealed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mapLocked()
+}
+
+// unmapLocked releases the mapping. Caller must hold s.mu for writing and
+// make sure no reader still uses the segment.
+func (s *Segment) unmapLocked() {
+	if s.mapped == nil {
+		return
+	}
+	munmapFile(s.mapped)
+	s.mapped = nil
+}
@@ -0,0 +1,304 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const QuarantineDir = "quarantine"
+
+// ScrubReport is the result of checking every segment of a collection.
+type ScrubReport struct {
+	Database       string               `json:"database"`
+	Collection     string               `json:"collection"`
+	Segments       []SegmentScrub       `json:"segments"`
+	Records        int                  `json:"records"`
+	CorruptRecords int                  `json:"corrupt_records"`
+	Repaired       bool                 `json:"repaired"`
+	Quarantined    []QuarantinedSegment `json:"quarantined,omitempty"`
+}
+
+// SegmentScrub lists the problems found in one segment.
+type SegmentScrub struct {
+	ID             int             `json:"id"`
+	Path           string          `json:"path"`
+	Records        int             `json:"records"` // records that decoded cleanly
+	Corrupt        []CorruptRecord `json:"corrupt,omitempty"`
+	TruncatedBytes int64           `json:"truncated_on_open,omitempty"`
+}
+
+// CorruptRecord is an unreadable byte range, in logical segment offsets.
+type CorruptRecord struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Error  string `json:"error"`
+}
+
+// QuarantinedSegment records a segment file moved out of the live set.
+type QuarantinedSegment struct {
+	ID         int       `json:"id"`
+	File       string    `json:"file"`
+	Reason     string    `json:"reason"`
+	Time       time.Time `json:"time"`
+	ReplacedBy *int      `json:"replaced_by,omitempty"` // segment holding its readable records
+}
+
+// scrub reads every record of the segment and reports the ones that
+// can't be decoded.
+func (s *Segment) scrub() SegmentScrub {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rep := SegmentScrub{ID: s.ID, Path: s.Path, TruncatedBytes: s.TruncatedBytes}
+
+	if s.Flags&SegmentFlagCompressed != 0 {
+		for i, blk := range s.footer.Blocks {
+			data, err := s.readBlock(i)
+			if err != nil {
+				rep.Corrupt = append(rep.Corrupt, CorruptRecord{Offset: blk.Start, Size: blk.RawLen, Error: err.Error()})
+				continue
+			}
+			pos := 0
+			for pos < len(data) {
+				_, n, err := parseRecord(data, pos, s.Version)
+				if n == 0 {
+					rep.Corrupt = append(rep.Corrupt, CorruptRecord{
+						Offset: blk.Start + int64(pos),
+						Size:   int64(len(data) - pos),
+						Error:  "unframable bytes at end of block",
+					})
+					break
+				}
+				if err != nil {
+					rep.Corrupt = append(rep.Corrupt, CorruptRecord{Offset: blk.Start + int64(pos), Size: n, Error: err.Error()})
+				} else {
+					rep.Records++
+				}
+				pos += int(n)
+			}
+		}
+		return rep
+	}
+
+	offset := int64(segmentHeaderSize)
+	for offset < s.RawSize {
+		_, n, err := s.readRecordAt(offset)
+		if n == 0 {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			rep.Corrupt = append(rep.Corrupt, CorruptRecord{
+				Offset: offset,
+				Size:   s.RawSize - offset,
+				Error:  "unframable tail: " + err.Error(),
+			})
+			break
+		}
+		if err != nil {
+			rep.Corrupt = append(rep.Corrupt, CorruptRecord{Offset: offset, Size: n, Error: err.Error()})
+		} else {
+			rep.Records++
+		}
+		offset += n
+	}
+	return rep
+}
+
+// truncateTornTail cuts an unsealed segment back to the end of its last
+// intact record. Bytes after it are a write torn by a crash: they were
+// never fsynced, so no caller was told they were durable.
+func (s *Segment) truncateTornTail() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	good := int64(segmentHeaderSize)
+	offset := good
+	for offset < s.RawSize {
+		_, n, err := s.readRecordAt(offset)
+		if n == 0 {
+			break
+		}
+		offset += n
+		if err == nil {
+			good = offset
+		}
+	}
+	if good >= s.Size {
+		return 0, nil
+	}
+
+	torn := s.Size - good
+	if err := s.file.Truncate(good); err != nil {
+		return 0, err
+	}
+	if err := s.file.Sync(); err != nil {
+		return 0, err
+	}
+	s.Size, s.RawSize = good, good
+	s.TruncatedBytes = torn
+	return torn, nil
+}
+
+// quarantine moves a segment file into the collection's quarantine
+// directory and returns its new path.
+func (sm *SegmentManager) quarantine(path string) (string, error) {
+	dst, err := sm.quarantinePath(path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// quarantinePath returns the path a segment file is quarantined under,
+// creating the quarantine directory if needed.
+func (sm *SegmentManager) quarantinePath(path string) (string, error) {
+	dir := filepath.Join(sm.dir, QuarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)+"."+time.Now().Format("20060102T150405.000")), nil
+}
+
+// Scrub checks every record of every segment. With repair set, each damaged
+// segment is replaced by a fresh one holding its readable records, and the
+// damaged file is moved to quarantine/.
+func (sm *SegmentManager) Scrub(repair bool) (*ScrubReport, error) {
+	if !repair {
+		sm.mu.RLock()
+		defer sm.mu.RUnlock()
+		return sm.scrubLocked(), nil
+	}
+
+	sm.compactMu.Lock()
+	defer sm.compactMu.Unlock()
+	if err := sm.committer.flush(); err != nil {
+		return nil, err
+	}
+
+	sm.writeMu.Lock()
+	defer sm.writeMu.Unlock()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	report := sm.scrubLocked()
+	for _, rep := range report.Segments {
+		if len(rep.Corrupt) == 0 {
+			continue
+		}
+		seg := sm.segmentByID(rep.ID)
+		if seg == nil {
+			continue
+		}
+		q, err := sm.repairSegmentLocked(seg, fmt.Sprintf("%d corrupt records", len(rep.Corrupt)))
+		if err != nil {
+			sm.rebuildIndex()
+			return report, err
+		}
+		report.Quarantined = append(report.Quarantined, q)
+	}
+	sm.rebuildIndex()
+	report.Repaired = true
+	return report, nil
+}
+
+func (sm *SegmentManager) scrubLocked() *ScrubReport {
+	report := &ScrubReport{Segments: make([]SegmentScrub, 0, len(sm.segments))}
+	for _, seg := range sm.segments {
+		rep := seg.scrub()
+		report.Records += rep.Records
+		report.CorruptRecords += len(rep.Corrupt)
+		report.Segments = append(report.Segments, rep)
+	}
+	report.Quarantined = append(report.Quarantined, sm.quarantined...)
+	return report
+}
+
+// repairSegmentLocked copies the readable records of seg, in order, into a
+// new segment that takes its place in the manifest, then quarantines seg.
+// Caller must hold writeMu and sm.mu.
+func (sm *SegmentManager) repairSegmentLocked(seg *Segment, reason string) (QuarantinedSegment, error) {
+	var q QuarantinedSegment
+
+	records, err := seg.ReadAll()
+	if err != nil {
+		return q, err
+	}
+
+	fresh, err := NewSegment(sm.dir, sm.nextSegmentID)
+	if err != nil {
+		return q, err
+	}
+	sm.nextSegmentID++
+	fail := func(err error) (QuarantinedSegment, error) {
+		fresh.Close()
+		os.Remove(fresh.Path)
+		return q, err
+	}
+
+	for _, rec := range records {
+		if _, _, err := fresh.appendRecord(SegmentRecord{Type: rec.Type, DocID: rec.DocID, Data: rec.Data, LSN: rec.LSN}); err != nil {
+			return fail(err)
+		}
+	}
+	active := seg == sm.activeSegment
+	if active {
+		err = fresh.Sync()
+	} else {
+		err = sm.sealSegment(fresh)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	next := make([]*Segment, len(sm.segments))
+	for i, s := range sm.segments {
+		if s == seg {
+			s = fresh
+		}
+		next[i] = s
+	}
+	if err := sm.writeManifestLocked(next); err != nil {
+		return fail(err)
+	}
+	sm.segments = next
+	if active {
+		sm.activeSegment = fresh
+	}
+	sm.version++
+
+	// The file is already out of the manifest; if it can't be moved,
+	// startup will remove it
+	dst, err := sm.quarantinePath(seg.Path)
+	if err != nil {
+		return q, fmt.Errorf("quarantine segment %06d: %w", seg.ID, err)
+	}
+	if sm.retireLocked(seg, func() {
+		seg.Close()
+		if err := os.Rename(seg.Path, dst); err != nil {
+			fmt.Printf("⚠️  Could not quarantine segment %06d: %v\n", seg.ID, err)
+		}
+	}) {
+		seg.Close()
+		if err := os.Rename(seg.Path, dst); err != nil {
+			return q, fmt.Errorf("quarantine segment %06d: %w", seg.ID, err)
+		}
+	}
+
+	id := fresh.ID
+	q = QuarantinedSegment{ID: seg.ID, File: dst, Reason: reason, Time: time.Now(), ReplacedBy: &id}
+	sm.quarantined = append(sm.quarantined, q)
+	return q, nil
+}
+
+// isSegmentFormatError reports whether err from OpenSegment means the file
+// itself is damaged, as opposed to being missing or inaccessible.
+func isSegmentFormatError(err error) bool {
+	return !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission)
+}
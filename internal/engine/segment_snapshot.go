@@ -0,0 +1,260 @@
+package engine
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"testDB/internal/types"
+)
+
+// Snapshots give readers a fixed view of a collection while writers keep
+// appending. Every change to the primary-key index counts as a version;
+// while snapshots are open, the entry a change replaces is kept in
+// sm.prior, so a snapshot can still find the record that was current at
+// its version. Segments dropped from the live set by compaction or repair
+// stay open in sm.retired until no snapshot that may read them is left.
+
+// SegmentSnapshot is a read-only view of a collection's documents as of the
+// moment it was taken. It must be released once read.
+type SegmentSnapshot struct {
+	LSN int64 // highest WAL LSN the view includes
+
+	sm       *SegmentManager
+	version  int64
+	segments []*Segment
+	released atomic.Bool
+}
+
+// indexVersion is a superseded index entry: where docID's record was
+// (live is false if it had none) up to, but not including, version until.
+type indexVersion struct {
+	loc   recordLocation
+	live  bool
+	until int64
+}
+
+// retiredSegment is a segment no longer in the live set that snapshots
+// older than until may still read.
+type retiredSegment struct {
+	seg     *Segment
+	until   int64
+	reclaim func()
+}
+
+// Snapshot returns a view of the current documents. Later writes,
+// compactions and repairs don't change what it reads.
+func (sm *SegmentManager) Snapshot() *SegmentSnapshot {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	snap := &SegmentSnapshot{
+		LSN:      sm.appliedLSN,
+		sm:       sm,
+		version:  sm.version,
+		segments: append([]*Segment(nil), sm.segments...),
+	}
+	sm.readers[snap.version]++
+	return snap
+}
+
+// notePriorLocked counts a change to docID's index entry, first keeping
+// the entry it replaces if a snapshot may still need it. Caller must hold
+// sm.mu.
+func (sm *SegmentManager) notePriorLocked(docID string) {
+	sm.version++
+	if len(sm.readers) == 0 {
+		return
+	}
+	loc, ok := sm.index[docID]
+	sm.prior[docID] = append(sm.prior[docID], indexVersion{loc: loc, live: ok, until: sm.version})
+}
+
+// notePriorsLocked counts the replacement of the whole index, old, by
+// sm.index, keeping every entry that changed. Caller must hold sm.mu.
+func (sm *SegmentManager) notePriorsLocked(old map[string]recordLocation) {
+	sm.version++
+	if len(sm.readers) == 0 {
+		return
+	}
+	for id, loc := range old {
+		if cur, ok := sm.index[id]; !ok || cur != loc {
+			sm.prior[id] = append(sm.prior[id], indexVersion{loc: loc, live: true, until: sm.version})
+		}
+	}
+	for id := range sm.index {
+		if _, ok := old[id]; !ok {
+			sm.prior[id] = append(sm.prior[id], indexVersion{until: sm.version})
+		}
+	}
+}
+
+// locateLocked returns where docID's record was at version. Caller must
+// hold sm.mu.
+func (sm *SegmentManager) locateLocked(docID string, version int64) (recordLocation, bool) {
+	for _, pv := range sm.prior[docID] {
+		if pv.until > version {
+			return pv.loc, pv.live
+		}
+	}
+	loc, ok := sm.index[docID]
+	return loc, ok
+}
+
+// retireLocked takes seg, already out of sm.segments, out of service. It
+// reports whether seg can be reclaimed right away; otherwise reclaim runs
+// when the last snapshot that may read it is released. Caller must hold
+// sm.mu, and must have counted the change to the segment set as a version.
+func (sm *SegmentManager) retireLocked(seg *Segment, reclaim func()) bool {
+	for v := range sm.readers {
+		if v < sm.version {
+			sm.retired = append(sm.retired, retiredSegment{seg: seg, until: sm.version, reclaim: reclaim})
+			return false
+		}
+	}
+	return true
+}
+
+// Release ends the snapshot, reclaiming the index entries and segments
+// only it still held. Releasing twice is harmless.
+func (s *SegmentSnapshot) Release() {
+	if !s.released.CompareAndSwap(false, true) {
+		return
+	}
+	sm := s.sm
+
+	sm.mu.Lock()
+	if sm.readers[s.version]--; sm.readers[s.version] == 0 {
+		delete(sm.readers, s.version)
+	}
+	reclaim := sm.pruneLocked()
+	sm.mu.Unlock()
+
+	for _, r := range reclaim {
+		r.reclaim()
+	}
+}
+
+// pruneLocked drops the index entries no open snapshot can reach, and
+// returns the retired segments none can read any more. Caller must hold
+// sm.mu.
+func (sm *SegmentManager) pruneLocked() []retiredSegment {
+	oldest, open := int64(0), false
+	for v := range sm.readers {
+		if !open || v < oldest {
+			oldest, open = v, true
+		}
+	}
+
+	if !open {
+		clear(sm.prior)
+	} else {
+		for id, versions := range sm.prior {
+			n := 0
+			for n < len(versions) && versions[n].until <= oldest {
+				n++
+			}
+			if n == len(versions) {
+				delete(sm.prior, id)
+			} else if n > 0 {
+				sm.prior[id] = versions[n:]
+			}
+		}
+	}
+
+	var done []retiredSegment
+	kept := sm.retired[:0]
+	for _, r := range sm.retired {
+		if open && oldest < r.until {
+			kept = append(kept, r)
+		} else {
+			done = append(done, r)
+		}
+	}
+	sm.retired = kept
+	return done
+}
+
+func (s *SegmentSnapshot) segmentByID(id int) *Segment {
+	for _, seg := range s.segments {
+		if seg.ID == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// Get returns the document with docID as of the snapshot.
+func (s *SegmentSnapshot) Get(docID string) (types.Document, bool, error) {
+	s.sm.mu.RLock()
+	loc, ok := s.sm.locateLocked(docID, s.version)
+	s.sm.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	seg := s.segmentByID(loc.segmentID)
+	if seg == nil {
+		return nil, false, fmt.Errorf("segment %d not found for doc %s", loc.segmentID, docID)
+	}
+	rec, err := seg.ReadAt(loc.offset)
+	if err != nil {
+		return nil, false, err
+	}
+	return rec.Data, true, nil
+}
+
+// Scan is SegmentManager.Scan as of the snapshot. Segments are read
+// without holding sm.mu; it is only taken to check, a segment at a time,
+// which of the records read were live at the snapshot.
+func (s *SegmentSnapshot) Scan(filter map[string]any) ([]types.Document, error) {
+	sm := s.sm
+
+	var docs []types.Document
+	for _, seg := range s.segments {
+		sm.scanned.Add(1)
+		if st := seg.stats(); st != nil && !st.mayMatch(filter) {
+			sm.pruned.Add(1)
+			continue
+		}
+
+		records, err := seg.ReadAll()
+		if err != nil {
+			// Skip corrupted segments
+			continue
+		}
+		sm.mu.RLock()
+		for _, rec := range records {
+			if rec.Type != RecordInsert && rec.Type != RecordUpdate {
+				continue
+			}
+			if loc, ok := sm.locateLocked(rec.DocID, s.version); ok && loc.segmentID == seg.ID && loc.offset == rec.Offset {
+				docs = append(docs, rec.Data)
+			}
+		}
+		sm.mu.RUnlock()
+	}
+	return docs, nil
+}
+
+// snapshotStatsLocked describes the open snapshots and what they retain.
+func (sm *SegmentManager) snapshotStatsLocked() map[string]interface{} {
+	open := 0
+	for _, n := range sm.readers {
+		open += n
+	}
+	versions := 0
+	for _, pv := range sm.prior {
+		versions += len(pv)
+	}
+	retained := make([]int, 0, len(sm.retired))
+	for _, r := range sm.retired {
+		retained = append(retained, r.seg.ID)
+	}
+
+	return map[string]interface{}{
+		"open":              open,
+		"version":           sm.version,
+		"retained_versions": versions,
+		"retained_segments": retained,
+	}
+}
@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"testDB/internal/types"
+)
+
+func TestSnapshotReads(t *testing.T) {
+	dir := "./test_snapshot"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	sm, err := NewSegmentManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Close()
+
+	for i := 0; i < 3; i++ {
+		sm.Append(fmt.Sprintf("doc%d", i), types.Document{"_id": fmt.Sprintf("doc%d", i), "v": 1})
+	}
+	sm.writeMu.Lock()
+	sm.mu.Lock()
+	err = sm.rollOverLocked()
+	sm.mu.Unlock()
+	sm.writeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	victims := append([]*Segment(nil), sm.segments...)
+
+	// Changes after the snapshot, including a compaction of the segments
+	// it reads, don't show through it
+	snap := sm.Snapshot()
+	sm.Append("doc0", types.Document{"_id": "doc0", "v": 2})
+	sm.Delete("doc1")
+	sm.Append("doc3", types.Document{"_id": "doc3", "v": 1})
+	if err := sm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(victims[0].Path); err != nil {
+		t.Fatalf("Compacted segment removed while a snapshot reads it: %v", err)
+	}
+
+	docs, err := snap.Scan(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 3 {
+		t.Fatalf("Expected 3 documents in the snapshot, got %v", docs)
+	}
+	for _, d := range docs {
+		if fmt.Sprint(d["v"]) != "1" {
+			t.Fatalf("Snapshot sees a later write: %v", d)
+		}
+	}
+	if d, ok, _ := snap.Get("doc1"); !ok || d["_id"] != "doc1" {
+		t.Fatal("Snapshot lost a document deleted after it was taken")
+	}
+	if _, ok, _ := snap.Get("doc3"); ok {
+		t.Fatal("Snapshot sees a document inserted after it was taken")
+	}
+	if docs, _ := sm.Scan(nil); len(docs) != 3 {
+		t.Fatalf("Expected 3 current documents, got %d", len(docs))
+	}
+
+	// Releasing the last reader reclaims what only it needed
+	snap.Release()
+	snap.Release()
+	if _, err := os.Stat(victims[0].Path); !os.IsNotExist(err) {
+		t.Fatalf("Compacted segment kept after the snapshot was released: %v", err)
+	}
+	sm.mu.RLock()
+	retained := len(sm.prior) + len(sm.retired) + len(sm.readers)
+	sm.mu.RUnlock()
+	if retained != 0 {
+		t.Fatal("Snapshot state kept after the last release")
+	}
+
+	// Through the engine: a query never sees half of a transaction
+	edir := "./test_snapshot_engine"
+	os.RemoveAll(edir)
+	defer os.RemoveAll(edir)
+	e, err := New(DefaultConfig().WithDataDir(edir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			txn := e.Begin()
+			txn.Insert("db", "pairs", types.Document{"pair": i})
+			txn.Insert("db", "pairs", types.Document{"pair": i})
+			if err := txn.Commit(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		docs, err := e.Query("db", "pairs", nil, map[string]int{"pair": 1}, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs)%2 != 0 {
+			t.Fatalf("Query saw part of a transaction: %d documents", len(docs))
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,453 @@
+package engine
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"time"
+
+	"testDB/internal/types"
+)
+
+// Zone maps: per-field statistics written into the footer of sealed
+// segments, used to skip segments that can't contain a match.
+//
+// The statistics cover every insert/update record in the segment, live or
+// superseded, so they describe a superset of the segment's live documents.
+// Pruning must therefore only ever answer "no match possible" when that is
+// certain under matchesFilter's comparison rules (see compareAny).
+
+const (
+	segmentStatsMaxFields = 256 // top-level fields tracked per segment
+	segmentStatsMaxString = 128 // longer strings disable string bounds for a field
+
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// fieldStats summarizes the values of one top-level field.
+type fieldStats struct {
+	Count int // documents with the field present (including nulls)
+	Nulls int
+
+	NumCount int // values toNumber accepts (numbers and numeric strings)
+	NumMin   float64
+	NumMax   float64
+	NaN      bool // NaN compares equal to every number
+
+	StrCount int // string values
+	StrMin   string
+	StrMax   string
+	StrWide  bool // a string exceeded segmentStatsMaxString; bounds unusable
+
+	TimeCount int // values toTime accepts
+	TimeMin   time.Time
+	TimeMax   time.Time
+
+	OtherCount int // bools, arrays, documents, binary
+}
+
+// segmentStats is the zone map of one sealed segment.
+type segmentStats struct {
+	Docs     int
+	Fields   map[string]*fieldStats
+	Complete bool // every field seen is in Fields
+
+	Bloom  []byte // bloom filter of document IDs
+	Hashes int
+}
+
+func newSegmentStats() *segmentStats {
+	return &segmentStats{Fields: make(map[string]*fieldStats), Complete: true, Hashes: bloomHashes}
+}
+
+// collectSegmentStats builds the zone map for the records in raw (the
+// record area of a segment, without its header).
+func collectSegmentStats(raw []byte, version uint32) *segmentStats {
+	st := newSegmentStats()
+	ids := make([]string, 0)
+
+	pos := 0
+	for pos < len(raw) {
+		rec, n, err := parseRecord(raw, pos, version)
+		if n == 0 {
+			break
+		}
+		pos += int(n)
+		if err != nil || (rec.Type != RecordInsert && rec.Type != RecordUpdate) {
+			continue
+		}
+		st.add(rec.Data)
+		ids = append(ids, rec.DocID)
+	}
+
+	st.Bloom = make([]byte, (len(ids)*bloomBitsPerKey+7)/8+1)
+	for _, id := range ids {
+		st.bloomAdd(id)
+	}
+	return st
+}
+
+func (st *segmentStats) add(doc types.Document) {
+	st.Docs++
+	for k, v := range doc {
+		fs, ok := st.Fields[k]
+		if !ok {
+			if len(st.Fields) >= segmentStatsMaxFields {
+				st.Complete = false
+				continue
+			}
+			fs = &fieldStats{}
+			st.Fields[k] = fs
+		}
+		fs.add(v)
+	}
+}
+
+func (fs *fieldStats) add(v any) {
+	fs.Count++
+	if v == nil {
+		fs.Nulls++
+		return
+	}
+
+	if n, ok := toNumber(v); ok {
+		if math.IsNaN(n) {
+			fs.NaN = true
+		} else {
+			if fs.NumCount == 0 || n < fs.NumMin {
+				fs.NumMin = n
+			}
+			if fs.NumCount == 0 || n > fs.NumMax {
+				fs.NumMax = n
+			}
+			fs.NumCount++
+		}
+	}
+	if t, ok := toTime(v); ok {
+		if fs.TimeCount == 0 || t.Before(fs.TimeMin) {
+			fs.TimeMin = t
+		}
+		if fs.TimeCount == 0 || t.After(fs.TimeMax) {
+			fs.TimeMax = t
+		}
+		fs.TimeCount++
+	}
+
+	switch x := v.(type) {
+	case string:
+		if len(x) > segmentStatsMaxString {
+			fs.StrWide = true
+		}
+		if fs.StrCount == 0 || x < fs.StrMin {
+			fs.StrMin = x
+		}
+		if fs.StrCount == 0 || x > fs.StrMax {
+			fs.StrMax = x
+		}
+		fs.StrCount++
+	case time.Time:
+	default:
+		if _, ok := toNumber(v); !ok {
+			fs.OtherCount++
+		}
+	}
+}
+
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (st *segmentStats) bloomAdd(key string) {
+	bits := uint32(len(st.Bloom) * 8)
+	h1, h2 := bloomHash(key)
+	for i := 0; i < st.Hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % bits
+		st.Bloom[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (st *segmentStats) bloomMayContain(key string) bool {
+	if len(st.Bloom) == 0 {
+		return st.Docs > 0
+	}
+	bits := uint32(len(st.Bloom) * 8)
+	h1, h2 := bloomHash(key)
+	for i := 0; i < st.Hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % bits
+		if st.Bloom[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mayMatch reports whether any document in the segment could match filter.
+// It mirrors the structure of matchesFilter and only looks at top-level
+// fields; anything it can't reason about counts as a possible match.
+func (st *segmentStats) mayMatch(filter map[string]any) bool {
+	if len(filter) == 0 {
+		return st.Docs > 0
+	}
+
+	if orVal, ok := filter["$or"]; ok {
+		arr, ok := orVal.([]any)
+		if !ok {
+			return true
+		}
+		for _, item := range arr {
+			m, ok := item.(map[string]any)
+			if !ok || st.mayMatch(m) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if andVal, ok := filter["$and"]; ok {
+		arr, ok := andVal.([]any)
+		if !ok {
+			return true
+		}
+		for _, item := range arr {
+			if m, ok := item.(map[string]any); ok && !st.mayMatch(m) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for key, want := range filter {
+		if strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			continue
+		}
+		if !st.fieldMayMatch(key, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func (st *segmentStats) fieldMayMatch(key string, want any) bool {
+	fs := st.Fields[key]
+	if fs == nil && !st.Complete {
+		return true
+	}
+
+	if opMap, ok := want.(map[string]any); ok {
+		for op, v := range opMap {
+			switch op {
+			case "$exists":
+				if b, ok := v.(bool); ok && b && fs == nil {
+					return false
+				}
+			case "$gt", "$gte", "$lt", "$lte":
+				if !fs.rangeMayMatch(op, v) {
+					return false
+				}
+			case "$in":
+				if key == "_id" && !st.idsMayMatch(v) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	// Equality requires the field to exist
+	if fs == nil {
+		return false
+	}
+	if id, ok := plainString(want); ok && key == "_id" && !st.bloomMayContain(id) {
+		return false
+	}
+	return fs.equalMayMatch(want)
+}
+
+func (st *segmentStats) idsMayMatch(v any) bool {
+	arr, ok := v.([]any)
+	if !ok {
+		return true
+	}
+	for _, item := range arr {
+		id, ok := plainString(item)
+		if !ok || st.bloomMayContain(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// plainString returns v if it is a string that compareAny only ever
+// matches exactly (not a number or a date).
+func plainString(v any) (string, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return "", false
+	}
+	if _, isNum := toNumber(s); isNum {
+		return "", false
+	}
+	if _, isTime := toTime(s); isTime {
+		return "", false
+	}
+	return s, true
+}
+
+// rangeMayMatch follows compareNumbers: numbers compare numerically, and
+// otherwise both sides must be dates.
+func (fs *fieldStats) rangeMayMatch(op string, v any) bool {
+	if fs == nil {
+		return false
+	}
+	if n, ok := toNumber(v); ok {
+		if math.IsNaN(n) {
+			return false
+		}
+		if fs.NumCount == 0 {
+			return false
+		}
+		switch op {
+		case "$gt":
+			return fs.NumMax > n
+		case "$gte":
+			return fs.NumMax >= n
+		case "$lt":
+			return fs.NumMin < n
+		case "$lte":
+			return fs.NumMin <= n
+		}
+		return true
+	}
+	if t, ok := toTime(v); ok {
+		if fs.TimeCount == 0 {
+			return false
+		}
+		switch op {
+		case "$gt":
+			return fs.TimeMax.After(t)
+		case "$gte":
+			return !fs.TimeMax.Before(t)
+		case "$lt":
+			return fs.TimeMin.Before(t)
+		case "$lte":
+			return !fs.TimeMin.After(t)
+		}
+	}
+	return true
+}
+
+// equalMayMatch follows compareAny. Its last resort compares values as
+// formatted text, so bounds are only trusted when no value of another kind
+// could format to the wanted text.
+func (fs *fieldStats) equalMayMatch(v any) bool {
+	if fs.OtherCount > 0 || v == nil {
+		return true
+	}
+
+	if n, ok := toNumber(v); ok {
+		if math.IsNaN(n) || fs.NaN {
+			return true
+		}
+		return fs.NumCount > 0 && fs.NumMin <= n && n <= fs.NumMax
+	}
+	if t, ok := toTime(v); ok {
+		return fs.TimeCount > 0 && !t.Before(fs.TimeMin) && !t.After(fs.TimeMax)
+	}
+	if s, ok := v.(string); ok {
+		if fs.StrCount != fs.Count-fs.Nulls || (s == "" && fs.Nulls > 0) || fs.StrWide {
+			return true
+		}
+		return fs.StrCount > 0 && fs.StrMin <= s && s <= fs.StrMax
+	}
+	return true
+}
+
+func (st *segmentStats) toDoc() map[string]any {
+	fields := make(map[string]any, len(st.Fields))
+	for k, fs := range st.Fields {
+		m := map[string]any{
+			"count": fs.Count,
+			"nulls": fs.Nulls,
+		}
+		if fs.NumCount > 0 {
+			m["num_count"] = fs.NumCount
+			m["num_min"] = fs.NumMin
+			m["num_max"] = fs.NumMax
+		}
+		if fs.NaN {
+			m["nan"] = true
+		}
+		if fs.StrCount > 0 {
+			m["str_count"] = fs.StrCount
+			m["str_min"] = fs.StrMin
+			m["str_max"] = fs.StrMax
+		}
+		if fs.StrWide {
+			m["str_wide"] = true
+		}
+		if fs.TimeCount > 0 {
+			m["time_count"] = fs.TimeCount
+			m["time_min"] = fs.TimeMin
+			m["time_max"] = fs.TimeMax
+		}
+		if fs.OtherCount > 0 {
+			m["other_count"] = fs.OtherCount
+		}
+		fields[k] = m
+	}
+	return map[string]any{
+		"docs":     st.Docs,
+		"fields":   fields,
+		"complete": st.Complete,
+		"bloom":    st.Bloom,
+		"hashes":   st.Hashes,
+	}
+}
+
+func segmentStatsFromDoc(doc map[string]any) *segmentStats {
+	st := newSegmentStats()
+	st.Docs = int(toInt64(doc["docs"]))
+	st.Complete, _ = doc["complete"].(bool)
+	st.Bloom, _ = doc["bloom"].([]byte)
+	st.Hashes = int(toInt64(doc["hashes"]))
+
+	fields, _ := doc["fields"].(map[string]any)
+	for k, it := range fields {
+		m, ok := it.(map[string]any)
+		if !ok {
+			// Unknown shape: don't claim anything about this field
+			st.Complete = false
+			continue
+		}
+		fs := &fieldStats{
+			Count:      int(toInt64(m["count"])),
+			Nulls:      int(toInt64(m["nulls"])),
+			NumCount:   int(toInt64(m["num_count"])),
+			StrCount:   int(toInt64(m["str_count"])),
+			TimeCount:  int(toInt64(m["time_count"])),
+			OtherCount: int(toInt64(m["other_count"])),
+		}
+		fs.NumMin, _ = m["num_min"].(float64)
+		fs.NumMax, _ = m["num_max"].(float64)
+		fs.NaN, _ = m["nan"].(bool)
+		fs.StrMin, _ = m["str_min"].(string)
+		fs.StrMax, _ = m["str_max"].(string)
+		fs.StrWide, _ = m["str_wide"].(bool)
+		fs.TimeMin, _ = m["time_min"].(time.Time)
+		fs.TimeMax, _ = m["time_max"].(time.Time)
+		st.Fields[k] = fs
+	}
+	return st
+}
+
+// summary is the GetStats view of the zone map.
+func (st *segmentStats) summary() map[string]interface{} {
+	doc := st.toDoc()
+	delete(doc, "bloom")
+	doc["bloom_bits"] = len(st.Bloom) * 8
+	return doc
+}
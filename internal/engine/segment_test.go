@@ -3,7 +3,12 @@ package engine
 import (
 	"fmt"
     "os"
+    "path/filepath"
+    "runtime"
+    "sync"
+    "sync/atomic"
     "testing"
+    "time"
 
     "testDB/internal/types"
 )
@@ -98,4 +103,685 @@ func TestCompaction(t *testing.T) {
     if len(docs) != 50 {
         t.Fatalf("Expected 50 docs after compaction, got %d", len(docs))
     }
-}
\ No newline at end of file
+}
+func TestSegmentManagerGet(t *testing.T) {
+    dir := "./test_pk_index"
+    os.RemoveAll(dir)
+    defer os.RemoveAll(dir)
+
+    sm, err := NewSegmentManager(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for i := 0; i < 10; i++ {
+        id := fmt.Sprintf("doc%d", i)
+        if err := sm.Append(id, types.Document{"_id": id, "n": i}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // Supersede doc3 and delete doc4
+    if err := sm.Append("doc3", types.Document{"_id": "doc3", "n": 33}); err != nil {
+        t.Fatal(err)
+    }
+    if err := sm.Delete("doc4"); err != nil {
+        t.Fatal(err)
+    }
+    sm.Close()
+
+    // Reopen: the index must be rebuilt from disk
+    sm, err = NewSegmentManager(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sm.Close()
+
+    if sm.Count() != 9 {
+        t.Fatalf("Expected 9 live docs, got %d", sm.Count())
+    }
+    doc, ok, err := sm.Get("doc3")
+    if err != nil || !ok {
+        t.Fatalf("Get doc3: ok=%v err=%v", ok, err)
+    }
+    if doc["n"] != int64(33) {
+        t.Fatalf("Expected latest version of doc3, got %v", doc)
+    }
+    if sm.Has("doc4") {
+        t.Fatal("doc4 should be deleted")
+    }
+}
+
+func TestBinaryEncodingPreservesTypes(t *testing.T) {
+    when := time.Date(2026, 10, 1, 12, 0, 0, 123, time.UTC)
+    doc := types.Document{
+        "_id":   "doc1",
+        "int":   int64(1) << 60,
+        "float": 2.5,
+        "str":   "hello",
+        "bool":  true,
+        "null":  nil,
+        "when":  when,
+        "bin":   []byte{1, 2, 3},
+        "sub":   map[string]any{"a": int64(1)},
+        "arr":   []any{int64(1), "two", map[string]any{"three": 3.0}},
+    }
+
+    b, err := encodeDocument(doc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got, err := decodeDocument(b)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if got["int"] != int64(1)<<60 || got["float"] != 2.5 || got["bool"] != true {
+        t.Fatalf("Scalar types not preserved: %#v", got)
+    }
+    if v, ok := got["null"]; !ok || v != nil {
+        t.Fatalf("null not preserved: %#v", got["null"])
+    }
+    if tm, ok := got["when"].(time.Time); !ok || !tm.Equal(when) {
+        t.Fatalf("datetime not preserved: %#v", got["when"])
+    }
+    if string(got["bin"].([]byte)) != "\x01\x02\x03" {
+        t.Fatalf("binary not preserved: %#v", got["bin"])
+    }
+    arr := got["arr"].([]any)
+    if arr[0] != int64(1) || arr[2].(map[string]any)["three"] != 3.0 {
+        t.Fatalf("array not preserved: %#v", arr)
+    }
+}
+
+func TestLegacyJSONSegmentReadable(t *testing.T) {
+    dir := "./test_legacy_segment"
+    os.RemoveAll(dir)
+    defer os.RemoveAll(dir)
+
+    // Hand-write a version-1 (JSON) segment
+    segDir := filepath.Join(dir, "segments")
+    if err := os.MkdirAll(segDir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    f, err := os.Create(filepath.Join(segDir, "000000.seg"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    legacy := &Segment{ID: 0, Path: f.Name(), file: f, Version: SegmentVersionJSON}
+    if err := legacy.writeHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 5; i++ {
+        id := fmt.Sprintf("doc%d", i)
+        if err := legacy.Append(SegmentRecord{Type: RecordInsert, DocID: id, Data: types.Document{"_id": id, "n": i}}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    legacy.Close()
+
+    sm, err := NewSegmentManager(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sm.Close()
+
+    // New writes must go to a fresh binary segment
+    if err := sm.Append("doc9", types.Document{"_id": "doc9", "n": 9}); err != nil {
+        t.Fatal(err)
+    }
+    if sm.activeSegment.Version != SegmentVersion {
+        t.Fatalf("Active segment has version %d", sm.activeSegment.Version)
+    }
+
+    // Compaction rewrites the JSON segment in the binary format
+    if err := sm.Compact(); err != nil {
+        t.Fatal(err)
+    }
+    for _, seg := range sm.segments {
+        if seg.Version != SegmentVersion {
+            t.Fatalf("Segment %d still has version %d after compaction", seg.ID, seg.Version)
+        }
+    }
+
+    doc, ok, err := sm.Get("doc2")
+    if err != nil || !ok {
+        t.Fatalf("Get doc2: ok=%v err=%v", ok, err)
+    }
+    if doc["n"] != int64(2) {
+        t.Fatalf("Expected n=2 as int64 after rewrite, got %#v", doc["n"])
+    }
+    if sm.Count() != 6 {
+        t.Fatalf("Expected 6 docs, got %d", sm.Count())
+    }
+}
+
+func TestSealedSegmentCompression(t *testing.T) {
+    dir := "./test_compression"
+    os.RemoveAll(dir)
+    defer os.RemoveAll(dir)
+
+    sm, err := NewSegmentManagerWithOptions(dir, SegmentOptions{Compression: CompressionZlib, CompressionLevel: 6})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 2000; i++ {
+        id := fmt.Sprintf("doc%d", i)
+        doc := types.Document{"_id": id, "n": i, "text": "the quick brown fox jumps over the lazy dog"}
+        if err := sm.Append(id, doc); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Seal the active segment as if it had filled up
+    sm.mu.Lock()
+    sealed := sm.activeSegment
+    if err := sm.sealSegment(sealed); err != nil {
+        t.Fatal(err)
+    }
+    if err := sm.createNewSegment(); err != nil {
+        t.Fatal(err)
+    }
+    sm.mu.Unlock()
+
+    if sealed.Flags&SegmentFlagCompressed == 0 {
+        t.Fatal("Sealed segment was not compressed")
+    }
+    if len(sealed.footer.Blocks) < 2 {
+        t.Fatalf("Expected several blocks, got %d", len(sealed.footer.Blocks))
+    }
+    stats := sm.GetStats()
+    if ratio := stats["compression_ratio"].(float64); ratio <= 2 {
+        t.Fatalf("Expected compression ratio > 2, got %.2f", ratio)
+    }
+    sm.Close()
+
+    // What a crash during a rewrite leaves behind
+    tmp := sealed.Path + ".tmp"
+    if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    // Reopen: block index comes from the footer
+    sm, err = NewSegmentManager(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sm.Close()
+    if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+        t.Fatal("Leftover .seg.tmp should have been removed")
+    }
+
+    if sm.Count() != 2000 {
+        t.Fatalf("Expected 2000 docs, got %d", sm.Count())
+    }
+    doc, ok, err := sm.Get("doc1234")
+    if err != nil || !ok {
+        t.Fatalf("Get doc1234: ok=%v err=%v", ok, err)
+    }
+    if doc["n"] != int64(1234) {
+        t.Fatalf("Wrong doc: %v", doc)
+    }
+}
+
+func TestGroupCommitSharesFsync(t *testing.T) {
+    var syncs int32
+    gc := newGroupCommitter(WALSyncImmediate, 100, 0, 0, func() error {
+        atomic.AddInt32(&syncs, 1)
+        time.Sleep(2 * time.Millisecond)
+        return nil
+    })
+    defer gc.close()
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex // orders writes like SegmentManager.mu does
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            mu.Lock()
+            ticket := gc.noteWrite()
+            mu.Unlock()
+            if err := ticket.Wait(); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+
+    if n := atomic.LoadInt32(&syncs); n == 0 || n >= 50 {
+        t.Fatalf("Expected concurrent writers to share fsyncs, got %d fsyncs for 50 writes", n)
+    }
+    if gc.synced != gc.written {
+        t.Fatalf("Writes not durable: synced=%d written=%d", gc.synced, gc.written)
+    }
+}
+
+func TestManifestOrderAndOrphans(t *testing.T) {
+    dir := "./test_manifest"
+    os.RemoveAll(dir)
+    defer os.RemoveAll(dir)
+
+    sm, err := NewSegmentManager(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := sm.Append("doc1", types.Document{"_id": "doc1", "n": 1}); err != nil {
+        t.Fatal(err)
+    }
+    // Roll over so the next write lands in a newer segment
+    sm.mu.Lock()
+    if err := sm.sealSegment(sm.activeSegment); err != nil {
+        t.Fatal(err)
+    }
+    if err := sm.createNewSegment(); err != nil {
+        t.Fatal(err)
+    }
+    sm.mu.Unlock()
+    if err := sm.Append("doc1", types.Document{"_id": "doc1", "n": 2}); err != nil {
+        t.Fatal(err)
+    }
+    // The compacted segment gets a higher ID than the active one
+    if err := sm.Compact(); err != nil {
+        t.Fatal(err)
+    }
+    sm.Close()
+
+    // Leftovers of a crashed compaction: an unpublished segment and a temp file
+    segDir := filepath.Join(dir, "segments")
+    orphan, err := NewSegment(dir, 99)
+    if err != nil {
+        t.Fatal(err)
+    }
+    orphan.Append(SegmentRecord{Type: RecordInsert, DocID: "doc1", Data: types.Document{"_id": "doc1", "n": 99}})
+    orphan.Close()
+    if err := os.WriteFile(filepath.Join(segDir, "000005.seg.tmp"), []byte("partial"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    sm, err = NewSegmentManager(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sm.Close()
+
+    doc, ok, err := sm.Get("doc1")
+    if err != nil || !ok {
+        t.Fatalf("Get doc1: ok=%v err=%v", ok, err)
+    }
+    if doc["n"] != int64(2) {
+        t.Fatalf("Expected doc1 from the active segment, got %v", doc)
+    }
+    for _, name := range []string{"000099.seg", "000005.seg.tmp"} {
+        if _, err := os.Stat(filepath.Join(segDir, name)); !os.IsNotExist(err) {
+            t.Fatalf("Orphan %s should have been removed", name)
+        }
+    }
+    if sm.nextSegmentID <= 99 {
+        t.Fatalf("Segment IDs must not be reused, next is %d", sm.nextSegmentID)
+    }
+}
+
+// rollSegment seals the active segment and starts a new one, as a full
+// segment would.
+func rollSegment(t *testing.T, sm *SegmentManager) {
+    t.Helper()
+    sm.writeMu.Lock()
+    defer sm.writeMu.Unlock()
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+    if err := sm.sealSegment(sm.activeSegment); err != nil {
+        t.Fatal(err)
+    }
+    if err := sm.createNewSegment(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestPolicyCompaction(t *testing.T) {
+    dir := "./test_policy_compact"
+    os.RemoveAll(dir)
+    defer os.RemoveAll(dir)
+
+    sm, err := NewSegmentManager(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    put := func(id string, n int) {
+        if err := sm.Append(id, types.Document{"_id": id, "n": n}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Segment A: x plus ten docs that stay live
+    put("x", 0)
+    for i := 0; i < 10; i++ {
+        put(fmt.Sprintf("z%d", i), i)
+    }
+    rollSegment(t, sm)
+
+    // Segment B: deletes x, writes y* which segment C supersedes
+    if err := sm.Delete("x"); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 5; i++ {
+        put(fmt.Sprintf("y%d", i), i)
+    }
+    rollSegment(t, sm)
+
+    // Segment C
+    for i := 0; i < 5; i++ {
+        put(fmt.Sprintf("y%d", i), 100+i)
+    }
+    rollSegment(t, sm)
+
+    run, err := sm.MaybeCompact()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if run == nil || run.Reason != CompactionDeadSpace {
+        t.Fatalf("Expected a dead-space compaction, got %+v", run)
+    }
+    if len(run.Segments) != 1 || run.LiveDocs != 0 {
+        t.Fatalf("Expected only segment B to be merged, got %+v", run)
+    }
+    // Replay from disk: B's tombstone must survive, or x comes back from A
+    sm.mu.Lock()
+    sm.rebuildIndex()
+    sm.mu.Unlock()
+    if sm.Has("x") {
+        t.Fatal("x was resurrected by compaction")
+    }
+
+    // A, compacted B and C are now three small segments in the same tier
+    run, err = sm.MaybeCompact()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if run == nil || run.Reason != CompactionSizeTier || len(run.Segments) != 3 || run.LiveDocs != 15 {
+        t.Fatalf("Expected a size-tier compaction of 3 segments, got %+v", run)
+    }
+    if run, _ := sm.MaybeCompact(); run != nil {
+        t.Fatalf("Nothing should be left to compact, got %+v", run)
+    }
+
+    stats := sm.GetStats()["compaction"].(map[string]interface{})
+    if stats["runs"] != 2 || stats["reclaimed_bytes"].(int64) <= 0 {
+        t.Fatalf("Unexpected compaction stats: %v", stats)
+    }
+    sm.Close()
+
+    sm, err = NewSegmentManager(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sm.Close()
+
+    if sm.Has("x") {
+        t.Fatal("x was resurrected by compaction")
+    }
+    if sm.Count() != 15 {
+        t.Fatalf("Expected 15 live docs, got %d", sm.Count())
+    }
+    doc, _, _ := sm.Get("y3")
+    if doc["n"] != int64(103) {
+        t.Fatalf("Expected latest y3, got %v", doc)
+    }
+}
+
+func TestZoneMapPruning(t *testing.T) {
+    for _, codec := range []string{CompressionNone, CompressionFlate} {
+        dir := "./test_zone_map_" + codec
+        os.RemoveAll(dir)
+        defer os.RemoveAll(dir)
+
+        opts := DefaultSegmentOptions()
+        opts.Compression = codec
+        sm, err := NewSegmentManagerWithOptions(dir, opts)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        // Two sealed segments with disjoint ages, then the active one
+        for _, base := range []int{0, 100} {
+            for i := 0; i < 10; i++ {
+                id := fmt.Sprintf("u%d", base+i)
+                if err := sm.Append(id, types.Document{"_id": id, "age": base + i, "name": fmt.Sprintf("%c%d", 'a'+base/100, i)}); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            rollSegment(t, sm)
+        }
+        // Move u3 out of the first segment's range
+        if err := sm.Append("u3", types.Document{"_id": "u3", "age": 500, "name": "a3"}); err != nil {
+            t.Fatal(err)
+        }
+        sm.Close()
+
+        // Zone maps must come back from the footers
+        sm, err = NewSegmentManagerWithOptions(dir, opts)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        scan := func(filter map[string]any) ([]types.Document, int64) {
+            before := sm.pruned.Load()
+            docs, err := sm.Scan(filter)
+            if err != nil {
+                t.Fatal(err)
+            }
+            matched := make([]types.Document, 0)
+            for _, d := range docs {
+                if matchesFilter(d, filter) {
+                    matched = append(matched, d)
+                }
+            }
+            return matched, sm.pruned.Load() - before
+        }
+
+        docs, pruned := scan(map[string]any{"age": map[string]any{"$gt": 150}})
+        if len(docs) != 1 || pruned != 2 {
+            t.Fatalf("%s: $gt 150: got %d docs, pruned %d segments", codec, len(docs), pruned)
+        }
+        docs, pruned = scan(map[string]any{"age": map[string]any{"$lt": 50}})
+        if len(docs) != 9 || pruned != 1 {
+            t.Fatalf("%s: $lt 50: got %d docs, pruned %d segments", codec, len(docs), pruned)
+        }
+        docs, pruned = scan(map[string]any{"name": "b5"})
+        if len(docs) != 1 || pruned != 1 {
+            t.Fatalf("%s: name equality: got %d docs, pruned %d segments", codec, len(docs), pruned)
+        }
+        docs, pruned = scan(map[string]any{"_id": map[string]any{"$in": []any{"u104", "nope"}}})
+        if len(docs) != 1 || pruned < 1 {
+            t.Fatalf("%s: _id $in: got %d docs, pruned %d segments", codec, len(docs), pruned)
+        }
+        if _, pruned = scan(map[string]any{"missing": map[string]any{"$exists": true}}); pruned != 2 {
+            t.Fatalf("%s: $exists on unknown field pruned %d segments", codec, pruned)
+        }
+
+        seg := sm.GetStats()["segments"].([]map[string]interface{})[0]
+        if _, ok := seg["zone_map"]; !ok {
+            t.Fatalf("%s: sealed segment stats lack a zone map: %v", codec, seg)
+        }
+        sm.Close()
+    }
+}
+
+func TestScrubAndRepair(t *testing.T) {
+    dir := "./test_scrub"
+    os.RemoveAll(dir)
+    defer os.RemoveAll(dir)
+
+    opts := DefaultSegmentOptions()
+    opts.Compression = CompressionNone
+    sm, err := NewSegmentManagerWithOptions(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 10; i++ {
+        id := fmt.Sprintf("d%d", i)
+        if err := sm.Append(id, types.Document{"_id": id, "n": i}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    rollSegment(t, sm)
+    for i := 0; i < 5; i++ {
+        id := fmt.Sprintf("e%d", i)
+        if err := sm.Append(id, types.Document{"_id": id, "n": i}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    sealed := sm.segments[0]
+    badOffset := sm.index["d3"].offset
+    activePath := sm.activeSegment.Path
+    sm.Close()
+
+    // Flip a byte inside d3 and leave half a record at the end of the active segment
+    f, err := os.OpenFile(sealed.Path, os.O_RDWR, 0666)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.WriteAt([]byte{0xFF}, badOffset+8)
+    f.Close()
+    f, err = os.OpenFile(activePath, os.O_WRONLY|os.O_APPEND, 0666)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Write([]byte{200, 0, 0, 0, 1, 2, 3})
+    f.Close()
+
+    sm, err = NewSegmentManagerWithOptions(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    report, err := sm.Scrub(false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.CorruptRecords != 1 || report.Segments[0].Corrupt[0].Offset != badOffset {
+        t.Fatalf("Expected one corrupt record at %d, got %+v", badOffset, report.Segments)
+    }
+    if report.Segments[1].TruncatedBytes != 7 || len(report.Segments[1].Corrupt) != 0 {
+        t.Fatalf("Expected the torn tail to be truncated, got %+v", report.Segments[1])
+    }
+
+    report, err = sm.Scrub(true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(report.Quarantined) != 1 || report.Quarantined[0].ID != sealed.ID {
+        t.Fatalf("Expected segment %d to be quarantined, got %+v", sealed.ID, report.Quarantined)
+    }
+    if _, err := os.Stat(report.Quarantined[0].File); err != nil {
+        t.Fatalf("Quarantined file missing: %v", err)
+    }
+    if report, _ := sm.Scrub(false); report.CorruptRecords != 0 {
+        t.Fatalf("Collection still corrupt after repair: %+v", report.Segments)
+    }
+    sm.Close()
+
+    sm, err = NewSegmentManagerWithOptions(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sm.Count() != 14 || sm.Has("d3") {
+        t.Fatalf("Expected the 14 readable docs after repair, got %d", sm.Count())
+    }
+    // A segment that can't even be opened is quarantined at startup
+    broken := sm.segments[0].Path
+    sm.Close()
+    if err := os.WriteFile(broken, []byte("garbage"), 0666); err != nil {
+        t.Fatal(err)
+    }
+    sm, err = NewSegmentManagerWithOptions(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sm.Close()
+    report, _ = sm.Scrub(false)
+    if sm.Count() != 5 || len(report.Quarantined) != 1 {
+        t.Fatalf("Expected the unreadable segment to be quarantined, got %d docs, %+v", sm.Count(), report.Quarantined)
+    }
+}
+
+func TestMappedSealedSegments(t *testing.T) {
+    for _, codec := range []string{CompressionNone, CompressionFlate} {
+        dir := "./test_mmap_" + codec
+        os.RemoveAll(dir)
+        defer os.RemoveAll(dir)
+
+        opts := DefaultSegmentOptions()
+        opts.Compression = codec
+        opts.SyncMode = WALSyncAsync
+        sm, err := NewSegmentManagerWithOptions(dir, opts)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i := 0; i < 50; i++ {
+            id := fmt.Sprintf("m%d", i)
+            if err := sm.Append(id, types.Document{"_id": id, "n": i, "blob": []byte{byte(i), 1, 2}}); err != nil {
+                t.Fatal(err)
+            }
+            if i%20 == 19 {
+                rollSegment(t, sm)
+            }
+        }
+        sm.Close()
+
+        sm, err = NewSegmentManagerWithOptions(dir, opts)
+        if err != nil {
+            t.Fatal(err)
+        }
+        wantMapped := runtime.GOOS == "linux" || runtime.GOOS == "darwin"
+        for _, seg := range sm.segments {
+            if seg == sm.activeSegment {
+                if seg.mapped != nil {
+                    t.Fatalf("Active segment %d must not be mapped", seg.ID)
+                }
+            } else if (seg.mapped != nil) != wantMapped {
+                t.Fatalf("Segment %d mapped=%v, expected %v", seg.ID, seg.mapped != nil, wantMapped)
+            }
+        }
+
+        // Readers of sealed segments run alongside appends to the active one
+        var wg sync.WaitGroup
+        var failed atomic.Value
+        for r := 0; r < 4; r++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                for i := 0; i < 200; i++ {
+                    id := fmt.Sprintf("m%d", i%40)
+                    doc, ok, err := sm.Get(id)
+                    if err != nil || !ok || fmt.Sprint(doc["n"]) != fmt.Sprint(i%40) {
+                        failed.Store(fmt.Sprintf("Get(%s) = %v, %v, %v", id, doc, ok, err))
+                        return
+                    }
+                    if b, ok := doc["blob"].([]byte); !ok || len(b) != 3 || b[0] != byte(i%40) {
+                        failed.Store(fmt.Sprintf("Get(%s) blob = %v", id, doc["blob"]))
+                        return
+                    }
+                }
+            }()
+        }
+        for i := 50; i < 250; i++ {
+            id := fmt.Sprintf("m%d", i)
+            if err := sm.Append(id, types.Document{"_id": id, "n": i}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        wg.Wait()
+        if msg := failed.Load(); msg != nil {
+            t.Fatal(msg)
+        }
+
+        docs, err := sm.Scan(nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(docs) != 250 {
+            t.Fatalf("Expected 250 docs, got %d", len(docs))
+        }
+        sm.Close()
+    }
+}
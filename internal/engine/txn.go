@@ -0,0 +1,531 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"testDB/internal/types"
+)
+
+// ErrTxnConflict is returned by Commit when a document the transaction
+// read was changed by another writer before it committed.
+var ErrTxnConflict = errors.New("transaction conflict")
+
+// ErrTxnClosed is returned by the operations of a transaction that was
+// committed, aborted or timed out.
+var ErrTxnClosed = errors.New("transaction is not active")
+
+// Txn is a multi-document transaction across any number of collections.
+// Its writes are buffered until Commit, which stores them as a single WAL
+// entry; until then its reads see the committed documents with its own
+// writes on top.
+//
+// Concurrency control is optimistic: Commit checks, with every collection
+// involved locked, that each document the transaction read is still as it
+// was read, and fails with ErrTxnConflict otherwise. Documents a query
+// would match only because of a later commit are not tracked.
+type Txn struct {
+	ID string
+
+	e        *Engine
+	mu       sync.Mutex
+	done     bool
+	lastUsed atomic.Int64 // UnixNano of the last operation
+
+	reads  map[txnKey]types.Document // each document as first read; nil if absent
+	writes map[txnKey]types.Document // buffered images; nil for a delete
+	order  []txnKey                  // written documents, in first-write order
+}
+
+type txnKey struct {
+	db, coll, id string
+}
+
+// Begin starts a transaction. A transaction left without an operation for
+// cfg.TxnTimeout is aborted.
+func (e *Engine) Begin() *Txn {
+	t := &Txn{
+		ID:     NewObjectID(),
+		e:      e,
+		reads:  map[txnKey]types.Document{},
+		writes: map[txnKey]types.Document{},
+	}
+	t.lastUsed.Store(time.Now().UnixNano())
+
+	e.expireTxns()
+	e.txnMu.Lock()
+	e.txns[t.ID] = t
+	e.txnMu.Unlock()
+	return t
+}
+
+// Txn returns the open transaction with the given ID.
+func (e *Engine) Txn(id string) (*Txn, error) {
+	e.expireTxns()
+	e.txnMu.Lock()
+	defer e.txnMu.Unlock()
+	t, ok := e.txns[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTxnClosed, id)
+	}
+	return t, nil
+}
+
+// expireTxns aborts the transactions idle for longer than cfg.TxnTimeout.
+func (e *Engine) expireTxns() {
+	if e.cfg.TxnTimeout <= 0 {
+		return
+	}
+	var expired []*Txn
+	e.txnMu.Lock()
+	for _, t := range e.txns {
+		if t.idle() > e.cfg.TxnTimeout {
+			expired = append(expired, t)
+		}
+	}
+	e.txnMu.Unlock()
+
+	// t.mu is never taken under e.txnMu
+	for _, t := range expired {
+		t.Abort()
+	}
+}
+
+func (e *Engine) forgetTxn(t *Txn) {
+	e.txnMu.Lock()
+	delete(e.txns, t.ID)
+	e.txnMu.Unlock()
+}
+
+func (t *Txn) idle() time.Duration {
+	return time.Since(time.Unix(0, t.lastUsed.Load()))
+}
+
+// use locks t for an operation, failing if it is closed or has timed out.
+// On success the caller must unlock t.mu.
+func (t *Txn) use() error {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return ErrTxnClosed
+	}
+	if timeout := t.e.cfg.TxnTimeout; timeout > 0 && t.idle() > timeout {
+		t.discardLocked()
+		t.mu.Unlock()
+		t.e.forgetTxn(t)
+		return fmt.Errorf("%w: timed out after %s", ErrTxnClosed, timeout)
+	}
+	t.lastUsed.Store(time.Now().UnixNano())
+	return nil
+}
+
+func (t *Txn) discardLocked() {
+	t.done = true
+	t.reads, t.writes, t.order = nil, nil, nil
+}
+
+func (t *Txn) collection(dbName, collName string) (*Database, *Collection, error) {
+	db, err := t.e.getOrCreateDB(dbName)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := db.getOrCreateCollection(t.e.cfg, collName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, c, nil
+}
+
+func (t *Txn) writeLocked(key txnKey, img types.Document) {
+	if _, ok := t.writes[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.writes[key] = img
+}
+
+// viewLocked returns the documents of c that match filter as the
+// transaction sees them, and records the committed ones it read. Caller
+// must hold t.mu.
+func (t *Txn) viewLocked(db *Database, c *Collection, filter map[string]any) ([]types.Document, error) {
+	c.mu.RLock()
+	candidates, err := c.candidateDocsLocked(filter)
+	if err == nil {
+		candidates = append([]types.Document(nil), candidates...)
+	}
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []types.Document
+	seen := map[string]bool{}
+	for _, d := range candidates {
+		key := txnKey{db.Name, c.Name, fmt.Sprintf("%v", d["_id"])}
+		seen[key.id] = true
+		if img, ok := t.writes[key]; ok {
+			if img != nil && matchesFilter(img, filter) {
+				out = append(out, img)
+			}
+			continue
+		}
+		if matchesFilter(d, filter) {
+			if _, ok := t.reads[key]; !ok {
+				t.reads[key] = d
+			}
+			out = append(out, d)
+		}
+	}
+
+	// Documents the transaction wrote that storage doesn't offer
+	for _, key := range t.order {
+		if key.db != db.Name || key.coll != c.Name || seen[key.id] {
+			continue
+		}
+		if img := t.writes[key]; img != nil && matchesFilter(img, filter) {
+			out = append(out, img)
+		}
+	}
+	return out, nil
+}
+
+// Insert buffers the insert of doc and returns its _id. A duplicate _id is
+// reported now, and checked again on Commit.
+func (t *Txn) Insert(dbName, collName string, doc types.Document) (string, error) {
+	if err := t.use(); err != nil {
+		return "", err
+	}
+	defer t.mu.Unlock()
+
+	db, c, err := t.collection(dbName, collName)
+	if err != nil {
+		return "", err
+	}
+	if doc == nil {
+		return "", errors.New("data is required")
+	}
+
+	doc = canonicalizeDocument(doc)
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = NewObjectID()
+	}
+	if _, ok := doc["_created"]; !ok {
+		doc["_created"] = time.Now().Unix()
+	}
+	doc["_version"] = int64(1)
+	if err := enforceDocSizeLimit(doc, t.e.cfg.MaxDocBytes); err != nil {
+		return "", err
+	}
+
+	key := txnKey{db.Name, c.Name, fmt.Sprintf("%v", doc["_id"])}
+	if img, ok := t.writes[key]; ok {
+		if img != nil {
+			return "", fmt.Errorf("duplicate _id: %s", key.id)
+		}
+		// Re-inserting a committed document this transaction deleted
+		// commits as an update, so its version carries on
+		if read := t.reads[key]; read != nil {
+			doc["_version"] = DocVersion(read) + 1
+		}
+	} else {
+		c.mu.RLock()
+		_, exists, err := c.getDocLocked(key.id)
+		c.mu.RUnlock()
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("duplicate _id: %s", key.id)
+		}
+		if _, ok := t.reads[key]; !ok {
+			t.reads[key] = nil
+		}
+	}
+	t.writeLocked(key, doc)
+	return key.id, nil
+}
+
+// Update buffers update applied to the matching documents and returns how
+// many there were.
+func (t *Txn) Update(dbName, collName string, filter map[string]any, update map[string]any, multi bool) (int, error) {
+	if err := t.use(); err != nil {
+		return 0, err
+	}
+	defer t.mu.Unlock()
+
+	db, c, err := t.collection(dbName, collName)
+	if err != nil {
+		return 0, err
+	}
+	if update == nil {
+		return 0, errors.New("update is required")
+	}
+	docs, err := t.viewLocked(db, c, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	// Work out every new image before buffering any
+	var images []types.Document
+	for _, d := range docs {
+		nd := cloneDocument(d)
+		if err := applyUpdateOperators(nd, update); err != nil {
+			return 0, err
+		}
+		nd["_updated"] = time.Now().Unix()
+		// A transaction moves each document on by one version, however
+		// often it writes it
+		if _, own := t.writes[txnKey{db.Name, c.Name, fmt.Sprintf("%v", d["_id"])}]; !own {
+			nd["_version"] = DocVersion(d) + 1
+		}
+		if err := enforceDocSizeLimit(nd, t.e.cfg.MaxDocBytes); err != nil {
+			return 0, err
+		}
+		images = append(images, nd)
+		if !multi {
+			break
+		}
+	}
+	for _, nd := range images {
+		t.writeLocked(txnKey{db.Name, c.Name, fmt.Sprintf("%v", nd["_id"])}, nd)
+	}
+	return len(images), nil
+}
+
+// Delete buffers the delete of the matching documents and returns how many
+// there were.
+func (t *Txn) Delete(dbName, collName string, filter map[string]any, multi bool) (int, error) {
+	if err := t.use(); err != nil {
+		return 0, err
+	}
+	defer t.mu.Unlock()
+
+	db, c, err := t.collection(dbName, collName)
+	if err != nil {
+		return 0, err
+	}
+	docs, err := t.viewLocked(db, c, filter)
+	if err != nil {
+		return 0, err
+	}
+	if !multi && len(docs) > 1 {
+		docs = docs[:1]
+	}
+	for _, d := range docs {
+		t.writeLocked(txnKey{db.Name, c.Name, fmt.Sprintf("%v", d["_id"])}, nil)
+	}
+	return len(docs), nil
+}
+
+// Query is Engine.Query as the transaction sees the collection.
+func (t *Txn) Query(
+	dbName, collName string,
+	filter map[string]any,
+	sortSpec map[string]int,
+	limit, skip int,
+	projection map[string]int,
+) ([]types.Document, error) {
+	if err := t.use(); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+
+	db, c, err := t.collection(dbName, collName)
+	if err != nil {
+		return nil, err
+	}
+	out, err := t.viewLocked(db, c, filter)
+	if err != nil {
+		return nil, err
+	}
+	applySort(out, sortSpec)
+	out = applySkipLimit(out, skip, limit)
+	return applyProjection(out, projection), nil
+}
+
+// Abort discards the transaction's writes.
+func (t *Txn) Abort() error {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return ErrTxnClosed
+	}
+	t.discardLocked()
+	t.mu.Unlock()
+	t.e.forgetTxn(t)
+	return nil
+}
+
+// Commit applies the transaction's writes atomically, returning once they
+// are durable (see CommitWithConcern).
+func (t *Txn) Commit() error {
+	return t.CommitWithConcern(WriteConcernDefault)
+}
+
+// CommitWithConcern applies the transaction's writes atomically: they are
+// logged as one WAL entry and stored with every collection involved
+// locked, so no reader sees part of them. If a document the transaction
+// read has changed since, nothing is applied and the error wraps
+// ErrTxnConflict. If storing fails partway, the changes already stored
+// are undone before the error is returned. The transaction is closed
+// either way.
+func (t *Txn) CommitWithConcern(wc WriteConcern) error {
+	if err := t.use(); err != nil {
+		return err
+	}
+	tickets, err := t.commitLocked()
+	t.discardLocked()
+	t.mu.Unlock()
+	t.e.forgetTxn(t)
+	if err != nil {
+		return err
+	}
+
+	for _, ticket := range tickets {
+		if err := ticket.Wait(wc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Txn) commitLocked() ([]writeTicket, error) {
+	// Lock every collection involved, in a fixed order
+	colls := map[string]*Collection{}
+	var names []string
+	for _, keys := range []map[txnKey]types.Document{t.reads, t.writes} {
+		for key := range keys {
+			name := key.db + "/" + key.coll
+			if _, ok := colls[name]; ok {
+				continue
+			}
+			_, c, err := t.collection(key.db, key.coll)
+			if err != nil {
+				return nil, err
+			}
+			colls[name] = c
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		colls[name].mu.Lock()
+	}
+	defer func() {
+		for _, name := range names {
+			colls[name].mu.Unlock()
+		}
+	}()
+
+	for key, seen := range t.reads {
+		cur, exists, err := colls[key.db+"/"+key.coll].getDocLocked(key.id)
+		if err != nil {
+			return nil, err
+		}
+		if exists != (seen != nil) || (exists && !sameDocument(cur, seen)) {
+			return nil, fmt.Errorf("%w: %s/%s %s was changed by another writer", ErrTxnConflict, key.db, key.coll, key.id)
+		}
+	}
+
+	// Everything that can reject the commit is checked before it is
+	// logged. Two inserts of this commit can't share a unique value either.
+	type uniqueKey struct{ coll, field, val string }
+	claimed := map[uniqueKey]bool{}
+	var ops []WALEntry
+	var keys []txnKey // the document of each op
+	for _, key := range t.order {
+		img, before := t.writes[key], t.reads[key]
+		name := key.db + "/" + key.coll
+		switch {
+		case img != nil && before == nil:
+			for _, idx := range colls[name].Indexes {
+				if !idx.Unique {
+					continue
+				}
+				uk := uniqueKey{name, idx.Field, getIndexValue(img, idx.Field)}
+				if len(idx.Entries[uk.val]) > 0 || claimed[uk] {
+					return nil, fmt.Errorf("duplicate value for unique index: %s", idx.Field)
+				}
+				claimed[uk] = true
+			}
+			ops = append(ops, WALEntry{Op: "insert", DB: key.db, Collection: key.coll, Doc: img})
+		case img != nil:
+			ops = append(ops, WALEntry{Op: "update", DB: key.db, Collection: key.coll, IDs: []string{key.id}, Docs: []types.Document{img}})
+		case before != nil:
+			ops = append(ops, WALEntry{Op: "delete", DB: key.db, Collection: key.coll, IDs: []string{key.id}})
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	lsn, walTicket, err := t.e.logWrite(true, WALEntry{TS: time.Now().Unix(), Op: "txn", Ops: ops})
+	if err != nil {
+		return nil, err
+	}
+	stored := false
+	defer func() { t.e.settleWrite(lsn, stored) }()
+
+	// The last append to each collection covers the earlier ones
+	stores := map[*Collection]commitTicket{}
+	for i, op := range ops {
+		c := colls[op.DB+"/"+op.Collection]
+		var ticket commitTicket
+		switch op.Op {
+		case "insert":
+			ticket, err = c.putDocLocked(op.Doc, lsn)
+		case "update":
+			ticket, err = c.putDocLocked(op.Docs[0], lsn)
+		case "delete":
+			_, ticket, err = c.removeDocLocked(op.IDs[0], lsn)
+		}
+		if err != nil {
+			// The abort is logged first so that the undo, stamped with
+			// its LSN, is never older than the changes it undoes
+			abortLSN, abortErr := t.e.abortWrite(lsn)
+			if abortErr != nil {
+				return nil, fmt.Errorf("%w (logging the abort: %v)", err, abortErr)
+			}
+			if rbErr := t.rollbackLocked(colls, keys[:i], abortLSN); rbErr != nil {
+				return nil, fmt.Errorf("%w (rolling back: %v)", err, rbErr)
+			}
+			return nil, err
+		}
+		stores[c] = ticket
+	}
+
+	stored = true
+	tickets := []writeTicket{{wal: walTicket}}
+	for _, ticket := range stores {
+		tickets = append(tickets, writeTicket{store: ticket})
+	}
+	return tickets, nil
+}
+
+// rollbackLocked puts the documents of keys, applied by a commit that
+// failed partway, back as the transaction read them, latest first. The
+// undo is stored at lsn, the commit's abort entry, so replay keeps it.
+// Caller must hold the lock of every collection involved.
+func (t *Txn) rollbackLocked(colls map[string]*Collection, keys []txnKey, lsn int64) error {
+	var firstErr error
+	for i := len(keys) - 1; i >= 0; i-- {
+		key := keys[i]
+		c := colls[key.db+"/"+key.coll]
+		var err error
+		if before := t.reads[key]; before != nil {
+			_, err = c.putDocLocked(before, lsn)
+		} else {
+			_, _, err = c.removeDocLocked(key.id, lsn)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
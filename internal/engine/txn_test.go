@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"testDB/internal/types"
+)
+
+// openAccounts opens an engine holding the accounts of alice (100) and
+// bob (0).
+func openAccounts(t *testing.T) (*Engine, Config) {
+	t.Helper()
+	cfg := testConfig(t)
+	e := openTestEngine(t, cfg)
+	insertAll(t, e, "accounts",
+		types.Document{"_id": "alice", "balance": 100},
+		types.Document{"_id": "bob", "balance": 0},
+	)
+	return e, cfg
+}
+
+func TestTransactions(t *testing.T) {
+	dec := map[string]any{"$inc": map[string]any{"balance": -30}}
+	inc := map[string]any{"$inc": map[string]any{"balance": 30}}
+
+	t.Run("commit", func(t *testing.T) {
+		e, _ := openAccounts(t)
+		before := e.walv2.LastSequence()
+
+		// A transfer: writes are buffered, visible to the transaction only
+		txn := e.Begin()
+		if n, err := txn.Update("db", "accounts", map[string]any{"_id": "alice"}, dec, false); err != nil || n != 1 {
+			t.Fatalf("Update in transaction: %d, %v", n, err)
+		}
+		txn.Update("db", "accounts", map[string]any{"_id": "bob"}, inc, false)
+		if _, err := txn.Insert("db", "ledger", types.Document{"_id": "t1", "amount": 30}); err != nil {
+			t.Fatal(err)
+		}
+		if docs, _ := txn.Query("db", "accounts", map[string]any{"balance": 30}, nil, 0, 0, nil); len(docs) != 1 || docs[0]["_id"] != "bob" {
+			t.Fatalf("Transaction doesn't see its own writes: %v", docs)
+		}
+		if len(queryAll(t, e, "accounts", map[string]any{"balance": 30})) != 0 || len(queryAll(t, e, "ledger", nil)) != 0 {
+			t.Fatal("Uncommitted writes are visible outside the transaction")
+		}
+
+		if err := txn.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if e.walv2.LastSequence() != before+1 {
+			t.Fatalf("Expected one WAL entry for the transaction, got %d", e.walv2.LastSequence()-before)
+		}
+		if len(queryAll(t, e, "accounts", map[string]any{"balance": 70})) != 1 ||
+			len(queryAll(t, e, "accounts", map[string]any{"balance": 30})) != 1 ||
+			len(queryAll(t, e, "ledger", nil)) != 1 {
+			t.Fatal("Committed transaction not applied")
+		}
+		if _, err := txn.Insert("db", "ledger", types.Document{}); !errors.Is(err, ErrTxnClosed) {
+			t.Fatalf("Expected a committed transaction to be closed, got %v", err)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		e, _ := openAccounts(t)
+
+		// A document changed after the transaction read it
+		txn := e.Begin()
+		txn.Update("db", "accounts", map[string]any{"_id": "alice"}, dec, false)
+		txn.Insert("db", "ledger", types.Document{"_id": "t2"})
+		e.Update("db", "accounts", map[string]any{"_id": "alice"}, map[string]any{"$set": map[string]any{"frozen": true}}, false, true)
+		if err := txn.Commit(); !errors.Is(err, ErrTxnConflict) {
+			t.Fatalf("Expected a conflict, got %v", err)
+		}
+		if len(queryAll(t, e, "ledger", nil)) != 0 || len(queryAll(t, e, "accounts", map[string]any{"balance": 100})) != 1 {
+			t.Fatal("A conflicting transaction was partly applied")
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		e, _ := openAccounts(t)
+
+		txn := e.Begin()
+		txn.Delete("db", "accounts", nil, true)
+		if err := txn.Abort(); err != nil {
+			t.Fatal(err)
+		}
+		if len(queryAll(t, e, "accounts", nil)) != 2 {
+			t.Fatal("Aborted delete was applied")
+		}
+		if _, err := e.Txn(txn.ID); !errors.Is(err, ErrTxnClosed) {
+			t.Fatalf("Expected an aborted transaction to be gone, got %v", err)
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		e, _ := openAccounts(t)
+		e.cfg.TxnTimeout = time.Millisecond
+
+		idle := e.Begin()
+		time.Sleep(5 * time.Millisecond)
+		if _, err := idle.Query("db", "accounts", nil, nil, 0, 0, nil); !errors.Is(err, ErrTxnClosed) {
+			t.Fatalf("Expected an idle transaction to time out, got %v", err)
+		}
+	})
+
+	// Replay applies a logged transaction whole, and a torn one not at all
+	for _, tc := range []struct {
+		name    string
+		torn    bool
+		applied bool
+	}{
+		{name: "replay", applied: true},
+		{name: "replay torn entry", torn: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, cfg := openAccounts(t)
+			ops := []WALEntry{
+				{Op: "insert", DB: "db", Collection: "ledger", Doc: types.Document{"_id": "t3"}},
+				{Op: "delete", DB: "db", Collection: "accounts", IDs: []string{"bob"}},
+			}
+			if _, _, err := e.walv2.Append(WALEntry{Op: "txn", Ops: ops}); err != nil {
+				t.Fatal(err)
+			}
+			if tc.torn {
+				active := e.walv2.files[len(e.walv2.files)-1].path
+				info, _ := os.Stat(active)
+				if err := os.Truncate(active, info.Size()-3); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			e = openTestEngine(t, cfg)
+			ledger := len(queryAll(t, e, "ledger", map[string]any{"_id": "t3"}))
+			bob := len(queryAll(t, e, "accounts", map[string]any{"_id": "bob"}))
+			if tc.applied && (ledger != 1 || bob != 0) {
+				t.Fatal("Logged transaction not replayed")
+			}
+			if !tc.applied && (ledger != 0 || bob != 1) {
+				t.Fatal("Torn transaction entry was partly replayed")
+			}
+		})
+	}
+}
+
+func TestTxnCommitIsAllOrNothing(t *testing.T) {
+	t.Run("unique values claimed within the commit", func(t *testing.T) {
+		e, _ := openAccounts(t)
+		db, _ := e.getOrCreateDB("db")
+		ledger, _ := db.getOrCreateCollection(e.cfg, "ledger")
+		ledger.Indexes = map[string]*Index{"ref": {Field: "ref", Unique: true, Entries: map[string][]string{}}}
+
+		txn := e.Begin()
+		txn.Insert("db", "ledger", types.Document{"_id": "t1", "ref": "r1"})
+		txn.Insert("db", "ledger", types.Document{"_id": "t2", "ref": "r1"})
+		before := e.walv2.LastSequence()
+		if err := txn.Commit(); err == nil {
+			t.Fatal("Expected the second insert of r1 to be rejected")
+		}
+		if e.walv2.LastSequence() != before || len(queryAll(t, e, "ledger", nil)) != 0 {
+			t.Fatal("A rejected transaction was logged or applied")
+		}
+	})
+
+	t.Run("store failure rolls back", func(t *testing.T) {
+		e, cfg := openAccounts(t)
+		insertAll(t, e, "ledger", types.Document{"_id": "t0"})
+		db, _ := e.getOrCreateDB("db")
+		ledger, _ := db.getOrCreateCollection(e.cfg, "ledger")
+
+		txn := e.Begin()
+		txn.Update("db", "accounts", map[string]any{"_id": "alice"}, map[string]any{"$inc": map[string]any{"balance": -30}}, false)
+		txn.Delete("db", "accounts", map[string]any{"_id": "bob"}, false)
+		txn.Insert("db", "accounts", types.Document{"_id": "carol", "balance": 30})
+		txn.Insert("db", "ledger", types.Document{"_id": "t1"})
+
+		// Appends to the ledger fail
+		seg := ledger.segmentMgr.activeSegment
+		seg.mu.Lock()
+		seg.Sealed = true
+		seg.mu.Unlock()
+		err := txn.Commit()
+		seg.mu.Lock()
+		seg.Sealed = false
+		seg.mu.Unlock()
+		if err == nil {
+			t.Fatal("Expected the commit to fail")
+		}
+
+		for _, tc := range []struct {
+			filter map[string]any
+			want   int
+		}{
+			{map[string]any{"_id": "alice", "balance": 100}, 1},
+			{map[string]any{"_id": "bob"}, 1},
+			{map[string]any{"_id": "carol"}, 0},
+			{map[string]any{"balance": 30}, 0},
+		} {
+			if got := len(queryAll(t, e, "accounts", tc.filter)); got != tc.want {
+				t.Fatalf("%v: expected %d documents after the rollback, got %d", tc.filter, tc.want, got)
+			}
+		}
+
+		// Restart as after a crash: replay leaves the failed commit out
+		e2 := openTestEngine(t, cfg)
+		for _, tc := range []struct {
+			coll   string
+			filter map[string]any
+			want   int
+		}{
+			{"accounts", map[string]any{"_id": "alice", "balance": 100}, 1},
+			{"accounts", map[string]any{"_id": "bob"}, 1},
+			{"accounts", map[string]any{"_id": "carol"}, 0},
+			{"ledger", map[string]any{"_id": "t1"}, 0},
+		} {
+			if got := len(queryAll(t, e2, tc.coll, tc.filter)); got != tc.want {
+				t.Fatalf("%s %v: expected %d documents after the restart, got %d", tc.coll, tc.filter, tc.want, got)
+			}
+		}
+	})
+}
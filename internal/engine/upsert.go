@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"testDB/internal/types"
+)
+
+// Upsert is UpdateWithConcern, except that when nothing matches filter it
+// inserts a document instead: the fields filter pins to a value, with
+// update applied on top, $setOnInsert included. It returns how many
+// documents were updated and the _id of the one inserted, if any. Matching
+// and inserting happen under one collection lock, so concurrent upserts of
+// the same filter never insert twice.
+func (e *Engine) Upsert(dbName, collName string, filter map[string]any, update map[string]any, multi bool, wc WriteConcern) (int, string, error) {
+	db, err := e.getOrCreateDB(dbName)
+	if err != nil {
+		return 0, "", err
+	}
+	c, err := db.getOrCreateCollection(e.cfg, collName)
+	if err != nil {
+		return 0, "", err
+	}
+	if update == nil {
+		return 0, "", errors.New("update is required")
+	}
+
+	c.mu.Lock()
+	images, ticket, err := e.updateLocked(db, c, filter, update, multi, nil, true)
+	var inserted types.Document
+	if err == nil && len(images) == 0 {
+		inserted, ticket, err = e.upsertLocked(db, c, filter, update, true)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return 0, "", err
+	}
+	if err := ticket.Wait(wc); err != nil {
+		return 0, "", err
+	}
+	if inserted != nil {
+		return 0, fmt.Sprintf("%v", inserted["_id"]), nil
+	}
+	return len(images), "", nil
+}
+
+// upsertLocked inserts the document an upsert creates when nothing matched
+// filter, and returns it. Caller must hold c.mu and wait on the returned
+// ticket after releasing it.
+func (e *Engine) upsertLocked(db *Database, c *Collection, filter map[string]any, update map[string]any, doLog bool) (types.Document, writeTicket, error) {
+	doc, err := upsertDocument(filter, update)
+	if err != nil {
+		return nil, writeTicket{}, err
+	}
+	if err := enforceDocSizeLimit(doc, e.cfg.MaxDocBytes); err != nil {
+		return nil, writeTicket{}, err
+	}
+	_, ticket, err := e.insertLocked(db, c, doc, doLog)
+	if err != nil {
+		return nil, writeTicket{}, err
+	}
+	return doc, ticket, nil
+}
+
+// upsertDocument builds the document an upsert inserts: the equality
+// fields of filter, with update and its $setOnInsert applied.
+func upsertDocument(filter map[string]any, update map[string]any) (types.Document, error) {
+	seed := types.Document{}
+	seedFromFilter(seed, filter)
+	doc := canonicalizeDocument(seed) // copies, so update can't reach into filter
+
+	if err := applyUpdateOperators(doc, update); err != nil {
+		return nil, err
+	}
+	if m, ok := update["$setOnInsert"].(map[string]any); ok {
+		for k, v := range m {
+			setNestedField(doc, k, v)
+		}
+	}
+	return canonicalizeDocument(doc), nil
+}
+
+// seedFromFilter copies into doc the fields filter pins to a single value:
+// plain equalities and $eq, including those under $and.
+func seedFromFilter(doc types.Document, filter map[string]any) {
+	for k, v := range filter {
+		if k == "$and" {
+			items, _ := v.([]any)
+			for _, item := range items {
+				if m, ok := item.(map[string]any); ok {
+					seedFromFilter(doc, m)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		// As in matchesFilter, an object value holds operators
+		if m, ok := v.(map[string]any); ok {
+			if eq, ok := m["$eq"]; ok {
+				setNestedField(doc, k, eq)
+			}
+			continue
+		}
+		setNestedField(doc, k, v)
+	}
+}
+
+// FindAndModifyOptions selects the document FindAndModify changes, the
+// change, and what it returns.
+type FindAndModifyOptions struct {
+	Filter     map[string]any
+	Sort       map[string]int // the first match in this order is the one changed
+	Update     map[string]any
+	Remove     bool           // delete the document instead of updating it
+	Upsert     bool           // insert as Upsert does when nothing matches
+	New        bool           // return the document after the change, not before
+	Projection map[string]int // applied to the returned document
+}
+
+// FindAndModify updates or removes the first document matching
+// opts.Filter, in opts.Sort order, and returns it as it was before the
+// change, or after it with opts.New. Finding and changing the document
+// happen under one collection lock, so no other write comes between them.
+// The document is nil when nothing matched, and for the pre-image of an
+// upsert that inserted.
+func (e *Engine) FindAndModify(dbName, collName string, opts FindAndModifyOptions, wc WriteConcern) (types.Document, error) {
+	db, err := e.getOrCreateDB(dbName)
+	if err != nil {
+		return nil, err
+	}
+	c, err := db.getOrCreateCollection(e.cfg, collName)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Remove == (opts.Update != nil) {
+		return nil, errors.New("exactly one of update and remove is required")
+	}
+	if opts.Remove && opts.Upsert {
+		return nil, errors.New("upsert requires update")
+	}
+
+	c.mu.Lock()
+	before, after, ticket, err := e.findAndModifyLocked(db, c, opts)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := ticket.Wait(wc); err != nil {
+		return nil, err
+	}
+
+	doc := before
+	if opts.New {
+		doc = after
+	}
+	if doc == nil {
+		return nil, nil
+	}
+	return applyProjection([]types.Document{doc}, opts.Projection)[0], nil
+}
+
+// findAndModifyLocked applies opts to the first match and returns the
+// document before and after. Caller must hold c.mu and wait on the
+// returned ticket after releasing it.
+func (e *Engine) findAndModifyLocked(db *Database, c *Collection, opts FindAndModifyOptions) (types.Document, types.Document, writeTicket, error) {
+	candidates, err := c.candidateDocsLocked(opts.Filter)
+	if err != nil {
+		return nil, nil, writeTicket{}, err
+	}
+	var matches []types.Document
+	for _, d := range candidates {
+		if matchesFilter(d, opts.Filter) {
+			matches = append(matches, d)
+		}
+	}
+
+	if len(matches) == 0 {
+		if !opts.Upsert {
+			return nil, nil, writeTicket{}, nil
+		}
+		after, ticket, err := e.upsertLocked(db, c, opts.Filter, opts.Update, true)
+		return nil, after, ticket, err
+	}
+
+	applySort(matches, opts.Sort)
+	before := matches[0]
+	byID := map[string]any{"_id": before["_id"]}
+	if opts.Remove {
+		_, ticket, err := e.deleteLocked(db, c, byID, false, nil, true)
+		return before, nil, ticket, err
+	}
+	images, ticket, err := e.updateLocked(db, c, byID, opts.Update, false, nil, true)
+	if err != nil || len(images) == 0 {
+		return nil, nil, writeTicket{}, err
+	}
+	return before, images[0], ticket, nil
+}
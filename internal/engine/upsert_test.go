@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"testDB/internal/types"
+)
+
+func TestUpsert(t *testing.T) {
+	e := openTestEngine(t, testConfig(t))
+	filter := map[string]any{"name": "hits", "region": map[string]any{"$eq": "eu"}, "n": map[string]any{"$gt": 0}}
+	update := map[string]any{
+		"$inc":         map[string]any{"n": 1},
+		"$setOnInsert": map[string]any{"created_by": "upsert"},
+	}
+
+	t.Run("insert seeds from the filter", func(t *testing.T) {
+		n, id, err := e.Upsert("db", "counters", filter, update, false, WriteConcernDefault)
+		if err != nil || n != 0 || id == "" {
+			t.Fatalf("Upsert insert: %d, %q, %v", n, id, err)
+		}
+		docs := queryAll(t, e, "counters", map[string]any{"_id": id})
+		if len(docs) != 1 || docs[0]["name"] != "hits" || docs[0]["region"] != "eu" || fmt.Sprint(docs[0]["n"]) != "1" || docs[0]["created_by"] != "upsert" {
+			t.Fatalf("Unexpected upserted document: %v", docs)
+		}
+	})
+
+	t.Run("update leaves $setOnInsert alone", func(t *testing.T) {
+		e.Update("db", "counters", map[string]any{"name": "hits"}, map[string]any{"$set": map[string]any{"created_by": "someone"}}, false, true)
+		if n, id, err := e.Upsert("db", "counters", filter, update, false, WriteConcernDefault); err != nil || n != 1 || id != "" {
+			t.Fatalf("Upsert update: %d, %q, %v", n, id, err)
+		}
+		docs := queryAll(t, e, "counters", map[string]any{"name": "hits"})
+		if len(docs) != 1 || fmt.Sprint(docs[0]["n"]) != "2" || docs[0]["created_by"] != "someone" {
+			t.Fatalf("Unexpected document after the second upsert: %v", docs)
+		}
+	})
+
+	t.Run("concurrent upserts insert once", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, _, err := e.Upsert("db", "counters", map[string]any{"name": "race"}, map[string]any{"$inc": map[string]any{"n": 1}}, false, WriteConcernDefault); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if docs := queryAll(t, e, "counters", map[string]any{"name": "race"}); len(docs) != 1 || fmt.Sprint(docs[0]["n"]) != "8" {
+			t.Fatalf("Expected one document counted to 8, got %v", docs)
+		}
+	})
+}
+
+func TestFindAndModify(t *testing.T) {
+	e := openTestEngine(t, testConfig(t))
+	for i, p := range []int{3, 1, 2} {
+		insertAll(t, e, "jobs", types.Document{"_id": fmt.Sprintf("job%d", i), "priority": p, "state": "queued"})
+	}
+	claim := FindAndModifyOptions{
+		Filter: map[string]any{"state": "queued"},
+		Sort:   map[string]int{"priority": -1},
+		Update: map[string]any{"$set": map[string]any{"state": "running"}},
+	}
+	claimNew := claim
+	claimNew.New = true
+	claimNew.Projection = map[string]int{"_id": 1, "state": 1}
+	remove := FindAndModifyOptions{Filter: map[string]any{"state": "queued"}, Remove: true}
+
+	// Each step runs on the jobs the previous ones left; want holds the
+	// fields of the returned document, nil for no match
+	for _, step := range []struct {
+		name string
+		opts FindAndModifyOptions
+		want map[string]any
+	}{
+		{"sort picks the pre-image", claim, map[string]any{"_id": "job0", "state": "queued"}},
+		{"projected post-image", claimNew, map[string]any{"_id": "job2", "state": "running", "priority": nil}},
+		{"remove", remove, map[string]any{"_id": "job1"}},
+		{"no match", remove, nil},
+		{"upsert", FindAndModifyOptions{
+			Filter: map[string]any{"_id": "job9"},
+			Update: map[string]any{"$set": map[string]any{"state": "queued"}},
+			Upsert: true,
+			New:    true,
+		}, map[string]any{"_id": "job9", "_version": 1}},
+	} {
+		t.Run(step.name, func(t *testing.T) {
+			doc, err := e.FindAndModify("db", "jobs", step.opts, WriteConcernDefault)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (doc == nil) != (step.want == nil) {
+				t.Fatalf("Expected %v, got %v", step.want, doc)
+			}
+			for k, v := range step.want {
+				if fmt.Sprint(doc[k]) != fmt.Sprint(v) {
+					t.Fatalf("Expected %s %v, got %v", k, v, doc)
+				}
+			}
+		})
+	}
+}
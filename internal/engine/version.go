@@ -0,0 +1,36 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+
+	"testDB/internal/types"
+)
+
+// Every stored document carries a _version: 1 when inserted, one more on
+// each update. A client that read version n can make its update or delete
+// conditional on the document still being at n, so a concurrent change
+// isn't silently overwritten.
+
+// ErrVersionConflict is returned by a conditional write when the document
+// is no longer at the version the caller expected.
+var ErrVersionConflict = errors.New("version conflict")
+
+// DocVersion returns the _version of doc. Documents stored before versions
+// were kept count as version 0.
+func DocVersion(doc types.Document) int64 {
+	n, _ := toNumber(doc["_version"])
+	return int64(n)
+}
+
+// checkVersion fails with ErrVersionConflict unless doc is at *version.
+// A nil version makes the write unconditional.
+func checkVersion(doc types.Document, version *int64) error {
+	if version == nil {
+		return nil
+	}
+	if cur := DocVersion(doc); cur != *version {
+		return fmt.Errorf("%w: %v is at version %d, not %d", ErrVersionConflict, doc["_id"], cur, *version)
+	}
+	return nil
+}
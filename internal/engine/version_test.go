@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"testDB/internal/types"
+)
+
+func TestDocumentVersions(t *testing.T) {
+	cfg := testConfig(t)
+	e := openTestEngine(t, cfg)
+	version := func(t *testing.T, id string) int64 {
+		t.Helper()
+		docs := queryAll(t, e, "docs", map[string]any{"_id": id})
+		if len(docs) != 1 {
+			t.Fatalf("Expected one document %s, got %v", id, docs)
+		}
+		return DocVersion(docs[0])
+	}
+	set := func(v any) map[string]any { return map[string]any{"$set": map[string]any{"v": v}} }
+	a := map[string]any{"_id": "a"}
+
+	// Each step runs on the document the previous ones left: a client
+	// can't choose the version, every write moves it on by one, and of two
+	// clients that read the same version the second write loses
+	for _, step := range []struct {
+		name    string
+		write   func() error
+		wantErr error
+		want    int64
+	}{
+		{
+			name: "insert",
+			write: func() error {
+				_, err := e.Insert("db", "docs", types.Document{"_id": "a", "_version": 7}, true)
+				return err
+			},
+			want: 1,
+		},
+		{
+			name: "update",
+			write: func() error {
+				_, err := e.Update("db", "docs", a, set(1), false, true)
+				return err
+			},
+			want: 2,
+		},
+		{
+			name: "update at the version read",
+			write: func() error {
+				_, err := e.UpdateIfVersion("db", "docs", a, set(2), 2, WriteConcernDefault)
+				return err
+			},
+			want: 3,
+		},
+		{
+			name: "stale update",
+			write: func() error {
+				_, err := e.UpdateIfVersion("db", "docs", a, set(3), 2, WriteConcernDefault)
+				return err
+			},
+			wantErr: ErrVersionConflict,
+			want:    3,
+		},
+		{
+			// No version a client sends makes the write unconditional
+			name: "negative version",
+			write: func() error {
+				_, err := e.UpdateIfVersion("db", "docs", a, set(3), -1, WriteConcernDefault)
+				return err
+			},
+			wantErr: ErrVersionConflict,
+			want:    3,
+		},
+		{
+			name: "stale delete",
+			write: func() error {
+				_, err := e.DeleteIfVersion("db", "docs", a, 2, WriteConcernDefault)
+				return err
+			},
+			wantErr: ErrVersionConflict,
+			want:    3,
+		},
+	} {
+		t.Run(step.name, func(t *testing.T) {
+			if err := step.write(); !errors.Is(err, step.wantErr) {
+				t.Fatalf("Expected %v, got %v", step.wantErr, err)
+			}
+			if v := version(t, "a"); v != step.want {
+				t.Fatalf("Expected version %d, got %d", step.want, v)
+			}
+		})
+	}
+	if n, err := e.DeleteIfVersion("db", "docs", a, 3, WriteConcernDefault); err != nil || n != 1 {
+		t.Fatalf("Conditional delete: %d, %v", n, err)
+	}
+
+	t.Run("delete and re-insert in a transaction", func(t *testing.T) {
+		insertAll(t, e, "docs", types.Document{"_id": "c"})
+		e.Update("db", "docs", map[string]any{"_id": "c"}, set(1), false, true)
+		txn := e.Begin()
+		txn.Delete("db", "docs", map[string]any{"_id": "c"}, false)
+		if _, err := txn.Insert("db", "docs", types.Document{"_id": "c", "v": "new"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := txn.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if v := version(t, "c"); v != 3 {
+			t.Fatalf("Expected the re-inserted document to go on to version 3, got %d", v)
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		// A transaction bumps each document once; versions survive a restart
+		insertAll(t, e, "docs", types.Document{"_id": "b"})
+		txn := e.Begin()
+		txn.Update("db", "docs", map[string]any{"_id": "b"}, set(1), false)
+		txn.Update("db", "docs", map[string]any{"_id": "b"}, set(2), false)
+		if err := txn.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		e = openTestEngine(t, cfg)
+		if v := version(t, "b"); v != 2 {
+			t.Fatalf("Expected version 2 after a transaction and a restart, got %d", v)
+		}
+	})
+}
@@ -4,16 +4,65 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
 	"strings"
+	"time"
+
+	"testDB/internal/types"
 )
 
 
-func (e *Engine) walAppend(entry WALEntry) error {
+func (e *Engine) walAppend(entry WALEntry) (int64, commitTicket, error) {
 	if e.replaying {
-		return nil
+		return 0, commitTicket{}, nil
+	}
+	return e.walv2.appendUnsettled(entry)
+}
+
+// logWrite logs a change ahead of applying it and returns the entry's LSN,
+// or 0 when nothing is logged (doLog unset, or during replay), with the
+// ticket that tells when the entry is durable. A change that can't be
+// logged must not be applied. Once the change is stored, or has failed,
+// the caller must report which with settleWrite, still holding the locks
+// it was stored under.
+func (e *Engine) logWrite(doLog bool, entry WALEntry) (int64, commitTicket, error) {
+	if !doLog {
+		return 0, commitTicket{}, nil
+	}
+	return e.walAppend(entry)
+}
+
+// failWrite logs an abort for the write logged at lsn, which failed with
+// err before it was stored, and returns err once the abort is as durable
+// as the write would have been. Replay leaves an aborted write out, so a
+// write reported as failed doesn't come back after a restart.
+func (e *Engine) failWrite(lsn int64, err error) error {
+	if lsn == 0 {
+		return err
+	}
+	if _, abortErr := e.abortWrite(lsn); abortErr != nil {
+		return fmt.Errorf("%w (logging the abort: %v)", err, abortErr)
+	}
+	return err
+}
+
+// abortWrite logs an abort for the write logged at lsn and returns the
+// abort's own LSN once it is durable.
+func (e *Engine) abortWrite(lsn int64) (int64, error) {
+	abortLSN, ticket, err := e.walv2.Append(WALEntry{TS: time.Now().Unix(), Op: "abort", Aborts: lsn})
+	if err != nil {
+		return 0, err
+	}
+	return abortLSN, ticket.Wait()
+}
+
+// settleWrite tells change streams whether the change logged at lsn by
+// logWrite was stored.
+func (e *Engine) settleWrite(lsn int64, stored bool) {
+	if lsn > 0 {
+		e.walv2.Settle(lsn, stored)
 	}
-	return e.walv2.Append(entry)
 }
 
 func (e *Engine) replayWAL() error {
@@ -86,17 +135,21 @@ func (e *Engine) replayWALv2() error {
 		return err
 	}
 
+	applied, skipped := 0, 0
 	for _, entry := range entries {
-		switch entry.Op {
-		case "insert":
-			// Insert already checks docExistsInSegments when e.replaying == true,
-			// so duplicates from snapshot + WAL overlap are safely skipped.
-			_, _ = e.Insert(entry.DB, entry.Collection, entry.Doc, false)
-		case "update":
-			_, _ = e.Update(entry.DB, entry.Collection, entry.Filter, entry.Update, entry.Multi, false)
-		case "delete":
-			_, _ = e.Delete(entry.DB, entry.Collection, entry.Filter, entry.Multi, false)
+		n, err := e.replayEntry(entry)
+		if err != nil {
+			fmt.Printf("⚠️  WAL entry %d (%s %s/%s) not replayed: %v\n", entry.Sequence, entry.Op, entry.DB, entry.Collection, err)
+			continue
 		}
+		if n > 0 {
+			applied++
+		} else {
+			skipped++
+		}
+	}
+	if len(entries) > 0 {
+		fmt.Printf("✅ WAL replay: %d entries applied, %d already in storage\n", applied, skipped)
 	}
 
 	e.replaying = false
@@ -104,56 +157,194 @@ func (e *Engine) replayWALv2() error {
 
 	// After replay, always checkpoint to clear the WAL.
 	// This prevents the same entries from being replayed again on the next startup.
-	// flushAll() persists the current state (segments already have latest data,
-	// but legacy Docs collections need flushing).
+	return e.checkpoint()
+}
+
+// checkpoint makes every collection durable, then drops the WAL entries
+// that all of them have absorbed. An entry is only dropped once its
+// collection's durable LSN has reached it.
+func (e *Engine) checkpoint() error {
+	// Every entry up to limit was applied by the time flushAll has taken
+	// its collection's lock: changes are logged and stored under c.mu
+	limit := e.walv2.LastSequence()
 	if err := e.flushAll(); err != nil {
 		return err
 	}
-	if err := e.walv2.Checkpoint(); err != nil {
-		return err
-	}
 
-	if len(entries) > 0 {
-		// Log how many entries were replayed so it's visible on startup
-		_ = len(entries) // already printed by walv2.Replay()
-	}
+	cut := limit
+	e.forEachCollection(func(db *Database, c *Collection) {
+		sm := c.segments()
+		if sm == nil {
+			// data.db is rewritten and fsynced on every change
+			return
+		}
+		if applied, durable := sm.LSNs(); applied > durable && durable < cut {
+			cut = durable
+		}
+	})
+	return e.walv2.CheckpointUpTo(cut)
+}
 
-	return nil
+// maxDurableLSN returns the highest LSN any collection has stored.
+func (e *Engine) maxDurableLSN() int64 {
+	var max int64
+	e.forEachCollection(func(db *Database, c *Collection) {
+		if sm := c.segments(); sm != nil {
+			if _, durable := sm.LSNs(); durable > max {
+				max = durable
+			}
+		}
+	})
+	return max
 }
 
+// forEachCollection calls fn for every open collection without holding
+// the engine or database locks while fn runs.
+func (e *Engine) forEachCollection(fn func(db *Database, c *Collection)) {
+	e.mu.RLock()
+	databases := make([]*Database, 0, len(e.databases))
+	for _, db := range e.databases {
+		databases = append(databases, db)
+	}
+	e.mu.RUnlock()
 
-func (e *Engine) WALStats() map[string]any {
+	for _, db := range databases {
+		db.mu.RLock()
+		collections := make([]*Collection, 0, len(db.collections))
+		for _, c := range db.collections {
+			collections = append(collections, c)
+		}
+		db.mu.RUnlock()
 
-	e.walMu.Lock()
-	defer e.walMu.Unlock()
+		for _, c := range collections {
+			fn(db, c)
+		}
+	}
+}
+
+// replayEntry applies one WAL entry and returns how many documents it
+// changed.
+//
+// A segment collection knows the LSN of the last change it stored, so
+// older entries are skipped outright and newer ones applied as logged. The
+// entry at that LSN itself is applied idempotently, since a crash may have
+// cut a multi-document entry short: an insert is skipped when its _id is
+// already stored, an update image is only written when storage holds
+// something different, and a delete only when the document is still
+// there. Legacy collections have no LSNs and replay every entry that way.
+//
+// Entries written before update/delete were logged physically (no IDs) are
+// re-run from their filter, as they always were.
+func (e *Engine) replayEntry(entry *WALEntryV2) (int, error) {
+	if entry.Op == "txn" {
+		return e.replayTxn(entry)
+	}
 
-	info, err := os.Stat(e.cfg.WALFile)
+	db, err := e.getOrCreateDB(entry.DB)
+	if err != nil {
+		return 0, err
+	}
+	c, err := db.getOrCreateCollection(e.cfg, entry.Collection)
 	if err != nil {
-		return map[string]any{
-			"size":  0,
-			"error": err.Error(),
+		return 0, err
+	}
+
+	exact := false
+	if sm := c.segments(); sm != nil {
+		applied, _ := sm.LSNs()
+		if entry.Sequence < applied {
+			return 0, nil
 		}
+		exact = entry.Sequence > applied
 	}
 
-	// count entries
-	file, err := os.Open(e.cfg.WALFile)
-	if err != nil {
-		return map[string]any{
-			"size": info.Size(),
+	if entry.Op != "insert" && len(entry.IDs) == 0 {
+		filter, _ := canonicalizeAny(entry.Filter).(map[string]any)
+		update, _ := canonicalizeAny(entry.Update).(map[string]any)
+		switch entry.Op {
+		case "update":
+			return e.Update(entry.DB, entry.Collection, filter, update, entry.Multi, false)
+		case "delete":
+			return e.Delete(entry.DB, entry.Collection, filter, entry.Multi, false)
 		}
+		return 0, fmt.Errorf("unknown op %q", entry.Op)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	count := 0
+	var images []map[string]any
+	switch entry.Op {
+	case "insert":
+		images = []map[string]any{entry.Doc}
+	case "update":
+		images = entry.Docs
+	}
 
-	for scanner.Scan() {
-		count++
+	c.mu.Lock()
+	changed := 0
+	var ticket commitTicket
+	for _, img := range images {
+		doc := canonicalizeDocument(img)
+		if !exact {
+			cur, ok, err := c.getDocLocked(fmt.Sprintf("%v", doc["_id"]))
+			if err != nil {
+				c.mu.Unlock()
+				return changed, err
+			}
+			if ok && (entry.Op == "insert" || sameDocument(cur, doc)) {
+				continue
+			}
+		}
+		if ticket, err = c.putDocLocked(doc, entry.Sequence); err != nil {
+			c.mu.Unlock()
+			return changed, err
+		}
+		changed++
+	}
+	if entry.Op == "delete" {
+		for _, id := range entry.IDs {
+			removed, t, err := c.removeDocLocked(id, entry.Sequence)
+			if err != nil {
+				c.mu.Unlock()
+				return changed, err
+			}
+			if removed {
+				ticket = t
+				changed++
+			}
+		}
 	}
+	c.mu.Unlock()
 
-	return map[string]any{
-		"file":    e.cfg.WALFile,
-		"size":    info.Size(),
-		"entries": count,
+	return changed, ticket.Wait()
+}
+
+// replayTxn applies the changes of a transaction, each against the LSNs of
+// its own collection. A transaction is logged as a single entry, so replay
+// gets all of its changes or, if the entry was torn, none.
+func (e *Engine) replayTxn(entry *WALEntryV2) (int, error) {
+	changed := 0
+	for _, op := range entry.Ops {
+		change := *op
+		change.Sequence, change.Timestamp = entry.Sequence, entry.Timestamp
+		n, err := e.replayEntry(&change)
+		changed += n
+		if err != nil {
+			return changed, fmt.Errorf("%s %s/%s: %w", op.Op, op.DB, op.Collection, err)
+		}
 	}
+	return changed, nil
+}
+
+// sameDocument reports whether two documents have the same JSON form, which
+// is what a WAL image preserves.
+func sameDocument(a, b types.Document) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+
+// WALStats reports the WAL position and its live and archived files,
+// reading the archived ones too if scanArchive is set.
+func (e *Engine) WALStats(scanArchive bool) map[string]any {
+	return e.walv2.Stats(scanArchive)
 }
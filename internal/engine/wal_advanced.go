@@ -20,26 +20,47 @@ type WALv2 struct {
 	writer      *bufio.Writer
 	mu          sync.Mutex
 	sequence    int64
-	batchCount  int
+	committer   *groupCommitter // shares fsyncs between writers
 	lastSync    time.Time
 	lastCheckpoint time.Time
 
 	// Batch mode
 	batchBuffer []*WALEntryV2
 	batchMu     sync.Mutex
+
+	files         []walFile // live WAL files, oldest first; the last is active
+	activeSize    int64     // bytes written to the active file
+	checkpointLSN int64     // entries up to here are in storage
+
+	changes *changeHub // change stream subscribers
+}
+
+// WALCheckpointFile, in WALDir, records the WAL position at the last
+// checkpoint so sequence numbers keep increasing after the WAL file has
+// been emptied.
+const WALCheckpointFile = "CHECKPOINT"
+
+type walCheckpoint struct {
+	LSN      int64     `json:"lsn"`      // entries up to here were dropped
+	Sequence int64     `json:"sequence"` // last sequence handed out
+	Time     time.Time `json:"time"`
 }
 
 type WALEntryV2 struct {
-	Sequence   int64          `json:"seq"`
-	Timestamp  int64          `json:"ts"`
-	Op         string         `json:"op"`
-	DB         string         `json:"db"`
-	Collection string         `json:"coll"`
-	Doc        map[string]any `json:"doc,omitempty"`
-	Filter     map[string]any `json:"filter,omitempty"`
-	Update     map[string]any `json:"update,omitempty"`
-	Multi      bool           `json:"multi,omitempty"`
-	CRC        uint32         `json:"-"` // Computed, not stored in JSON
+	Sequence   int64            `json:"seq"`
+	Timestamp  int64            `json:"ts"`
+	Op         string           `json:"op"`
+	DB         string           `json:"db"`
+	Collection string           `json:"coll"`
+	Doc        map[string]any   `json:"doc,omitempty"`
+	Filter     map[string]any   `json:"filter,omitempty"`
+	Update     map[string]any   `json:"update,omitempty"`
+	Multi      bool             `json:"multi,omitempty"`
+	IDs        []string         `json:"ids,omitempty"`    // update/delete: affected _ids
+	Docs       []map[string]any `json:"docs,omitempty"`   // update: resulting documents
+	Ops        []*WALEntryV2    `json:"ops,omitempty"`    // txn: the changes, without seq or ts
+	Aborts     int64            `json:"aborts,omitempty"` // abort: the write that failed
+	CRC        uint32           `json:"-"`                // Computed, not stored in JSON
 }
 
 func NewWALv2(cfg Config) (*WALv2, error) {
@@ -52,60 +73,74 @@ func NewWALv2(cfg Config) (*WALv2, error) {
 		}
 	}
 
-	file, err := os.OpenFile(cfg.WALFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return nil, err
-	}
-
 	wal := &WALv2{
 		cfg:         cfg,
-		file:        file,
-		writer:      bufio.NewWriter(file),
 		lastSync:    time.Now(),
 		lastCheckpoint: time.Now(),
 		batchBuffer: make([]*WALEntryV2, 0, cfg.WALBatchSize),
 	}
 
-	// Get current sequence
-	wal.sequence = wal.getLastSequence()
-
-	// Start background sync if async mode
-	if cfg.WALSyncMode == WALSyncAsync {
-		go wal.asyncSyncLoop()
+	// Open the active file and get the current sequence, which never
+	// goes back below the last checkpoint's
+	var floor int64
+	if cp, err := readWALCheckpoint(cfg.WALDir); err == nil {
+		floor = cp.Sequence
+		wal.checkpointLSN = cp.LSN
 	}
+	if err := wal.openFiles(floor); err != nil {
+		return nil, err
+	}
+
+	wal.changes = newChangeHub(wal.sequence)
 
-	// Start background batch flush if batch mode
-	if cfg.WALSyncMode == WALSyncBatch {
-		go wal.batchFlushLoop()
+	// Appends return a ticket that completes with the fsync covering them
+	// (see groupCommitter); in async mode its loop syncs on a timer
+	wal.committer = newGroupCommitter(cfg.WALSyncMode, cfg.WALBatchSize, cfg.GroupCommitDelay, cfg.WALBatchTimeout, wal.syncActive)
+
+	// Entries nobody waits for still reach the disk within WALBatchTimeout
+	if cfg.WALSyncMode != WALSyncAsync && cfg.WALBatchTimeout > 0 {
+		go wal.flushLoop()
 	}
 
 	fmt.Printf("✅ WAL v2 initialized (mode: %s)\n", cfg.WALSyncMode)
 	return wal, nil
 }
 
-// Append entry to WAL
-func (w *WALv2) Append(entry WALEntry) error {
+// Append writes an entry to the WAL and returns its sequence number (LSN)
+// and a ticket that completes once the entry is durable. The entry has
+// reached the OS when Append returns; waiting on the ticket lets writers
+// share one fsync. Change streams see the entry once it is durable.
+func (w *WALv2) Append(entry WALEntry) (int64, commitTicket, error) {
+	return w.append(entry, true)
+}
+
+// appendUnsettled is Append for a write that is stored after it is
+// logged: change streams don't see the entry until Settle reports whether
+// it was stored.
+func (w *WALv2) appendUnsettled(entry WALEntry) (int64, commitTicket, error) {
+	return w.append(entry, false)
+}
+
+// Settle reports whether the write logged at seq by appendUnsettled was
+// stored, letting change streams see it or skip it.
+func (w *WALv2) Settle(seq int64, stored bool) {
+	w.changes.settle(seq, stored)
+}
+
+func (w *WALv2) append(entry WALEntry, settled bool) (int64, commitTicket, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	w.sequence++
+	seq := w.sequence + 1
 
-	entryV2 := &WALEntryV2{
-		Sequence:   w.sequence,
-		Timestamp:  time.Now().UnixNano(),
-		Op:         entry.Op,
-		DB:         entry.DB,
-		Collection: entry.Collection,
-		Doc:        entry.Doc,
-		Filter:     entry.Filter,
-		Update:     entry.Update,
-		Multi:      entry.Multi,
-	}
+	entryV2 := newWALEntryV2(entry)
+	entryV2.Sequence = seq
+	entryV2.Timestamp = time.Now().UnixNano()
 
 	// Serialize to JSON
 	data, err := json.Marshal(entryV2)
 	if err != nil {
-		return err
+		return 0, commitTicket{}, err
 	}
 
 	// Compute CRC
@@ -116,7 +151,7 @@ func (w *WALv2) Append(entry WALEntry) error {
 	
 	// Length
 	if err := binary.Write(buf, binary.LittleEndian, uint32(len(data))); err != nil {
-		return err
+		return 0, commitTicket{}, err
 	}
 	
 	// Data
@@ -124,7 +159,7 @@ func (w *WALv2) Append(entry WALEntry) error {
 	
 	// CRC
 	if err := binary.Write(buf, binary.LittleEndian, entryV2.CRC); err != nil {
-		return err
+		return 0, commitTicket{}, err
 	}
 	
 	// Newline
@@ -132,27 +167,52 @@ func (w *WALv2) Append(entry WALEntry) error {
 
 	// Write to file
 	if _, err := w.writer.Write(buf.Bytes()); err != nil {
-		return err
+		return 0, commitTicket{}, err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return 0, commitTicket{}, err
 	}
 
-	w.batchCount++
-
-	// Sync based on mode
-	switch w.cfg.WALSyncMode {
-	case WALSyncImmediate:
-		return w.syncNow()
-	case WALSyncBatch:
-		if w.batchCount >= w.cfg.WALBatchSize {
-			return w.syncNow()
+	// The sequence is only consumed once the entry is in the log
+	w.sequence = seq
+	w.activeSize += int64(buf.Len())
+	ticket := w.committer.noteWrite()
+	w.changes.hold(seq, data, settled)
+
+	if w.cfg.WALSegmentSize > 0 && w.activeSize >= w.cfg.WALSegmentSize {
+		// The entry is logged either way; a failed rotation is retried
+		// on the next append
+		if err := w.rotateLocked(); err != nil {
+			fmt.Printf("⚠️  WAL rotation failed: %v\n", err)
 		}
-	case WALSyncAsync:
-		// Will sync on timer
 	}
+	return seq, ticket, nil
+}
 
-	return nil
+// newWALEntryV2 converts an entry, and the changes of a transaction, to
+// the logged form.
+func newWALEntryV2(entry WALEntry) *WALEntryV2 {
+	entryV2 := &WALEntryV2{
+		Op:         entry.Op,
+		DB:         entry.DB,
+		Collection: entry.Collection,
+		Doc:        entry.Doc,
+		Filter:     entry.Filter,
+		Update:     entry.Update,
+		Multi:      entry.Multi,
+		IDs:        entry.IDs,
+		Aborts:     entry.Aborts,
+	}
+	for _, d := range entry.Docs {
+		entryV2.Docs = append(entryV2.Docs, d)
+	}
+	for _, op := range entry.Ops {
+		entryV2.Ops = append(entryV2.Ops, newWALEntryV2(op))
+	}
+	return entryV2
 }
 
-// Sync to disk
+// syncNow makes every entry written so far durable. Caller must hold w.mu.
 func (w *WALv2) syncNow() error {
 	if err := w.writer.Flush(); err != nil {
 		return err
@@ -160,110 +220,177 @@ func (w *WALv2) syncNow() error {
 	if err := w.file.Sync(); err != nil {
 		return err
 	}
-	w.batchCount = 0
 	w.lastSync = time.Now()
+	w.committer.markSynced()
+	w.changes.durableTo(w.sequence)
 	return nil
 }
 
-// Async sync loop
-func (w *WALv2) asyncSyncLoop() {
-	ticker := time.NewTicker(w.cfg.WALBatchTimeout)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		w.mu.Lock()
-		if w.batchCount > 0 {
-			_ = w.syncNow()
-		}
+// syncActive fsyncs the active file on behalf of the group committer,
+// without holding w.mu so appends continue meanwhile.
+func (w *WALv2) syncActive() error {
+	w.mu.Lock()
+	if err := w.writer.Flush(); err != nil {
 		w.mu.Unlock()
+		return err
 	}
+	file, seq := w.file, w.sequence
+	w.mu.Unlock()
+
+	err := file.Sync()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil && file != w.file {
+		// Rotated meanwhile, which synced the file first
+		return nil
+	}
+	if err == nil {
+		w.lastSync = time.Now()
+		w.changes.durableTo(seq)
+	}
+	return err
 }
 
-// Batch flush loop
-func (w *WALv2) batchFlushLoop() {
+// flushLoop fsyncs entries that are still pending after WALBatchTimeout.
+func (w *WALv2) flushLoop() {
 	ticker := time.NewTicker(w.cfg.WALBatchTimeout)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		w.mu.Lock()
-		if w.batchCount > 0 && time.Since(w.lastSync) > w.cfg.WALBatchTimeout {
-			_ = w.syncNow()
+		if w.committer.pending() > 0 {
+			_ = w.committer.flush()
 		}
-		w.mu.Unlock()
 	}
 }
 
-// Replay WAL entries
+// Replay returns the entries of the live WAL files that the last
+// checkpoint did not cover, in order, up to the first corrupt one.
 func (w *WALv2) Replay() ([]*WALEntryV2, error) {
-	file, err := os.Open(w.cfg.WALFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	defer file.Close()
+	w.mu.Lock()
+	files := append([]walFile(nil), w.files...)
+	from := w.checkpointLSN
+	w.mu.Unlock()
 
 	entries := make([]*WALEntryV2, 0)
-	reader := bufio.NewReader(file)
-
-	for {
-		entry, err := w.readEntry(reader)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
+	for _, f := range files {
+		fileEntries, _, err := scanWALFile(f.path)
+		if err != nil && !os.IsNotExist(err) {
 			// Corruption detected - stop here
-			fmt.Printf("⚠️ WAL corruption at entry %d: %v\n", len(entries), err)
+			fmt.Printf("⚠️ WAL corruption in %s after entry %d: %v\n", filepath.Base(f.path), len(fileEntries), err)
+		}
+		for _, entry := range fileEntries {
+			if entry.Sequence > from {
+				entries = append(entries, entry)
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
 			break
 		}
-		entries = append(entries, entry)
 	}
+	entries = dropAborted(entries)
 
 	fmt.Printf("✅ Replayed %d WAL entries\n", len(entries))
 	return entries, nil
 }
 
-// Read single entry
-func (w *WALv2) readEntry(reader *bufio.Reader) (*WALEntryV2, error) {
+// abortedWrites returns the sequences of the writes that the abort entries
+// among entries cancel. An abort always follows the write it cancels.
+func abortedWrites(entries []*WALEntryV2) map[int64]bool {
+	aborted := map[int64]bool{}
+	for _, entry := range entries {
+		if entry.Op == "abort" {
+			aborted[entry.Aborts] = true
+		}
+	}
+	return aborted
+}
+
+// dropAborted leaves out the writes that an abort entry cancels, and the
+// abort entries themselves.
+func dropAborted(entries []*WALEntryV2) []*WALEntryV2 {
+	aborted := abortedWrites(entries)
+	if len(aborted) == 0 {
+		return entries
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.Op != "abort" && !aborted[entry.Sequence] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// Read single entry and its encoded size. A clean end of input is io.EOF;
+// a partial entry is io.ErrUnexpectedEOF.
+func readEntry(reader *bufio.Reader) (*WALEntryV2, int64, error) {
 	// Read length
 	var length uint32
 	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Read data
 	data := make([]byte, length)
 	if _, err := io.ReadFull(reader, data); err != nil {
-		return nil, err
+		return nil, 0, unexpectedEOF(err)
 	}
 
 	// Read CRC
 	var storedCRC uint32
 	if err := binary.Read(reader, binary.LittleEndian, &storedCRC); err != nil {
-		return nil, err
+		return nil, 0, unexpectedEOF(err)
 	}
+	n := int64(4 + len(data) + 4)
 
 	// Skip newline
-	reader.ReadByte()
+	if _, err := reader.ReadByte(); err == nil {
+		n++
+	}
 
 	// Verify CRC
 	computedCRC := crc32.ChecksumIEEE(data)
 	if computedCRC != storedCRC {
-		return nil, fmt.Errorf("CRC mismatch: expected %d, got %d", storedCRC, computedCRC)
+		return nil, 0, fmt.Errorf("CRC mismatch: expected %d, got %d", storedCRC, computedCRC)
+	}
+
+	entry, err := decodeWALEntry(data)
+	if err != nil {
+		return nil, 0, err
 	}
+	return entry, n, nil
+}
 
-	// Decode JSON
+// decodeWALEntry decodes the JSON of an entry, keeping integers exact (see
+// canonicalizeDocument).
+func decodeWALEntry(data []byte) (*WALEntryV2, error) {
 	var entry WALEntryV2
-	if err := json.Unmarshal(data, &entry); err != nil {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&entry); err != nil {
 		return nil, err
 	}
-
 	return &entry, nil
 }
 
+// unexpectedEOF reports the end of input inside an entry as a torn entry.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 // Checkpoint - save state and archive WAL
 func (w *WALv2) Checkpoint() error {
+	return w.CheckpointUpTo(-1)
+}
+
+// CheckpointUpTo records that storage holds every entry up to sequence
+// cut, so replay starts after it, and retires the WAL files that hold
+// nothing newer. The active file is rotated first when it is one of them.
+// A negative cut covers every entry.
+func (w *WALv2) CheckpointUpTo(cut int64) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -271,40 +398,75 @@ func (w *WALv2) Checkpoint() error {
 	if err := w.syncNow(); err != nil {
 		return err
 	}
-
-	// Close current WAL
-	w.writer.Flush()
-	w.file.Close()
-
-	// Archive current WAL
-	if w.cfg.EnableWALArchive {
-		timestamp := time.Now().Format("20060102_150405")
-		archivePath := filepath.Join(w.cfg.WALArchiveDir, fmt.Sprintf("wal_%s.log", timestamp))
-		
-		if err := os.Rename(w.cfg.WALFile, archivePath); err != nil {
+	if cut < 0 || cut > w.sequence {
+		cut = w.sequence
+	}
+	if w.sequence <= cut {
+		if err := w.rotateLocked(); err != nil {
 			return err
 		}
-		
-		fmt.Printf("📦 WAL archived: %s\n", archivePath)
-	} else {
-		// Just truncate
-		if err := os.Remove(w.cfg.WALFile); err != nil && !os.IsNotExist(err) {
+	}
+
+	// Record the position before any file goes: the WAL that remains may
+	// be empty
+	if err := writeWALCheckpoint(w.cfg.WALDir, walCheckpoint{LSN: cut, Sequence: w.sequence, Time: time.Now()}); err != nil {
+		return err
+	}
+	w.checkpointLSN = cut
+	w.lastCheckpoint = time.Now()
+
+	retired := 0
+	for len(w.files) > 1 && w.files[1].start-1 <= cut {
+		if err := w.retireLocked(w.files[0]); err != nil {
 			return err
 		}
+		w.files = w.files[1:]
+		retired++
 	}
+	if err := w.pruneArchiveLocked(); err != nil {
+		return fmt.Errorf("prune WAL archive: %w", err)
+	}
+
+	fmt.Printf("✅ Checkpoint completed at LSN %d (%d WAL files retired, %d live)\n", cut, retired, len(w.files))
+	return nil
+}
+
+func readWALCheckpoint(walDir string) (*walCheckpoint, error) {
+	b, err := os.ReadFile(filepath.Join(walDir, WALCheckpointFile))
+	if err != nil {
+		return nil, err
+	}
+	var cp walCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
 
-	// Create new WAL file
-	file, err := os.OpenFile(w.cfg.WALFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+func writeWALCheckpoint(walDir string, cp walCheckpoint) error {
+	b, err := json.MarshalIndent(cp, "", "  ")
 	if err != nil {
 		return err
 	}
+	return atomicWriteFile(filepath.Join(walDir, WALCheckpointFile), b, 0644)
+}
 
-	w.file = file
-	w.writer = bufio.NewWriter(file)
-	w.lastCheckpoint = time.Now()
+// LastSequence returns the LSN of the newest entry.
+func (w *WALv2) LastSequence() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sequence
+}
 
-	fmt.Println("✅ Checkpoint completed")
-	return nil
+// AdvanceSequence makes sure new entries get LSNs above lsn. Storage may
+// hold LSNs the current WAL file no longer has once it is checkpointed.
+func (w *WALv2) AdvanceSequence(lsn int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if lsn > w.sequence {
+		w.sequence = lsn
+		w.changes.skipTo(lsn)
+	}
 }
 
 // Auto checkpoint loop
@@ -315,24 +477,20 @@ func (w *WALv2) StartAutoCheckpoint(onCheckpoint func() error) {
 
 		for range ticker.C {
 			// Check if WAL is too large
-			info, err := os.Stat(w.cfg.WALFile)
-			if err != nil {
-				continue
-			}
+			w.mu.Lock()
+			size := w.liveBytesLocked()
+			w.mu.Unlock()
 
-			if info.Size() >= w.cfg.CheckpointWALSize {
+			if size >= w.cfg.CheckpointWALSize {
 				fmt.Println("🔄 Auto-checkpoint triggered (WAL size limit)")
 				
-				// Call external checkpoint callback (save all data)
+				// The callback saves all data and checkpoints the WAL up
+				// to what storage absorbed
+				checkpoint := w.Checkpoint
 				if onCheckpoint != nil {
-					if err := onCheckpoint(); err != nil {
-						fmt.Printf("❌ Checkpoint callback failed: %v\n", err)
-						continue
-					}
+					checkpoint = onCheckpoint
 				}
-
-				// Archive WAL
-				if err := w.Checkpoint(); err != nil {
+				if err := checkpoint(); err != nil {
 					fmt.Printf("❌ Checkpoint failed: %v\n", err)
 				}
 			}
@@ -343,30 +501,6 @@ func (w *WALv2) StartAutoCheckpoint(onCheckpoint func() error) {
 		w.cfg.CheckpointInterval, w.cfg.CheckpointWALSize)
 }
 
-// Get last sequence number
-func (w *WALv2) getLastSequence() int64 {
-	file, err := os.Open(w.cfg.WALFile)
-	if err != nil {
-		return 0
-	}
-	defer file.Close()
-
-	var lastSeq int64
-	reader := bufio.NewReader(file)
-
-	for {
-		entry, err := w.readEntry(reader)
-		if err != nil {
-			break
-		}
-		if entry.Sequence > lastSeq {
-			lastSeq = entry.Sequence
-		}
-	}
-
-	return lastSeq
-}
-
 // Close WAL
 func (w *WALv2) Close() error {
 	w.mu.Lock()
@@ -375,27 +509,72 @@ func (w *WALv2) Close() error {
 	if err := w.syncNow(); err != nil {
 		return err
 	}
+	w.committer.close()
+	w.changes.close()
 
 	return w.file.Close()
 }
 
-// Stats
-func (w *WALv2) Stats() map[string]any {
+// Stats reports the WAL position and every live and archived file. The
+// live files are read to count their entries and find any corruption;
+// the archived ones only when scanArchive is set.
+func (w *WALv2) Stats(scanArchive bool) map[string]any {
 	w.mu.Lock()
-	defer w.mu.Unlock()
+	live, archived := w.fileStatsLocked()
+	stats := map[string]any{
+		"sequence":        w.sequence,
+		"checkpoint_lsn":  w.checkpointLSN,
+		"size":            w.liveBytesLocked(),
+		"batch_count":     w.committer.pending(),
+		"last_sync":       w.lastSync,
+		"last_checkpoint": w.lastCheckpoint,
+		"sync_mode":       w.cfg.WALSyncMode,
+		"segment_size":    w.cfg.WALSegmentSize,
+	}
+	w.mu.Unlock()
 
-	info, _ := os.Stat(w.cfg.WALFile)
-	size := int64(0)
-	if info != nil {
-		size = info.Size()
+	// Read outside the lock: appends only add past each file's limit
+	for i := range live {
+		live[i].scan()
+	}
+	if scanArchive {
+		for i := range archived {
+			archived[i].scan()
+		}
 	}
 
-	return map[string]any{
-		"sequence":       w.sequence,
-		"size":           size,
-		"batch_count":    w.batchCount,
-		"last_sync":      w.lastSync,
-		"last_checkpoint": w.lastCheckpoint,
-		"sync_mode":      w.cfg.WALSyncMode,
+	var entries int
+	var bytes, archivedBytes, first, last int64
+	corruption := []*WALCorruption{}
+	for _, files := range [][]WALFileStats{archived, live} {
+		for _, f := range files {
+			if f.Archived {
+				archivedBytes += f.Bytes
+			}
+			if !f.Scanned {
+				continue
+			}
+			bytes += f.Bytes
+			entries += f.Entries
+			if f.Entries > 0 && (first == 0 || f.FirstLSN < first) {
+				first = f.FirstLSN
+			}
+			if f.LastLSN > last {
+				last = f.LastLSN
+			}
+			if f.Corruption != nil {
+				corruption = append(corruption, f.Corruption)
+			}
+		}
 	}
-}
\ No newline at end of file
+
+	stats["files"] = live
+	stats["archived"] = archived
+	stats["archived_bytes"] = archivedBytes
+	stats["entries"] = entries
+	stats["first_lsn"] = first
+	stats["last_lsn"] = last
+	stats["bytes"] = bytes
+	stats["corruption"] = corruption
+	return stats
+}
@@ -0,0 +1,431 @@
+package engine
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The WAL is a series of files in WALDir, each named by the first LSN it
+// may hold (00000000000000000001.wal). Entries are appended to the last
+// one, which is closed and replaced by a new file once it reaches
+// cfg.WALSegmentSize. A checkpoint retires the files whose every entry
+// storage has absorbed: they are gzip-compressed into WALArchiveDir, or
+// deleted when archiving is off, and the archive is then pruned to the
+// cfg.WALRetention* limits.
+const (
+	walFileExt    = ".wal"
+	walArchiveExt = ".wal.gz"
+)
+
+type walFile struct {
+	start int64 // first LSN the file may hold
+	path  string
+}
+
+func walFileName(start int64) string {
+	return fmt.Sprintf("%020d%s", start, walFileExt)
+}
+
+// parseWALFileName returns the start LSN of a live or archived WAL file.
+func parseWALFileName(name string) (int64, bool) {
+	if !strings.HasSuffix(name, walFileExt) && !strings.HasSuffix(name, walArchiveExt) {
+		return 0, false
+	}
+	var start int64
+	if _, err := fmt.Sscanf(name, "%020d", &start); err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+// listWALFiles returns the live WAL files of dir, oldest first.
+func listWALFiles(dir string) ([]walFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []walFile
+	for _, ent := range entries {
+		if ent.IsDir() || filepath.Ext(ent.Name()) != walFileExt {
+			continue
+		}
+		if start, ok := parseWALFileName(ent.Name()); ok {
+			files = append(files, walFile{start: start, path: filepath.Join(dir, ent.Name())})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].start < files[j].start })
+	return files, nil
+}
+
+// openFiles finds the live WAL files and opens the last one for appending,
+// creating the first file if there is none. A wal.log left by the
+// single-file layout becomes the first file. Caller must have exclusive
+// access (startup).
+func (w *WALv2) openFiles(floor int64) error {
+	files, err := listWALFiles(w.cfg.WALDir)
+	if err != nil {
+		return err
+	}
+
+	if entries, _, err := scanWALFile(w.cfg.WALFile); err == nil || len(entries) > 0 {
+		if len(entries) == 0 {
+			os.Remove(w.cfg.WALFile)
+		} else {
+			f := walFile{start: entries[0].Sequence, path: filepath.Join(w.cfg.WALDir, walFileName(entries[0].Sequence))}
+			if err := os.Rename(w.cfg.WALFile, f.path); err != nil {
+				return fmt.Errorf("convert %s: %w", w.cfg.WALFile, err)
+			}
+			files = append([]walFile{f}, files...)
+			sort.Slice(files, func(i, j int) bool { return files[i].start < files[j].start })
+		}
+	}
+
+	if len(files) == 0 {
+		files = []walFile{{start: floor + 1, path: filepath.Join(w.cfg.WALDir, walFileName(floor+1))}}
+	}
+	active := files[len(files)-1]
+
+	// A crash may have torn the last entry: cut it off, or entries
+	// appended after it would be unreadable
+	entries, good, scanErr := scanWALFile(active.path)
+	if scanErr != nil && !errors.Is(scanErr, os.ErrNotExist) {
+		fmt.Printf("⚠️  WAL %s: dropping torn tail after %d entries: %v\n", filepath.Base(active.path), len(entries), scanErr)
+		if err := os.Truncate(active.path, good); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(active.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	w.files = files
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+	w.activeSize = good
+
+	w.sequence = active.start - 1
+	if len(entries) > 0 {
+		w.sequence = entries[len(entries)-1].Sequence
+	}
+	if floor > w.sequence {
+		w.sequence = floor
+	}
+	return nil
+}
+
+// rotateLocked closes the active file and starts a new one at the next
+// LSN. An empty active file is kept. Caller must hold w.mu.
+func (w *WALv2) rotateLocked() error {
+	if w.activeSize == 0 {
+		return nil
+	}
+	if err := w.syncNow(); err != nil {
+		return err
+	}
+
+	next := walFile{start: w.sequence + 1, path: filepath.Join(w.cfg.WALDir, walFileName(w.sequence+1))}
+	file, err := os.OpenFile(next.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.writer.Reset(file)
+	w.files = append(w.files, next)
+	w.activeSize = 0
+	return nil
+}
+
+// retireLocked archives or deletes a WAL file that is no longer needed
+// for recovery. Caller must hold w.mu.
+func (w *WALv2) retireLocked(f walFile) error {
+	if w.cfg.EnableWALArchive {
+		dst := filepath.Join(w.cfg.WALArchiveDir, strings.TrimSuffix(filepath.Base(f.path), walFileExt)+walArchiveExt)
+		if err := gzipFile(f.path, dst); err != nil {
+			return fmt.Errorf("archive %s: %w", filepath.Base(f.path), err)
+		}
+		fmt.Printf("📦 WAL archived: %s\n", dst)
+	}
+	return os.Remove(f.path)
+}
+
+// archivedWALFile is a file of the WAL archive, including those named by
+// time before the WAL was split into LSN-named files.
+type archivedWALFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func listArchivedWALFiles(dir string) ([]archivedWALFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []archivedWALFile
+	for _, ent := range entries {
+		name := ent.Name()
+		if ent.IsDir() || !(strings.HasSuffix(name, walArchiveExt) || strings.HasSuffix(name, ".log")) {
+			continue
+		}
+		info, err := ent.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, archivedWALFile{path: filepath.Join(dir, name), size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.Before(files[j].modTime)
+		}
+		return files[i].path < files[j].path
+	})
+	return files, nil
+}
+
+// pruneArchiveLocked deletes the oldest archived files until the archive
+// is within the configured age, count and size limits. Point-in-time
+// restore can't go back past the oldest file left. Caller must hold w.mu.
+func (w *WALv2) pruneArchiveLocked() error {
+	age, count, bytes := w.cfg.WALRetentionAge, w.cfg.WALRetentionCount, w.cfg.WALRetentionBytes
+	if !w.cfg.EnableWALArchive || (age <= 0 && count <= 0 && bytes <= 0) {
+		return nil
+	}
+	files, err := listArchivedWALFiles(w.cfg.WALArchiveDir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	left := len(files)
+	for _, f := range files {
+		expired := age > 0 && time.Since(f.modTime) > age
+		if !expired && (count <= 0 || left <= count) && (bytes <= 0 || total <= bytes) {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		left--
+		total -= f.size
+	}
+	return nil
+}
+
+// gzipFile writes a gzip-compressed copy of src to dst.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(src)
+	if _, err := io.Copy(zw, in); err != nil {
+		return fail(err)
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := out.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// WALCorruption locates the point where a WAL file stops being readable:
+// a torn entry at the end of the active file after a crash, or damage.
+// Offsets count uncompressed bytes from the start of the file.
+type WALCorruption struct {
+	File     string `json:"file"`
+	Offset   int64  `json:"offset"`
+	Entry    int    `json:"entry"`     // index of the unreadable entry in the file
+	AfterLSN int64  `json:"after_lsn"` // last LSN read before it
+	Err      string `json:"error"`
+}
+
+func (c *WALCorruption) Error() string {
+	return fmt.Sprintf("%s: entry %d at offset %d (after LSN %d): %s", filepath.Base(c.File), c.Entry, c.Offset, c.AfterLSN, c.Err)
+}
+
+// walkWALFile calls fn with each intact entry of a WAL file,
+// gzip-compressed if its name ends in .gz, reading at most limit bytes
+// unless limit is negative. It returns the length of the intact prefix
+// and, unless the file ends cleanly, a *WALCorruption. An error from fn
+// ends the walk and is returned as is.
+func walkWALFile(path string, limit int64, fn func(*WALEntryV2) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	corrupt := &WALCorruption{File: path}
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			corrupt.Err = err.Error()
+			return 0, corrupt
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+
+	reader := bufio.NewReader(r)
+	for {
+		entry, n, err := readEntry(reader)
+		if err == io.EOF {
+			return corrupt.Offset, nil
+		}
+		if err != nil {
+			corrupt.Err = err.Error()
+			return corrupt.Offset, corrupt
+		}
+		if err := fn(entry); err != nil {
+			return corrupt.Offset, err
+		}
+		corrupt.Offset += n
+		corrupt.Entry++
+		corrupt.AfterLSN = entry.Sequence
+	}
+}
+
+// scanWALFile reads the entries of a WAL file up to the first torn or
+// corrupt one. It returns the entries, the length of the intact prefix,
+// and what stopped the scan (nil at a clean end of file).
+func scanWALFile(path string) ([]*WALEntryV2, int64, error) {
+	var entries []*WALEntryV2
+	good, err := walkWALFile(path, -1, func(entry *WALEntryV2) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, good, err
+}
+
+// readWALFile reads the intact entries of a WAL file, stopping at the
+// first torn or corrupt one.
+func readWALFile(path string) ([]*WALEntryV2, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	entries, _, _ := scanWALFile(path)
+	return entries, nil
+}
+
+// WALFileStats describes one live or archived WAL file. The entry counts
+// and LSNs are only filled in once the file has been read (Scanned).
+type WALFileStats struct {
+	Name       string         `json:"name"`
+	StartLSN   int64          `json:"start_lsn"`
+	EndLSN     int64          `json:"end_lsn"` // last LSN the file can hold
+	Bytes      int64          `json:"bytes"`
+	Modified   time.Time      `json:"modified"`
+	Active     bool           `json:"active,omitempty"`
+	Archived   bool           `json:"archived,omitempty"`
+	Scanned    bool           `json:"scanned"`
+	Entries    int            `json:"entries"`
+	FirstLSN   int64          `json:"first_lsn,omitempty"`
+	LastLSN    int64          `json:"last_lsn,omitempty"`
+	Corruption *WALCorruption `json:"corruption,omitempty"`
+
+	path  string
+	limit int64 // bytes to read: the complete entries of the active file
+}
+
+// fileStatsLocked describes the live and archived files, in LSN order,
+// without reading them (see scan). Caller must hold w.mu.
+func (w *WALv2) fileStatsLocked() (live, archived []WALFileStats) {
+	archiveDir := ""
+	if w.cfg.EnableWALArchive {
+		archiveDir = w.cfg.WALArchiveDir
+	}
+	// Appends may be under way: only read what was complete
+	return describeWALFiles(w.files, archiveDir, w.sequence, w.activeSize)
+}
+
+// describeWALFiles describes the live files and those of archiveDir, if
+// set. The last live file ends at end, and only its first activeLimit
+// bytes are to be read (all of it if activeLimit is negative).
+func describeWALFiles(files []walFile, archiveDir string, end, activeLimit int64) (live, archived []WALFileStats) {
+	if archiveDir != "" {
+		list, _ := listArchivedWALFiles(archiveDir)
+		for _, f := range list {
+			st := WALFileStats{Name: filepath.Base(f.path), Bytes: f.size, Modified: f.modTime, Archived: true, StartLSN: -1, EndLSN: -1, path: f.path, limit: -1}
+			if start, ok := parseWALFileName(st.Name); ok {
+				st.StartLSN = start
+			}
+			archived = append(archived, st)
+		}
+		sort.SliceStable(archived, func(i, j int) bool { return archived[i].StartLSN < archived[j].StartLSN })
+	}
+
+	for i, f := range files {
+		st := WALFileStats{Name: filepath.Base(f.path), StartLSN: f.start, EndLSN: end, path: f.path, limit: -1}
+		if i+1 < len(files) {
+			st.EndLSN = files[i+1].start - 1
+		} else {
+			st.Active = true
+			st.limit = activeLimit
+		}
+		if info, err := os.Stat(f.path); err == nil {
+			st.Bytes, st.Modified = info.Size(), info.ModTime()
+		}
+		live = append(live, st)
+	}
+
+	// An archived file ends where the next file starts
+	for i := range archived {
+		if archived[i].StartLSN < 0 {
+			continue
+		}
+		if i+1 < len(archived) {
+			archived[i].EndLSN = archived[i+1].StartLSN - 1
+		} else if len(live) > 0 {
+			archived[i].EndLSN = live[0].StartLSN - 1
+		}
+	}
+	return live, archived
+}
+
+// liveBytesLocked returns the total size of the live WAL files. Caller
+// must hold w.mu.
+func (w *WALv2) liveBytesLocked() int64 {
+	var total int64
+	for _, f := range w.files[:len(w.files)-1] {
+		if info, err := os.Stat(f.path); err == nil {
+			total += info.Size()
+		}
+	}
+	return total + w.activeSize
+}
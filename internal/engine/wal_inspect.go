@@ -0,0 +1,241 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WALFilter selects the entries a WAL inspection returns. Zero fields
+// match everything.
+type WALFilter struct {
+	DB         string
+	Collection string
+	Op         string
+	FromSeq    int64     // first sequence
+	ToSeq      int64     // last sequence
+	Since      time.Time // first commit time
+	Until      time.Time // last commit time
+	Archive    bool      // read the archived files too
+}
+
+func (f *WALFilter) match(entry *WALEntryV2) bool {
+	switch {
+	case !f.matchTarget(entry):
+		return false
+	case f.FromSeq > 0 && entry.Sequence < f.FromSeq:
+		return false
+	case f.ToSeq > 0 && entry.Sequence > f.ToSeq:
+		return false
+	case !f.Since.IsZero() && entry.Timestamp < f.Since.UnixNano():
+		return false
+	case !f.Until.IsZero() && entry.Timestamp > f.Until.UnixNano():
+		return false
+	}
+	return true
+}
+
+// matchTarget matches the database, collection and op of an entry. A
+// transaction matches when any of its changes does, or when Op is "txn"
+// and the others match one of its changes.
+func (f *WALFilter) matchTarget(entry *WALEntryV2) bool {
+	if entry.Op == "txn" {
+		for _, op := range entry.Ops {
+			sub := *f
+			if f.Op == "txn" {
+				sub.Op = ""
+			}
+			if sub.matchTarget(op) {
+				return true
+			}
+		}
+		return false
+	}
+	return (f.DB == "" || entry.DB == f.DB) &&
+		(f.Collection == "" || entry.Collection == f.Collection) &&
+		(f.Op == "" || entry.Op == f.Op)
+}
+
+// skips reports whether none of a file's entries can be in the sequence
+// range, going by the LSNs its name gives.
+func (f *WALFilter) skips(st *WALFileStats) bool {
+	if f.FromSeq > 0 && st.EndLSN >= 0 && st.EndLSN < f.FromSeq {
+		return true
+	}
+	return f.ToSeq > 0 && st.StartLSN > f.ToSeq
+}
+
+// WALDumpLine is one line of a WAL dump: an entry, with its commit time
+// spelled out, or the corruption a file stops at.
+type WALDumpLine struct {
+	*WALEntryV2
+	Time       string         `json:"time,omitempty"`
+	Corruption *WALCorruption `json:"corruption,omitempty"`
+}
+
+// WALDumpSummary counts what a WAL dump wrote.
+type WALDumpSummary struct {
+	Files       int              `json:"files"`
+	Entries     int              `json:"entries"`
+	FirstLSN    int64            `json:"first_lsn,omitempty"`
+	LastLSN     int64            `json:"last_lsn,omitempty"`
+	Corruptions []*WALCorruption `json:"corruptions,omitempty"`
+}
+
+// errStopWalk ends the walk of a file once past the sequence range.
+var errStopWalk = errors.New("stop")
+
+// walkWAL reads files in order and calls fn with each entry the filter
+// matches and corrupt with each file that doesn't end cleanly. Files
+// overlap only when archived by older versions, so each sequence is
+// passed on once, the first time it is read. A live file retired while
+// the walk is under way is read from archiveDir.
+func walkWAL(files []WALFileStats, archiveDir string, filter WALFilter, fn func(*WALEntryV2) error, corrupt func(*WALCorruption) error) (int, error) {
+	var last int64
+	read := 0
+	for i := range files {
+		st := &files[i]
+		if filter.skips(st) {
+			continue
+		}
+		visit := func(entry *WALEntryV2) error {
+			if entry.Sequence <= last {
+				return nil
+			}
+			last = entry.Sequence
+			if filter.ToSeq > 0 && entry.Sequence > filter.ToSeq {
+				return errStopWalk
+			}
+			if !filter.match(entry) {
+				return nil
+			}
+			return fn(entry)
+		}
+
+		_, err := walkWALFile(st.path, st.limit, visit)
+		if errors.Is(err, os.ErrNotExist) && !st.Archived && archiveDir != "" {
+			moved := filepath.Join(archiveDir, strings.TrimSuffix(st.Name, walFileExt)+walArchiveExt)
+			_, err = walkWALFile(moved, -1, visit)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			// Retired and not archived, or pruned
+			continue
+		}
+		read++
+
+		var c *WALCorruption
+		switch {
+		case errors.As(err, &c):
+			if c.Entry == 0 {
+				// Nothing intact in this file: locate it after the last read
+				c.AfterLSN = last
+			}
+			if err := corrupt(c); err != nil {
+				return read, err
+			}
+		case err == errStopWalk:
+			return read, nil
+		case err != nil:
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// dumpWAL writes the matching entries of files to out as NDJSON, with a
+// line for each corruption met where it is met.
+func dumpWAL(out io.Writer, files []WALFileStats, archiveDir string, filter WALFilter) (*WALDumpSummary, error) {
+	enc := json.NewEncoder(out)
+	sum := &WALDumpSummary{}
+	n, err := walkWAL(files, archiveDir, filter, func(entry *WALEntryV2) error {
+		if sum.Entries == 0 {
+			sum.FirstLSN = entry.Sequence
+		}
+		sum.Entries++
+		sum.LastLSN = entry.Sequence
+		return enc.Encode(WALDumpLine{
+			WALEntryV2: entry,
+			Time:       time.Unix(0, entry.Timestamp).UTC().Format(time.RFC3339Nano),
+		})
+	}, func(c *WALCorruption) error {
+		sum.Corruptions = append(sum.Corruptions, c)
+		return enc.Encode(WALDumpLine{Corruption: c})
+	})
+	sum.Files = n
+	return sum, err
+}
+
+// DumpWAL writes the WAL entries of walDir, and of archiveDir when the
+// filter asks for the archive, to out as NDJSON. It reads the files
+// directly, for use on a data directory no server is running on; a
+// running engine is inspected through Engine.DumpWAL. A wal.log left by
+// the single-file layout is read before the LSN-named files.
+func DumpWAL(out io.Writer, walDir, archiveDir string, filter WALFilter) (*WALDumpSummary, error) {
+	files, err := listWALFiles(walDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !filter.Archive {
+		archiveDir = ""
+	}
+	live, archived := describeWALFiles(files, archiveDir, -1, -1)
+
+	legacy := filepath.Join(walDir, "wal.log")
+	if info, err := os.Stat(legacy); err == nil {
+		st := WALFileStats{Name: "wal.log", StartLSN: -1, EndLSN: -1, Bytes: info.Size(), Modified: info.ModTime(), path: legacy, limit: -1}
+		live = append([]WALFileStats{st}, live...)
+	}
+	return dumpWAL(out, append(archived, live...), "", filter)
+}
+
+// DumpWAL writes the entries of the running WAL to out as NDJSON (see
+// WALDumpLine). Appends go on meanwhile; entries written after the call
+// started are left out.
+func (e *Engine) DumpWAL(out io.Writer, filter WALFilter) (*WALDumpSummary, error) {
+	return e.walv2.dump(out, filter)
+}
+
+func (w *WALv2) dump(out io.Writer, filter WALFilter) (*WALDumpSummary, error) {
+	w.mu.Lock()
+	live, archived := w.fileStatsLocked()
+	w.mu.Unlock()
+
+	files := live
+	if filter.Archive {
+		files = append(archived, live...)
+	}
+	archiveDir := ""
+	if w.cfg.EnableWALArchive {
+		archiveDir = w.cfg.WALArchiveDir
+	}
+	return dumpWAL(out, files, archiveDir, filter)
+}
+
+// scan reads the file and fills in its entry count, LSN range and
+// corruption, if any. A file retired meanwhile is left unscanned.
+func (st *WALFileStats) scan() {
+	st.Entries, st.FirstLSN, st.LastLSN, st.Corruption = 0, 0, 0, nil
+	_, err := walkWALFile(st.path, st.limit, func(entry *WALEntryV2) error {
+		if st.Entries == 0 {
+			st.FirstLSN = entry.Sequence
+		}
+		st.Entries++
+		st.LastLSN = entry.Sequence
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	st.Scanned = true
+	if err != nil {
+		var c *WALCorruption
+		if !errors.As(err, &c) {
+			c = &WALCorruption{File: st.path, Err: err.Error()}
+		}
+		st.Corruption = c
+	}
+}
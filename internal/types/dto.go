@@ -1,9 +1,11 @@
 package types
 
 type InsertRequest struct {
-	DB         string   `json:"db"`
-	Collection string   `json:"collection"`
-	Data       Document `json:"data"`
+	DB           string   `json:"db"`
+	Collection   string   `json:"collection"`
+	Data         Document `json:"data"`
+	WriteConcern string   `json:"writeConcern"` // "", "ack" or "fsync"
+	TxnID        string   `json:"txnId"`        // buffer in this transaction
 }
 
 type QueryRequest struct {
@@ -14,21 +16,83 @@ type QueryRequest struct {
 	Limit      int            `json:"limit"`
 	Skip       int            `json:"skip"`
 	Projection map[string]int `json:"projection"` // {field:1, _id:0}
+	TxnID      string         `json:"txnId"`
+	Explain    bool           `json:"explain"` // also report the query plan and what running it took
+}
+
+// AggregateRequest runs an aggregation pipeline over a collection.
+type AggregateRequest struct {
+	DB         string           `json:"db"`
+	Collection string           `json:"collection"`
+	Pipeline   []map[string]any `json:"pipeline"` // stages, each {"$stage": spec}
 }
 
 type UpdateRequest struct {
-	DB         string         `json:"db"`
-	Collection string         `json:"collection"`
-	Filter     map[string]any `json:"filter"`
-	Update     map[string]any `json:"update"`
-	Multi      bool           `json:"multi"`
+	DB           string         `json:"db"`
+	Collection   string         `json:"collection"`
+	Filter       map[string]any `json:"filter"`
+	Update       map[string]any `json:"update"`
+	Multi        bool           `json:"multi"`
+	WriteConcern string         `json:"writeConcern"`
+	TxnID        string         `json:"txnId"`
+	IfVersion    *int64         `json:"ifVersion"` // only update a document still at this _version
+	Upsert       bool           `json:"upsert"`    // insert a document when nothing matches
 }
 
 type DeleteRequest struct {
-	DB         string         `json:"db"`
-	Collection string         `json:"collection"`
-	Filter     map[string]any `json:"filter"`
-	Multi      bool           `json:"multi"`
+	DB           string         `json:"db"`
+	Collection   string         `json:"collection"`
+	Filter       map[string]any `json:"filter"`
+	Multi        bool           `json:"multi"`
+	WriteConcern string         `json:"writeConcern"`
+	TxnID        string         `json:"txnId"`
+	IfVersion    *int64         `json:"ifVersion"` // only delete a document still at this _version
+}
+
+// FindAndModifyRequest updates or removes one document and returns it.
+type FindAndModifyRequest struct {
+	DB           string         `json:"db"`
+	Collection   string         `json:"collection"`
+	Filter       map[string]any `json:"filter"`
+	Sort         map[string]int `json:"sort"` // picks the match to modify
+	Update       map[string]any `json:"update"`
+	Remove       bool           `json:"remove"`
+	Upsert       bool           `json:"upsert"`
+	New          bool           `json:"new"` // return the post-image instead of the pre-image
+	Projection   map[string]int `json:"projection"`
+	WriteConcern string         `json:"writeConcern"`
+}
+
+// BulkOp is one write in a BulkRequest: insertOne, updateOne, updateMany,
+// deleteOne, deleteMany or replaceOne.
+type BulkOp struct {
+	Op          string         `json:"op"`
+	Doc         Document       `json:"doc"` // insertOne
+	Filter      map[string]any `json:"filter"`
+	Update      map[string]any `json:"update"`
+	Replacement Document       `json:"replacement"` // replaceOne
+	Upsert      bool           `json:"upsert"`
+}
+
+// BulkRequest applies a batch of writes to one collection.
+type BulkRequest struct {
+	DB           string   `json:"db"`
+	Collection   string   `json:"collection"`
+	Ops          []BulkOp `json:"ops"`
+	Ordered      *bool    `json:"ordered"` // default true: stop at the first failed op
+	WriteConcern string   `json:"writeConcern"`
+}
+
+// DocUpdateRequest updates the document named in the /api/doc URL.
+type DocUpdateRequest struct {
+	Update       map[string]any `json:"update"`
+	WriteConcern string         `json:"writeConcern"`
+}
+
+// TxnRequest commits or aborts a transaction started by /api/txn/begin.
+type TxnRequest struct {
+	TxnID        string `json:"txnId"`
+	WriteConcern string `json:"writeConcern"` // commit only
 }
 type CreateIndexRequest struct {
 	DB         string   `json:"db"`